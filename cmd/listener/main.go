@@ -1,6 +1,8 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"fmt"
 	"os"
 	"os/signal"
@@ -10,6 +12,9 @@ import (
 )
 
 func main() {
+	events := flag.Bool("events", false, "print every key event")
+	flag.Parse()
+
 	kl := keyboard.NewKeyboardListener("")
 	// Listen for Windows + I
 	kl.AddCombination("win+i", keyboard.KEY_LEFTMETA, keyboard.KEY_I)
@@ -17,15 +22,22 @@ func main() {
 		fmt.Println("Detected: Windows + I")
 	})
 
-	if err := kl.Start(); err != nil {
-		fmt.Println("Error:", err)
-		return
+	if *events {
+		sub := kl.Subscribe(keyboard.SubscribeOptions{})
+		go func() {
+			for event := range sub.C {
+				fmt.Printf("%s %-10s %-7s (code %d) on %s\n", event.Time.Format("15:04:05.000"), event.Name, event.Action, event.Code, event.Device)
+			}
+		}()
 	}
-	defer kl.Stop()
 
 	// Wait for Ctrl+C to exit
-	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
-	<-c
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if err := kl.Run(ctx); err != nil {
+		fmt.Println("Error:", err)
+		return
+	}
 	fmt.Println("Exiting...")
 }
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	"github.com/mudler/keygeist/keyboard"
+)
+
+// runCtl implements the "ctl" subcommand and returns the exit code
+func runCtl(args []string) int {
+	if len(args) == 0 {
+		args = []string{"status"}
+	}
+
+	result, err := keyboard.ControlRequest(args[0], args[1:]...)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return 1
+	}
+
+	var out bytes.Buffer
+	if err := json.Indent(&out, result, "", "  "); err != nil {
+		fmt.Println(string(result))
+		return 0
+	}
+	fmt.Println(out.String())
+	return 0
+}
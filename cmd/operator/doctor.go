@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/mudler/keygeist/keyboard"
+)
+
+// runDoctor implements the "doctor" subcommand and returns the exit code
+func runDoctor(args []string) int {
+	flags := flag.NewFlagSet("doctor", flag.ExitOnError)
+	skipLLM := flags.Bool("skip-llm", false, "do not send a test request to the LLM endpoint")
+	timeout := flags.Duration("timeout", 30*time.Second, "timeout for the LLM test request")
+	flags.Parse(args)
+
+	results := keyboard.RunDoctor(context.Background(), keyboard.DoctorOptions{
+		APIKey:         os.Getenv("OPENAI_API_KEY"),
+		Model:          os.Getenv("OPENAI_MODEL"),
+		BaseURL:        os.Getenv("OPENAI_BASE_URL"),
+		KeyboardDevice: os.Getenv("KEYBOARD_DEVICE"),
+		SkipLLM:        *skipLLM,
+		Timeout:        *timeout,
+	})
+
+	failed := 0
+	for _, result := range results {
+		fmt.Printf("[%-4s] %s: %s\n", result.Status, result.Name, result.Detail)
+		if result.Fix != "" {
+			fmt.Printf("       fix: %s\n", strings.ReplaceAll(result.Fix, "\n", "\n            "))
+		}
+		if result.Status == keyboard.DoctorFail {
+			failed++
+		}
+	}
+
+	fmt.Println()
+	if failed > 0 {
+		fmt.Printf("%d check(s) failed\n", failed)
+		return 1
+	}
+	fmt.Println("All required checks passed")
+	return 0
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/mudler/keygeist/keyboard"
+)
+
+// runInstall implements the "install" and "uninstall" subcommands and
+// returns the exit code
+func runInstall(name string, args []string) int {
+	opts, err := keyboard.DefaultInstallOptions()
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return 1
+	}
+
+	flags := flag.NewFlagSet(name, flag.ExitOnError)
+	flags.BoolVar(&opts.DryRun, "dry-run", false, "show the changes without applying them")
+	yes := flags.Bool("yes", false, "apply the changes without asking")
+	noUdev := flags.Bool("no-udev", false, "skip the udev rules (which need root)")
+	noSystemd := flags.Bool("no-systemd", false, "skip the systemd user unit")
+	flags.StringVar(&opts.BinaryPath, "binary", opts.BinaryPath, "keygeist binary started by the service")
+	flags.StringVar(&opts.EnvFile, "env-file", opts.EnvFile, "environment file read by the service")
+	flags.StringVar(&opts.UinputGroup, "uinput-group", opts.UinputGroup, "group allowed to use /dev/uinput")
+	flags.StringVar(&opts.InputGroup, "input-group", opts.InputGroup, "group allowed to read input devices")
+	flags.Parse(args)
+
+	opts.Udev = !*noUdev
+	opts.Systemd = !*noSystemd
+	if !*yes {
+		opts.Confirm = confirm
+	}
+
+	if name == "uninstall" {
+		err = keyboard.Uninstall(opts)
+	} else {
+		err = keyboard.Install(opts)
+	}
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// confirm asks a yes/no question on the terminal
+func confirm(prompt string) bool {
+	fmt.Printf("%s [y/N] ", prompt)
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"fmt"
 	"log"
+	"log/slog"
 	"os"
 	"os/exec"
 	"os/signal"
@@ -11,9 +12,51 @@ import (
 	"github.com/mudler/keygeist/keyboard"
 )
 
+func printUsage() {
+	fmt.Println("Usage: keygeist [command]")
+	fmt.Println()
+	fmt.Println("Commands:")
+	fmt.Println("  (none)    - Run the keyboard operator")
+	fmt.Println("  doctor    - Diagnose the setup and suggest fixes")
+	fmt.Println("  install   - Install udev rules and the systemd user unit")
+	fmt.Println("  uninstall - Remove the files written by install")
+	fmt.Println("  mcp       - Serve typing, clipboard and screen tools to MCP clients on stdio")
+	fmt.Println("  ctl       - Send a command to the running operator (status, cancel, pause, resume, help)")
+	fmt.Println("  help      - Show this help")
+}
+
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "doctor":
+			os.Exit(runDoctor(os.Args[2:]))
+		case "install", "uninstall":
+			os.Exit(runInstall(os.Args[1], os.Args[2:]))
+		case "ctl":
+			os.Exit(runCtl(os.Args[2:]))
+		case "mcp":
+			os.Exit(runMCP())
+		case "help", "-h", "--help":
+			printUsage()
+			return
+		default:
+			fmt.Printf("Unknown command: %s\n\n", os.Args[1])
+			printUsage()
+			os.Exit(2)
+		}
+	}
+	runOperator()
+}
+
+func runOperator() {
+	logger, err := keyboard.LoggerFromEnv()
+	if err != nil {
+		log.Fatalf("Invalid logging configuration: %v", err)
+	}
+	slog.SetDefault(logger)
+
 	if _, err := exec.LookPath("zenity"); err != nil {
-		log.Fatal("zenity is not installed. Please install it first.")
+		log.Fatal("zenity is not installed. Please install it first, or run 'keygeist doctor'.")
 	}
 	apiKey := os.Getenv("OPENAI_API_KEY")
 	if apiKey == "" {
@@ -25,24 +68,106 @@ func main() {
 	}
 	baseURL := os.Getenv("OPENAI_BASE_URL")
 	systemPrompt := os.Getenv("OPENAI_SYSTEM_PROMPT")
+
+	// When started as root, open the devices and continue as the invoking
+	// user, whose configuration and files are used from the start
+	target, err := keyboard.ResolvePrivilegeTarget()
+	if err != nil {
+		log.Fatalf("Failed to determine unprivileged user: %v", err)
+	}
+	if target != nil {
+		keyboard.SetUserEnvironment(target)
+	}
+
 	operator, err := keyboard.NewKeyboardOperator(apiKey, model, baseURL, os.Getenv("KEYBOARD_DEVICE"), systemPrompt)
 	if err != nil {
-		log.Fatalf("Failed to create Keygeist: %v", err)
+		log.Fatalf("Failed to create Keygeist: %v (run 'keygeist doctor' for diagnostics)", err)
 	}
 	defer operator.Close()
+	operator.SetLogger(logger)
+
+	if target != nil {
+		if err := operator.OpenDevices(); err != nil {
+			log.Fatalf("Failed to open input devices: %v", err)
+		}
+		if err := keyboard.DropPrivileges(target); err != nil {
+			log.Fatalf("Failed to drop privileges: %v", err)
+		}
+		logger.Info("dropped privileges", "user", target.Username, "uid", target.UID)
+	} else if os.Geteuid() == 0 {
+		logger.Warn("running as root without a user to drop to; set KEYGEIST_USER. Helpers (zenity, screenshot and clipboard tools) are disabled")
+	}
+
+	// Connect after dropping privileges, so the user's session bus is used
+	notifier, err := keyboard.NewNotifier(os.Getenv("KEYGEIST_NOTIFICATIONS"))
+	if err != nil {
+		logger.Warn("desktop notifications disabled", "error", err)
+	} else {
+		operator.SetNotifier(notifier)
+		defer notifier.Close()
+	}
+
+	if os.Getenv("KEYGEIST_TRAY") == "1" {
+		tray, err := keyboard.ConnectTray(operator)
+		if err != nil {
+			logger.Warn("tray icon disabled", "error", err)
+		} else {
+			defer tray.Close()
+		}
+	}
+
+	// MCP servers run as the user too
+	operator.ConnectMCPServers()
+
 	fmt.Println("Keygeist initialized!")
 	fmt.Println("Press the configured key combinations:")
 	fmt.Printf("  - %s for clipboard context\n", operator.GetConfig().ClipboardKey)
 	fmt.Printf("  - %s for screenshot context\n", operator.GetConfig().ScreenshotKey)
 	fmt.Printf("  - %s for all context\n", operator.GetConfig().AllContextKey)
 	fmt.Printf("  - %s for text-only context\n", operator.GetConfig().TextOnlyKey)
+	if operator.KnowledgeEnabled() && operator.GetConfig().KnowledgeKey != "" {
+		fmt.Printf("  - %s for knowledge context\n", operator.GetConfig().KnowledgeKey)
+	}
+	if operator.VoiceEnabled() && operator.GetConfig().VoiceKey != "" {
+		fmt.Printf("  - %s for a spoken prompt\n", operator.GetConfig().VoiceKey)
+	}
+	if operator.GetConfig().PauseKey != "" {
+		fmt.Printf("  - %s to pause or resume all hotkeys\n", operator.GetConfig().PauseKey)
+	}
 	fmt.Println("Press the same combination again to stop current interaction")
 	fmt.Println("Press Ctrl+C to exit")
+
+	// Ping the systemd watchdog from the keyboard event loop, so a wedged loop gets restarted
+	if interval := keyboard.SdWatchdogInterval(); interval > 0 {
+		operator.SetHeartbeat(interval/2, func() {
+			keyboard.SdNotify("WATCHDOG=1")
+		})
+	}
+
 	if err := operator.Start(); err != nil {
 		log.Fatalf("Failed to start Keygeist: %v", err)
 	}
+
+	control, err := keyboard.ListenControl()
+	if err != nil {
+		logger.Warn("control socket disabled", "error", err)
+	} else {
+		server := keyboard.NewControlServer(control)
+		operator.RegisterControlCommands(server)
+		go server.Serve()
+		defer server.Close()
+	}
+
+	operator.OnStatusChange(func(status keyboard.InteractionStatus) {
+		keyboard.SdNotify(keyboard.SdStatus(status.String()))
+	})
+	if _, err := keyboard.SdNotify("READY=1\n" + keyboard.SdStatus(operator.Status().String())); err != nil {
+		logger.Warn("failed to notify systemd", "error", err)
+	}
+
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 	<-c
+	keyboard.SdNotify("STOPPING=1")
 	fmt.Println("\nExiting...")
 }
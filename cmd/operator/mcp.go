@@ -0,0 +1,36 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os"
+
+	"github.com/mudler/keygeist/keyboard"
+)
+
+// runMCP implements the "mcp" subcommand: an MCP server on standard input
+// and output, for other agents to type and read context. Logs go to
+// standard error.
+func runMCP() int {
+	logger, err := keyboard.LoggerFromEnv()
+	if err != nil {
+		slog.Error("invalid logging configuration", "error", err)
+		return 1
+	}
+	slog.SetDefault(logger)
+
+	operator, err := keyboard.NewKeyboardOperator(os.Getenv("OPENAI_API_KEY"), os.Getenv("OPENAI_MODEL"),
+		os.Getenv("OPENAI_BASE_URL"), os.Getenv("KEYBOARD_DEVICE"), os.Getenv("OPENAI_SYSTEM_PROMPT"))
+	if err != nil {
+		logger.Error("failed to create Keygeist (run 'keygeist doctor' for diagnostics)", "error", err)
+		return 1
+	}
+	defer operator.Close()
+	operator.SetLogger(logger)
+
+	if err := operator.ServeMCP(context.Background(), os.Stdin, os.Stdout); err != nil {
+		logger.Error("mcp server failed", "error", err)
+		return 1
+	}
+	return 0
+}
@@ -3,8 +3,8 @@ module github.com/mudler/keygeist
 go 1.21
 
 require (
-	github.com/atotto/clipboard v0.1.4
 	github.com/bendahl/uinput v1.7.0
+	github.com/godbus/dbus/v5 v5.1.0
 	github.com/kbinani/screenshot v0.0.0-20250624051815-089614a94018
 	github.com/sashabaranov/go-openai v1.40.3
 	golang.org/x/sys v0.24.0
@@ -12,7 +12,6 @@ require (
 
 require (
 	github.com/gen2brain/shm v0.1.0 // indirect
-	github.com/godbus/dbus/v5 v5.1.0 // indirect
 	github.com/jezek/xgb v1.1.1 // indirect
 	github.com/lxn/win v0.0.0-20210218163916-a377121e959e // indirect
 )
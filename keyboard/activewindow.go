@@ -0,0 +1,185 @@
+package keyboard
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// WindowInfo describes the currently focused window
+type WindowInfo struct {
+	// ID is the compositor specific window identifier
+	ID    string
+	Class string
+	Title string
+	// Tool is the helper that found the window, and can focus it again
+	Tool string
+}
+
+// ActiveWindow returns the focused window using the first tool that works
+// for the current session (hyprctl, swaymsg, kdotool or xdotool)
+func ActiveWindow() (WindowInfo, error) {
+	var errs []string
+
+	if os.Getenv("HYPRLAND_INSTANCE_SIGNATURE") != "" {
+		info, err := activeWindowHyprland()
+		if err == nil {
+			return info, nil
+		}
+		errs = append(errs, fmt.Sprintf("hyprctl: %v", err))
+	}
+	if os.Getenv("SWAYSOCK") != "" {
+		info, err := activeWindowSway()
+		if err == nil {
+			return info, nil
+		}
+		errs = append(errs, fmt.Sprintf("swaymsg: %v", err))
+	}
+	if os.Getenv("WAYLAND_DISPLAY") != "" {
+		info, err := activeWindowXdotool("kdotool")
+		if err == nil {
+			return info, nil
+		}
+		errs = append(errs, fmt.Sprintf("kdotool: %v", err))
+	}
+	if os.Getenv("DISPLAY") != "" {
+		info, err := activeWindowXdotool("xdotool")
+		if err == nil {
+			return info, nil
+		}
+		errs = append(errs, fmt.Sprintf("xdotool: %v", err))
+	}
+
+	if len(errs) == 0 {
+		return WindowInfo{}, fmt.Errorf("no supported display session found")
+	}
+	return WindowInfo{}, fmt.Errorf("failed to query active window: %s", strings.Join(errs, "; "))
+}
+
+// activeWindowHyprland queries the focused window from Hyprland
+func activeWindowHyprland() (WindowInfo, error) {
+	output, err := helperOutput("hyprctl", "activewindow", "-j")
+	if err != nil {
+		return WindowInfo{}, err
+	}
+	var window struct {
+		Address string `json:"address"`
+		Class   string `json:"class"`
+		Title   string `json:"title"`
+	}
+	if err := json.Unmarshal(output, &window); err != nil {
+		return WindowInfo{}, err
+	}
+	return WindowInfo{ID: window.Address, Class: window.Class, Title: window.Title, Tool: "hyprctl"}, nil
+}
+
+// swayNode is the subset of the sway tree needed to find the focused window
+type swayNode struct {
+	ID               int64      `json:"id"`
+	Name             string     `json:"name"`
+	AppID            string     `json:"app_id"`
+	Focused          bool       `json:"focused"`
+	Nodes            []swayNode `json:"nodes"`
+	FloatingNodes    []swayNode `json:"floating_nodes"`
+	WindowProperties struct {
+		Class string `json:"class"`
+	} `json:"window_properties"`
+}
+
+// activeWindowSway queries the focused window from sway
+func activeWindowSway() (WindowInfo, error) {
+	output, err := helperOutput("swaymsg", "-t", "get_tree")
+	if err != nil {
+		return WindowInfo{}, err
+	}
+	var root swayNode
+	if err := json.Unmarshal(output, &root); err != nil {
+		return WindowInfo{}, err
+	}
+	node := findFocusedSwayNode(&root)
+	if node == nil {
+		return WindowInfo{}, fmt.Errorf("no focused window")
+	}
+	class := node.AppID
+	if class == "" {
+		class = node.WindowProperties.Class
+	}
+	return WindowInfo{ID: fmt.Sprint(node.ID), Class: class, Title: node.Name, Tool: "swaymsg"}, nil
+}
+
+// findFocusedSwayNode walks the sway tree looking for the focused node
+func findFocusedSwayNode(node *swayNode) *swayNode {
+	if node.Focused {
+		return node
+	}
+	for _, children := range [][]swayNode{node.Nodes, node.FloatingNodes} {
+		for i := range children {
+			if found := findFocusedSwayNode(&children[i]); found != nil {
+				return found
+			}
+		}
+	}
+	return nil
+}
+
+// activeWindowXdotool queries the focused window with xdotool or its KDE
+// Wayland counterpart kdotool, which share the same command line
+func activeWindowXdotool(tool string) (WindowInfo, error) {
+	output, err := helperOutput(tool, "getactivewindow")
+	if err != nil {
+		return WindowInfo{}, err
+	}
+	id := strings.TrimSpace(string(output))
+	if id == "" {
+		return WindowInfo{}, fmt.Errorf("no focused window")
+	}
+
+	info := WindowInfo{ID: id, Tool: tool}
+	if output, err := helperOutput(tool, "getwindowclassname", id); err == nil {
+		info.Class = strings.TrimSpace(string(output))
+	}
+	if output, err := helperOutput(tool, "getwindowname", id); err == nil {
+		info.Title = strings.TrimSpace(string(output))
+	}
+	return info, nil
+}
+
+// Focus gives the keyboard focus back to the window
+func (w WindowInfo) Focus() error {
+	if w.ID == "" {
+		return fmt.Errorf("unknown window")
+	}
+	var err error
+	switch w.Tool {
+	case "hyprctl":
+		_, err = helperOutput("hyprctl", "dispatch", "focuswindow", "address:"+w.ID)
+	case "swaymsg":
+		_, err = helperOutput("swaymsg", fmt.Sprintf("[con_id=%s]", w.ID), "focus")
+	case "xdotool":
+		_, err = helperOutput("xdotool", "windowactivate", "--sync", w.ID)
+	case "kdotool":
+		_, err = helperOutput("kdotool", "windowactivate", w.ID)
+	default:
+		return fmt.Errorf("cannot focus windows found by %q", w.Tool)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to focus window %s: %v", w.ID, err)
+	}
+	return nil
+}
+
+// MatchesApp checks if the window class contains any of the given names,
+// ignoring case
+func (w WindowInfo) MatchesApp(apps []string) bool {
+	class := strings.ToLower(w.Class)
+	if class == "" {
+		return false
+	}
+	for _, app := range apps {
+		if app != "" && strings.Contains(class, strings.ToLower(app)) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,450 @@
+package keyboard
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Clipboard history context modes
+const (
+	ClipsLast = "last"
+	ClipsPick = "pick"
+)
+
+// Clipboard history persistence
+const (
+	PersistOff       = "off"
+	PersistPlain     = "plain"
+	PersistEncrypted = "encrypted"
+)
+
+// Defaults used when the clipboard history configuration doesn't set them
+const (
+	DefaultClipboardHistorySize   = 50
+	DefaultClipboardHistoryLast   = 5
+	DefaultClipboardPollInterval  = time.Second
+	DefaultClipboardMaxEntryBytes = 16 * 1024
+)
+
+// clipboardSecretHints are the clipboard types password managers add to
+// mark secrets; entries offering any of them are never recorded
+var clipboardSecretHints = []string{
+	"x-kde-passwordManagerHint",
+	"org.nspasteboard.ConcealedType",
+	"org.nspasteboard.TransientType",
+	"ExcludeClipboardContentFromMonitorProcessing",
+}
+
+// ClipboardEntry is a recorded clipboard value
+type ClipboardEntry struct {
+	Text string    `json:"text"`
+	Time time.Time `json:"time"`
+}
+
+// ClipboardHistory records recent clipboard values by polling the
+// clipboard, keeping at most the configured number of entries
+type ClipboardHistory struct {
+	config    ClipboardHistoryConfig
+	clipboard ClipboardBackend
+	path      string
+	log       *slog.Logger
+	// paused skips recording, e.g. while a paused application is focused
+	paused func() bool
+
+	mu      sync.Mutex
+	entries []ClipboardEntry // oldest first
+	seen    string
+	warned  bool
+
+	keyMu sync.Mutex
+	key   []byte
+}
+
+// clipboardKeyLabel and clipboardKeyAttributes name the history key in the
+// keyring
+const clipboardKeyLabel = "Keygeist clipboard history key"
+
+var clipboardKeyAttributes = map[string]string{"application": "keygeist", "purpose": "clipboard-history"}
+
+// ClipboardHistoryPath returns the history file, by default under
+// $XDG_STATE_HOME/keygeist
+func ClipboardHistoryPath(config ClipboardHistoryConfig) string {
+	if config.Path != "" {
+		return expandHome(config.Path)
+	}
+	dir := os.Getenv("XDG_STATE_HOME")
+	if dir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return ""
+		}
+		dir = filepath.Join(home, ".local", "state")
+	}
+	name := "clipboard.json"
+	if config.Persist == PersistEncrypted {
+		name = "clipboard.enc"
+	}
+	return filepath.Join(dir, "keygeist", name)
+}
+
+// NewClipboardHistory creates an empty history recording clipboard; Run
+// loads the saved one
+func NewClipboardHistory(config ClipboardHistoryConfig, clipboard ClipboardBackend) *ClipboardHistory {
+	return &ClipboardHistory{
+		config:    config,
+		clipboard: clipboard,
+		path:      ClipboardHistoryPath(config),
+		log:       slog.Default(),
+		paused:    func() bool { return false },
+	}
+}
+
+// SetLogger sets the logger used while watching the clipboard
+func (ch *ClipboardHistory) SetLogger(logger *slog.Logger) {
+	ch.log = logger.With("component", "clipboard_history")
+}
+
+// Run loads the saved history and records clipboard changes until ctx is
+// cancelled
+func (ch *ClipboardHistory) Run(ctx context.Context) {
+	if ch.config.persist() {
+		if err := ch.load(); err != nil {
+			ch.log.Warn("failed to load clipboard history", "path", ch.path, "error", err)
+		}
+	}
+	// Polling wl-paste without data-control flickers and steals the focus
+	if ch.clipboard.Name == ClipboardWayland && !dataControlDesktop() {
+		ch.log.Warn("not recording clipboard history: the compositor doesn't support data-control", "desktop", os.Getenv("XDG_CURRENT_DESKTOP"))
+		return
+	}
+	ticker := time.NewTicker(ch.config.pollInterval())
+	defer ticker.Stop()
+	for {
+		ch.poll()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// poll records the clipboard value when it changed
+func (ch *ClipboardHistory) poll() {
+	if ch.paused() {
+		return
+	}
+	text, err := ch.clipboard.Read()
+	if err != nil {
+		ch.log.Debug("cannot read clipboard", "error", err)
+		return
+	}
+	ch.mu.Lock()
+	changed := text != ch.seen
+	ch.seen = text
+	ch.mu.Unlock()
+	if !changed || strings.TrimSpace(text) == "" {
+		return
+	}
+
+	// Without the types, secrets can't be told apart: record nothing
+	types, err := ch.clipboard.Types()
+	if err != nil {
+		ch.mu.Lock()
+		warned := ch.warned
+		ch.warned = true
+		ch.mu.Unlock()
+		if !warned {
+			ch.log.Warn("not recording clipboard history: cannot list clipboard types", "error", err)
+		}
+		return
+	}
+	if hint := secretHint(types, ch.config.IgnoreTypes); hint != "" {
+		ch.log.Debug("skipping clipboard entry marked as secret", "type", hint)
+		return
+	}
+
+	ch.add(truncateOutput(text, ch.config.maxEntryBytes()))
+	if ch.config.persist() {
+		if err := ch.save(); err != nil {
+			ch.log.Warn("failed to save clipboard history", "path", ch.path, "error", err)
+		}
+	}
+}
+
+// add appends an entry, moving a repeated value to the end
+func (ch *ClipboardHistory) add(text string) {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	for i, entry := range ch.entries {
+		if entry.Text == text {
+			ch.entries = append(ch.entries[:i], ch.entries[i+1:]...)
+			break
+		}
+	}
+	ch.entries = append(ch.entries, ClipboardEntry{Text: text, Time: time.Now()})
+	if extra := len(ch.entries) - ch.config.size(); extra > 0 {
+		ch.entries = append([]ClipboardEntry(nil), ch.entries[extra:]...)
+	}
+}
+
+// Recent returns up to n entries, most recent first
+func (ch *ClipboardHistory) Recent(n int) []ClipboardEntry {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	var recent []ClipboardEntry
+	for i := len(ch.entries) - 1; i >= 0 && len(recent) < n; i-- {
+		recent = append(recent, ch.entries[i])
+	}
+	return recent
+}
+
+// Len returns the number of entries
+func (ch *ClipboardHistory) Len() int {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	return len(ch.entries)
+}
+
+// Clear forgets every entry, on disk too
+func (ch *ClipboardHistory) Clear() error {
+	ch.mu.Lock()
+	ch.entries = nil
+	ch.mu.Unlock()
+	if !ch.config.persist() {
+		return nil
+	}
+	return ch.save()
+}
+
+// load reads the saved history
+func (ch *ClipboardHistory) load() error {
+	data, err := os.ReadFile(ch.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if ch.config.Persist == PersistEncrypted {
+		if data, err = ch.crypt(data, false); err != nil {
+			return err
+		}
+	}
+	var entries []ClipboardEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return fmt.Errorf("invalid clipboard history: %v", err)
+	}
+	if extra := len(entries) - ch.config.size(); extra > 0 {
+		entries = entries[extra:]
+	}
+	ch.mu.Lock()
+	ch.entries = entries
+	ch.mu.Unlock()
+	ch.log.Debug("loaded clipboard history", "entries", len(entries))
+	return nil
+}
+
+// save writes the history atomically, readable only by the user
+func (ch *ClipboardHistory) save() error {
+	ch.mu.Lock()
+	data, err := json.Marshal(ch.entries)
+	ch.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	if ch.config.Persist == PersistEncrypted {
+		if data, err = ch.crypt(data, true); err != nil {
+			return err
+		}
+	}
+	if err := os.MkdirAll(filepath.Dir(ch.path), 0700); err != nil {
+		return fmt.Errorf("failed to create clipboard history directory: %v", err)
+	}
+	tmp := ch.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("failed to write clipboard history: %v", err)
+	}
+	return os.Rename(tmp, ch.path)
+}
+
+// crypt encrypts or decrypts the history with AES-256-GCM; the nonce
+// precedes the ciphertext
+func (ch *ClipboardHistory) crypt(data []byte, encrypt bool) ([]byte, error) {
+	key, err := ch.encryptionKey()
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	if encrypt {
+		nonce := make([]byte, gcm.NonceSize())
+		if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+			return nil, err
+		}
+		return gcm.Seal(nonce, nonce, data, nil), nil
+	}
+	if len(data) < gcm.NonceSize() {
+		return nil, fmt.Errorf("clipboard history is too short")
+	}
+	plain, err := gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt clipboard history: %v", err)
+	}
+	return plain, nil
+}
+
+// encryptionKey returns the history key, from key_path when set and from
+// the keyring otherwise; it is fetched once
+func (ch *ClipboardHistory) encryptionKey() ([]byte, error) {
+	ch.keyMu.Lock()
+	defer ch.keyMu.Unlock()
+	if ch.key != nil {
+		return ch.key, nil
+	}
+	var key []byte
+	var err error
+	if path := ch.config.keyPath(); path != "" {
+		key, err = clipboardKey(path, filepath.Dir(ch.path))
+	} else {
+		key, err = secretKey(clipboardKeyLabel, clipboardKeyAttributes)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("no clipboard history key: %v", err)
+	}
+	ch.key = key
+	return key, nil
+}
+
+// sameDirectory reports whether two paths name the same directory
+func sameDirectory(a, b string) bool {
+	if infoA, err := os.Stat(a); err == nil {
+		if infoB, err := os.Stat(b); err == nil {
+			return os.SameFile(infoA, infoB)
+		}
+	}
+	absA, errA := filepath.Abs(a)
+	absB, errB := filepath.Abs(b)
+	return errA == nil && errB == nil && absA == absB
+}
+
+// clipboardKey reads the 32 byte history key file, creating it on first
+// use. A key next to the history would protect nothing, so historyDir is
+// refused.
+func clipboardKey(path, historyDir string) ([]byte, error) {
+	if sameDirectory(filepath.Dir(path), historyDir) {
+		return nil, fmt.Errorf("refusing to keep the key %s in the history's directory", path)
+	}
+	key, err := os.ReadFile(path)
+	if err == nil {
+		if len(key) != 32 {
+			return nil, fmt.Errorf("clipboard history key %s must be 32 bytes", path)
+		}
+		return key, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read clipboard history key: %v", err)
+	}
+	key = make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, fmt.Errorf("failed to create clipboard history key directory: %v", err)
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create clipboard history key: %v", err)
+	}
+	defer file.Close()
+	if _, err := file.Write(key); err != nil {
+		return nil, fmt.Errorf("failed to write clipboard history key: %v", err)
+	}
+	return key, nil
+}
+
+// secretHint returns the first type marking a secret, if any
+func secretHint(types, extra []string) string {
+	hints := append(append([]string(nil), clipboardSecretHints...), extra...)
+	for _, t := range types {
+		for _, hint := range hints {
+			if strings.EqualFold(t, hint) || strings.HasSuffix(strings.ToLower(t), "/"+strings.ToLower(hint)) {
+				return t
+			}
+		}
+	}
+	return ""
+}
+
+// clipPreview returns the first line of an entry, shortened for a list
+func clipPreview(text string) string {
+	text = strings.TrimSpace(text)
+	lines := strings.SplitN(text, "\n", 2)
+	preview := []rune(lines[0])
+	if len(preview) > 80 {
+		return string(preview[:80]) + "…"
+	}
+	if len(lines) > 1 {
+		return string(preview) + " …"
+	}
+	return string(preview)
+}
+
+// formatClips formats entries for a prompt, most recent first
+func formatClips(entries []ClipboardEntry) string {
+	var b strings.Builder
+	for i, entry := range entries {
+		fmt.Fprintf(&b, "--- Clip %d (copied %s) ---\n%s\n", i+1, entry.Time.Format("2006-01-02 15:04"), strings.TrimSpace(entry.Text))
+	}
+	return b.String()
+}
+
+// historyClips returns the clipboard history entries attached to a prompt:
+// the most recent ones, or those picked by the user in "pick" mode
+func (ko *KeyboardOperator) historyClips(ctx context.Context, log *slog.Logger) ([]ClipboardEntry, error) {
+	if ko.clipHistory == nil {
+		log.Warn("skipping clipboard history context: clipboard history is disabled")
+		return nil, nil
+	}
+	config := ko.fileConfig.ClipboardHistory
+	if config.Mode != ClipsPick {
+		return ko.clipHistory.Recent(config.last()), nil
+	}
+	entries := ko.clipHistory.Recent(config.size())
+	if len(entries) == 0 {
+		return nil, nil
+	}
+	rows := make([][]string, len(entries))
+	for i, entry := range entries {
+		rows[i] = []string{entry.Time.Format("15:04"), clipPreview(entry.Text)}
+	}
+	chosen, err := ko.input.Choose(ctx, "Choose the clipboard entries to include", []string{"Copied", "Text"}, rows)
+	if err != nil {
+		return nil, err
+	}
+	var picked []ClipboardEntry
+	for _, i := range chosen {
+		if i >= 0 && i < len(entries) {
+			picked = append(picked, entries[i])
+		}
+	}
+	log.Debug("picked clipboard entries", "entries", len(picked))
+	return picked, nil
+}
@@ -1,10 +1,13 @@
 package keyboard
 
 import (
+	"encoding/json"
 	"fmt"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
 )
 
 // KeyBindingConfig represents the configuration for keybindings
@@ -13,6 +16,9 @@ type KeyBindingConfig struct {
 	ScreenshotKey string
 	AllContextKey string
 	TextOnlyKey   string
+	KnowledgeKey  string
+	VoiceKey      string
+	PauseKey      string
 }
 
 // DefaultKeyBindingConfig returns the default keybinding configuration
@@ -22,6 +28,9 @@ func DefaultKeyBindingConfig() *KeyBindingConfig {
 		ScreenshotKey: "win+s",
 		AllContextKey: "win+e",
 		TextOnlyKey:   "win+t",
+		KnowledgeKey:  "win+k",
+		VoiceKey:      "win+v:hold",
+		PauseKey:      "win+pause",
 	}
 }
 
@@ -42,10 +51,772 @@ func LoadKeyBindingConfig() *KeyBindingConfig {
 	if env := os.Getenv("TEXT_ONLY_KEY"); env != "" {
 		config.TextOnlyKey = env
 	}
+	if env := os.Getenv("KNOWLEDGE_KEY"); env != "" {
+		config.KnowledgeKey = env
+	}
+	if env := os.Getenv("VOICE_KEY"); env != "" {
+		config.VoiceKey = env
+	}
+	if env, ok := os.LookupEnv("PAUSE_KEY"); ok {
+		// An empty PAUSE_KEY disables the pause binding
+		config.PauseKey = env
+	}
 
 	return config
 }
 
+// Config represents the optional JSON configuration file, used for settings
+// that don't fit in environment variables
+type Config struct {
+	Snippets SnippetConfig `json:"snippets"`
+	Profiles []Profile     `json:"profiles,omitempty"`
+	History  HistoryConfig `json:"history"`
+	Pause    PauseConfig   `json:"pause"`
+	// Bindings holds per-binding options, keyed by binding name
+	// (clipboard, screenshot, all, textonly, knowledge, voice)
+	Bindings     map[string]BindingConfig `json:"bindings,omitempty"`
+	Interactions InteractionConfig        `json:"interactions"`
+	Tools        ToolsConfig              `json:"tools"`
+	// MCPServers are Model Context Protocol servers whose tools and
+	// resources are offered to the model
+	MCPServers []MCPServerConfig `json:"mcp_servers,omitempty"`
+	// MCPServe controls the tools offered by "keygeist mcp"
+	MCPServe MCPServeConfig `json:"mcp_serve"`
+	// Knowledge indexes directories for the knowledge context
+	Knowledge KnowledgeConfig `json:"knowledge"`
+	// OCR extracts the text of screenshots for text-only models
+	OCR OCRConfig `json:"ocr"`
+	// Voice configures spoken prompts
+	Voice VoiceConfig `json:"voice"`
+	// ClipboardHistory records recent clipboard entries for the
+	// clipboard_history context
+	ClipboardHistory ClipboardHistoryConfig `json:"clipboard_history"`
+	// Display selects the clipboard and screenshot backends
+	Display DisplayConfig `json:"display"`
+}
+
+// DisplayConfig selects the clipboard and screenshot backends; "auto" (the
+// default) picks them from the session type
+type DisplayConfig struct {
+	// Clipboard is "wl-clipboard", "xclip", "xsel" or "auto"
+	Clipboard string `json:"clipboard,omitempty"`
+	// Screenshot is "portal" (xdg-desktop-portal), "grim", "x11",
+	// "gnome-screenshot", "scrot" or "auto"
+	Screenshot string `json:"screenshot,omitempty"`
+}
+
+// BindingConfig holds the options of one binding
+type BindingConfig struct {
+	// OnBusy is what pressing the binding does while it already has a job:
+	// "cancel" (default) cancels it, "queue" starts another one after it,
+	// "ignore" does nothing
+	OnBusy string `json:"on_busy,omitempty"`
+	// Output lists where responses go, in order (default: typed)
+	Output []SinkConfig `json:"output,omitempty"`
+	// Confirm shows the response for review before delivering it: "auto"
+	// (default) for terminal windows and multi-line responses typed or
+	// pasted, "always" or "never". true and false mean always and never.
+	Confirm ConfirmMode `json:"confirm,omitempty"`
+	// Context lists the context sources attached to the prompt: clipboard,
+	// selection, screenshot, knowledge and clipboard_history (default: those
+	// named by the binding, with all meaning clipboard and screenshot)
+	Context []string `json:"context,omitempty"`
+	// Input is how the prompt is given: "dialog" (default) or "voice"
+	// (default for the voice binding)
+	Input string `json:"input,omitempty"`
+	// Process lists the response processors applied in order (default:
+	// unwrap_fences, strip_thinking, trim, collapse_newlines)
+	Process []string `json:"process,omitempty"`
+}
+
+// Prompt inputs
+const (
+	InputDialog = "dialog"
+	InputVoice  = "voice"
+)
+
+// Context sources a binding can attach to the prompt
+const (
+	ContextClipboard  = "clipboard"
+	ContextScreenshot = "screenshot"
+	ContextKnowledge  = "knowledge"
+	// ContextClipboardHistory attaches recent clipboard entries
+	ContextClipboardHistory = "clipboard_history"
+	// ContextSelection attaches the primary selection, the text last
+	// selected with the mouse or keyboard
+	ContextSelection = "selection"
+)
+
+// contextSources are the valid context source names
+var validContextSources = []string{ContextClipboard, ContextScreenshot, ContextKnowledge, ContextClipboardHistory, ContextSelection}
+
+// validBindingNames are the bindings that can be configured in bindings
+var validBindingNames = []string{ContextClipboard, ContextScreenshot, "all", "textonly", ContextKnowledge, voiceBinding}
+
+// defaultContext returns the context sources of a binding without a
+// configured context
+func defaultContext(binding string) []string {
+	switch binding {
+	case "all":
+		return []string{ContextClipboard, ContextScreenshot}
+	case ContextClipboard, ContextScreenshot, ContextKnowledge, ContextSelection:
+		return []string{binding}
+	}
+	return nil
+}
+
+// ConfirmMode decides when a response is reviewed before delivery
+type ConfirmMode string
+
+const (
+	ConfirmNever  ConfirmMode = "never"
+	ConfirmAlways ConfirmMode = "always"
+	ConfirmAuto   ConfirmMode = "auto"
+)
+
+// UnmarshalJSON accepts a mode name or a boolean
+func (cm *ConfirmMode) UnmarshalJSON(data []byte) error {
+	var enabled bool
+	if err := json.Unmarshal(data, &enabled); err == nil {
+		*cm = ConfirmNever
+		if enabled {
+			*cm = ConfirmAlways
+		}
+		return nil
+	}
+	var mode string
+	if err := json.Unmarshal(data, &mode); err != nil {
+		return fmt.Errorf("confirm must be a boolean or one of never, always, auto")
+	}
+	*cm = ConfirmMode(mode)
+	return nil
+}
+
+// defaultTerminalApps are window classes treated as terminals
+var defaultTerminalApps = []string{
+	"terminal", "term", "kitty", "alacritty", "foot", "wezterm", "konsole",
+	"terminator", "tilix", "ghostty", "urxvt", "st-256color", "yakuake", "guake",
+}
+
+// InteractionConfig controls how interactions run alongside each other
+type InteractionConfig struct {
+	// MaxConcurrentQueries bounds the model queries running at once (default 1);
+	// responses are always typed one at a time
+	MaxConcurrentQueries int `json:"max_concurrent_queries,omitempty"`
+	// TerminalApps are the window classes where confirm "auto" always
+	// reviews the response (default: common terminal emulators)
+	TerminalApps []string `json:"terminal_apps,omitempty"`
+}
+
+// terminalApps returns the configured terminal classes or the defaults
+func (ic InteractionConfig) terminalApps() []string {
+	if len(ic.TerminalApps) > 0 {
+		return ic.TerminalApps
+	}
+	return defaultTerminalApps
+}
+
+// ToolsConfig controls the local actions the model may call
+type ToolsConfig struct {
+	Enabled bool `json:"enabled"`
+	// Allow lists the built-in tools offered to the model (default: all of
+	// them, without run_command unless commands are allowed)
+	Allow []string `json:"allow,omitempty"`
+	// Commands are the executables run_command may run
+	Commands []string `json:"commands,omitempty"`
+	// Roots are the directories read_file and list_directory may access;
+	// without them, those tools are not offered. Hidden entries below a
+	// root are refused.
+	Roots []string `json:"roots,omitempty"`
+	// Confirm asks before calling a tool, keyed by tool name: "always" or
+	// "never" (default: always for run_command, read_file and
+	// list_directory, never for the others)
+	Confirm map[string]ConfirmMode `json:"confirm,omitempty"`
+	// TimeoutSeconds bounds each tool call (default 10)
+	TimeoutSeconds int `json:"timeout_seconds,omitempty"`
+	// MaxOutputBytes truncates tool results sent to the model (default 8000)
+	MaxOutputBytes int `json:"max_output_bytes,omitempty"`
+	// MaxRounds bounds the tool calling rounds of one query (default 5)
+	MaxRounds int `json:"max_rounds,omitempty"`
+}
+
+// MCPServerConfig declares an MCP server, started as a command (stdio) or
+// reached at a URL (streamable HTTP)
+type MCPServerConfig struct {
+	// Name prefixes the server's tools, as in git__status
+	Name    string   `json:"name"`
+	Command []string `json:"command,omitempty"`
+	// Env is added to the few variables a command inherits, such as PATH
+	// and HOME
+	Env     map[string]string `json:"env,omitempty"`
+	URL     string            `json:"url,omitempty"`
+	Headers map[string]string `json:"headers,omitempty"`
+	// Tools lists the server tools offered to the model (default: all)
+	Tools []string `json:"tools,omitempty"`
+	// Confirm asks before every call to the server: "always" (default) or
+	// "never"
+	Confirm ConfirmMode `json:"confirm,omitempty"`
+}
+
+// MCPServeConfig controls the tools Keygeist offers as an MCP server
+type MCPServeConfig struct {
+	// Allow lists the tools offered (default: all of them)
+	Allow []string `json:"allow,omitempty"`
+	// Confirm asks before a call, keyed by tool name: "always" or "never"
+	// (default: always for type_text and press_hotkey, never for the others)
+	Confirm map[string]ConfirmMode `json:"confirm,omitempty"`
+}
+
+// KnowledgeConfig controls the local index used by the knowledge context
+type KnowledgeConfig struct {
+	// Directories are indexed recursively; without any, the knowledge
+	// context is disabled
+	Directories []string `json:"directories,omitempty"`
+	// Extensions are the file types indexed (default: text, Markdown and
+	// common source files)
+	Extensions []string `json:"extensions,omitempty"`
+	// Exclude are directory names skipped (default: .git, node_modules, ...)
+	Exclude []string `json:"exclude,omitempty"`
+	// Model is the embedding model (default text-embedding-3-small); BaseURL
+	// and APIKey default to the default profile's
+	Model   string `json:"model,omitempty"`
+	BaseURL string `json:"base_url,omitempty"`
+	APIKey  string `json:"api_key,omitempty"`
+	// ChunkSize and ChunkOverlap are in characters (default 1500 and 200)
+	ChunkSize    int `json:"chunk_size,omitempty"`
+	ChunkOverlap int `json:"chunk_overlap,omitempty"`
+	// TopK is the number of chunks added to a prompt (default 5)
+	TopK int `json:"top_k,omitempty"`
+	// MaxFileBytes skips larger files (default 1 MiB)
+	MaxFileBytes int64 `json:"max_file_bytes,omitempty"`
+	// ReindexIntervalSeconds is how often changed files are reindexed
+	// (default 300)
+	ReindexIntervalSeconds int `json:"reindex_interval_seconds,omitempty"`
+	// IndexPath is the index file (default $XDG_CACHE_HOME/keygeist/knowledge.gob)
+	IndexPath string `json:"index_path,omitempty"`
+}
+
+// model returns the embedding model
+func (kc KnowledgeConfig) model() string {
+	if kc.Model != "" {
+		return kc.Model
+	}
+	return DefaultEmbeddingModel
+}
+
+// extensions returns the indexed file extensions
+func (kc KnowledgeConfig) extensions() []string {
+	if len(kc.Extensions) > 0 {
+		return kc.Extensions
+	}
+	return defaultKnowledgeExtensions
+}
+
+// exclude returns the skipped directory names
+func (kc KnowledgeConfig) exclude() []string {
+	if len(kc.Exclude) > 0 {
+		return kc.Exclude
+	}
+	return defaultKnowledgeExclude
+}
+
+// chunkSize returns the chunk size in characters
+func (kc KnowledgeConfig) chunkSize() int {
+	if kc.ChunkSize > 0 {
+		return kc.ChunkSize
+	}
+	return DefaultKnowledgeChunkSize
+}
+
+// overlap returns the characters shared by neighbouring chunks
+func (kc KnowledgeConfig) overlap() int {
+	if kc.ChunkOverlap > 0 {
+		return kc.ChunkOverlap
+	}
+	return DefaultKnowledgeOverlap
+}
+
+// topK returns the number of chunks retrieved
+func (kc KnowledgeConfig) topK() int {
+	if kc.TopK > 0 {
+		return kc.TopK
+	}
+	return DefaultKnowledgeTopK
+}
+
+// maxFileSize returns the size above which files are skipped
+func (kc KnowledgeConfig) maxFileSize() int64 {
+	if kc.MaxFileBytes > 0 {
+		return kc.MaxFileBytes
+	}
+	return DefaultKnowledgeMaxFileSize
+}
+
+// interval returns the time between reindexing runs
+func (kc KnowledgeConfig) interval() time.Duration {
+	if kc.ReindexIntervalSeconds > 0 {
+		return time.Duration(kc.ReindexIntervalSeconds) * time.Second
+	}
+	return DefaultKnowledgeInterval
+}
+
+// OCR modes
+const (
+	OCRAuto   = "auto"
+	OCRAlways = "always"
+	OCRNever  = "never"
+)
+
+// OCRConfig selects how screenshot text is extracted
+type OCRConfig struct {
+	// Mode is "auto" (default) to send the text of screenshots instead of
+	// images to text-only models, "always" to also send it to vision
+	// models, or "never" to leave screenshots out for text-only models
+	Mode string `json:"mode,omitempty"`
+	// Engine is "tesseract" (default) or "http"
+	Engine string `json:"engine,omitempty"`
+	// Languages are the tesseract languages, as in eng+deu (default eng)
+	Languages string `json:"languages,omitempty"`
+	// URL and Headers configure the http engine
+	URL     string            `json:"url,omitempty"`
+	Headers map[string]string `json:"headers,omitempty"`
+	// MaxChars caps the extracted text (default 8000)
+	MaxChars int `json:"max_chars,omitempty"`
+}
+
+// maxChars returns the configured cap on extracted text or the default
+func (oc OCRConfig) maxChars() int {
+	if oc.MaxChars > 0 {
+		return oc.MaxChars
+	}
+	return DefaultOCRMaxChars
+}
+
+// VoiceConfig controls spoken prompts, recorded from the default microphone
+// and transcribed by an OpenAI-compatible /audio/transcriptions endpoint
+type VoiceConfig struct {
+	// Enabled registers the voice binding
+	Enabled bool `json:"enabled"`
+	// Recorder is "pw-record", "parec" or "auto" (default: the first installed)
+	Recorder string `json:"recorder,omitempty"`
+	// Model is the transcription model (default whisper-1); BaseURL and
+	// APIKey default to the default profile's
+	Model    string `json:"model,omitempty"`
+	BaseURL  string `json:"base_url,omitempty"`
+	APIKey   string `json:"api_key,omitempty"`
+	Language string `json:"language,omitempty"`
+	// SilenceMS ends the recording after this much silence following speech
+	// (default 1500), unless the binding is push-to-talk
+	SilenceMS int `json:"silence_ms,omitempty"`
+	// SilenceThreshold is the RMS level below which audio is silence
+	// (default 500, out of 32768)
+	SilenceThreshold float64 `json:"silence_threshold,omitempty"`
+	// NoSpeechMS gives up when nothing is said for this long (default 5000)
+	NoSpeechMS int `json:"no_speech_ms,omitempty"`
+	// MaxSeconds caps the length of a recording (default 30)
+	MaxSeconds int `json:"max_seconds,omitempty"`
+}
+
+// model returns the transcription model
+func (vc VoiceConfig) model() string {
+	if vc.Model != "" {
+		return vc.Model
+	}
+	return DefaultVoiceModel
+}
+
+// silence returns the silence that ends a recording
+func (vc VoiceConfig) silence() time.Duration {
+	if vc.SilenceMS > 0 {
+		return time.Duration(vc.SilenceMS) * time.Millisecond
+	}
+	return DefaultVoiceSilence
+}
+
+// silenceThreshold returns the level below which audio is silence
+func (vc VoiceConfig) silenceThreshold() float64 {
+	if vc.SilenceThreshold > 0 {
+		return vc.SilenceThreshold
+	}
+	return DefaultVoiceSilenceThreshold
+}
+
+// noSpeech returns how long to wait for speech to start
+func (vc VoiceConfig) noSpeech() time.Duration {
+	if vc.NoSpeechMS > 0 {
+		return time.Duration(vc.NoSpeechMS) * time.Millisecond
+	}
+	return DefaultVoiceNoSpeech
+}
+
+// maxDuration returns the longest recording
+func (vc VoiceConfig) maxDuration() time.Duration {
+	if vc.MaxSeconds > 0 {
+		return time.Duration(vc.MaxSeconds) * time.Second
+	}
+	return DefaultVoiceMaxDuration
+}
+
+// ClipboardHistoryConfig controls the clipboard history. Entries marked as
+// secrets by password managers are never recorded.
+type ClipboardHistoryConfig struct {
+	// Enabled watches the clipboard
+	Enabled bool `json:"enabled"`
+	// Size is the number of entries kept (default 50)
+	Size int `json:"size,omitempty"`
+	// Mode is "last" (default) to attach the Last most recent entries, or
+	// "pick" to choose them in a list after the prompt
+	Mode string `json:"mode,omitempty"`
+	Last int    `json:"last,omitempty"`
+	// Persist keeps the history across restarts: "off" (default), "plain"
+	// or "encrypted" (AES-256-GCM)
+	Persist string `json:"persist,omitempty"`
+	// Path is the history file (default $XDG_STATE_HOME/keygeist/clipboard.json,
+	// or clipboard.enc when encrypted)
+	Path string `json:"path,omitempty"`
+	// KeyPath is a key file to encrypt with instead of a key kept in the
+	// Secret Service keyring, created on first use. It must not be in the
+	// history's directory.
+	KeyPath string `json:"key_path,omitempty"`
+	// PollMS is how often the clipboard is checked (default 1000)
+	PollMS int `json:"poll_ms,omitempty"`
+	// MaxEntryBytes truncates larger entries (default 16 KiB)
+	MaxEntryBytes int `json:"max_entry_bytes,omitempty"`
+	// IgnoreTypes are more clipboard types marking entries not to record
+	IgnoreTypes []string `json:"ignore_types,omitempty"`
+}
+
+// size returns the number of entries kept
+func (cc ClipboardHistoryConfig) size() int {
+	if cc.Size > 0 {
+		return cc.Size
+	}
+	return DefaultClipboardHistorySize
+}
+
+// last returns the number of entries attached in "last" mode
+func (cc ClipboardHistoryConfig) last() int {
+	if cc.Last > 0 {
+		return cc.Last
+	}
+	return DefaultClipboardHistoryLast
+}
+
+// persist reports whether the history is saved
+func (cc ClipboardHistoryConfig) persist() bool {
+	return cc.Persist == PersistPlain || cc.Persist == PersistEncrypted
+}
+
+// pollInterval returns how often the clipboard is checked
+func (cc ClipboardHistoryConfig) pollInterval() time.Duration {
+	if cc.PollMS > 0 {
+		return time.Duration(cc.PollMS) * time.Millisecond
+	}
+	return DefaultClipboardPollInterval
+}
+
+// maxEntryBytes returns the length entries are truncated to
+func (cc ClipboardHistoryConfig) maxEntryBytes() int {
+	if cc.MaxEntryBytes > 0 {
+		return cc.MaxEntryBytes
+	}
+	return DefaultClipboardMaxEntryBytes
+}
+
+// keyPath returns the configured encryption key file, if any
+func (cc ClipboardHistoryConfig) keyPath() string {
+	if cc.KeyPath != "" {
+		return expandHome(cc.KeyPath)
+	}
+	return ""
+}
+
+// DefaultProfileName is the name of the profile built from the OPENAI_*
+// environment variables
+const DefaultProfileName = "default"
+
+// Profile is a named model configuration that can be switched at runtime.
+// Empty fields are taken from the default profile.
+type Profile struct {
+	Name         string `json:"name"`
+	Model        string `json:"model,omitempty"`
+	BaseURL      string `json:"base_url,omitempty"`
+	APIKey       string `json:"api_key,omitempty"`
+	SystemPrompt string `json:"system_prompt,omitempty"`
+	// Vision tells whether the model accepts images (default true); text-only
+	// models get the text of screenshots instead
+	Vision *bool `json:"vision,omitempty"`
+}
+
+// vision reports whether screenshots can be sent to the model as images
+func (p Profile) vision() bool {
+	return p.Vision == nil || *p.Vision
+}
+
+// PauseConfig controls automatic pausing of the hotkeys
+type PauseConfig struct {
+	// Apps pauses hotkeys while a window of these classes is focused
+	Apps []string `json:"apps,omitempty"`
+	// PollIntervalMS is how often the focused window is checked (default 1000)
+	PollIntervalMS int `json:"poll_interval_ms,omitempty"`
+}
+
+// pollInterval returns the configured focus polling interval or the default
+func (pc PauseConfig) pollInterval() time.Duration {
+	if pc.PollIntervalMS > 0 {
+		return time.Duration(pc.PollIntervalMS) * time.Millisecond
+	}
+	return time.Second
+}
+
+// HistoryConfig controls the interaction history file
+type HistoryConfig struct {
+	// Enabled records prompts and responses; they may contain sensitive data
+	Enabled bool `json:"enabled"`
+	// Path overrides the default keygeist/history.jsonl in the user state directory
+	Path string `json:"path,omitempty"`
+}
+
+// SnippetConfig represents the text expansion settings
+type SnippetConfig struct {
+	// Delimiters are the characters that end an abbreviation (defaults to space)
+	Delimiters string `json:"delimiters,omitempty"`
+	// EnabledApps restricts expansion to these window classes when not empty
+	EnabledApps []string `json:"enabled_apps,omitempty"`
+	// DisabledApps disables expansion in these window classes
+	DisabledApps []string `json:"disabled_apps,omitempty"`
+	// Library is the list of snippets
+	Library []Snippet `json:"library,omitempty"`
+}
+
+// Snippet replaces a typed abbreviation with an expansion. Exactly one of
+// Text, Template or Prompt should be set.
+type Snippet struct {
+	Trigger string `json:"trigger"`
+	// Text is inserted as-is
+	Text string `json:"text,omitempty"`
+	// Template is a Go text/template rendered at expansion time
+	Template string `json:"template,omitempty"`
+	// Prompt is rendered like Template and sent to the LLM; the answer is inserted
+	Prompt string `json:"prompt,omitempty"`
+	// Apps restricts this snippet to these window classes when not empty
+	Apps []string `json:"apps,omitempty"`
+}
+
+// ConfigPath returns the configuration file location: KEYGEIST_CONFIG if set,
+// otherwise keygeist/config.json in the user configuration directory
+func ConfigPath() string {
+	if env := os.Getenv("KEYGEIST_CONFIG"); env != "" {
+		return env
+	}
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "keygeist", "config.json")
+}
+
+// LoadConfig loads the configuration file. A missing file at the default
+// location yields an empty configuration; a missing KEYGEIST_CONFIG file is an error.
+func LoadConfig() (*Config, error) {
+	config := &Config{}
+	path := ConfigPath()
+	if path == "" {
+		return config, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) && os.Getenv("KEYGEIST_CONFIG") == "" {
+			return config, nil
+		}
+		return nil, fmt.Errorf("failed to read config %s: %v", path, err)
+	}
+	if err := json.Unmarshal(data, config); err != nil {
+		return nil, fmt.Errorf("failed to parse config %s: %v", path, err)
+	}
+	if err := config.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid config %s: %v", path, err)
+	}
+	return config, nil
+}
+
+// Validate checks the configuration for inconsistencies
+func (c *Config) Validate() error {
+	delimiters := c.Snippets.delimiters()
+	seen := make(map[string]bool)
+	for i, snippet := range c.Snippets.Library {
+		if snippet.Trigger == "" {
+			return fmt.Errorf("snippet %d has no trigger", i)
+		}
+		if strings.ContainsAny(snippet.Trigger, delimiters) {
+			return fmt.Errorf("snippet trigger '%s' contains a delimiter", snippet.Trigger)
+		}
+		if seen[snippet.Trigger] {
+			return fmt.Errorf("duplicate snippet trigger '%s'", snippet.Trigger)
+		}
+		seen[snippet.Trigger] = true
+
+		kinds := 0
+		for _, value := range []string{snippet.Text, snippet.Template, snippet.Prompt} {
+			if value != "" {
+				kinds++
+			}
+		}
+		if kinds != 1 {
+			return fmt.Errorf("snippet '%s' must set exactly one of text, template or prompt", snippet.Trigger)
+		}
+	}
+
+	for name, binding := range c.Bindings {
+		if !containsString(validBindingNames, name) {
+			return fmt.Errorf("unknown binding '%s' (available: %s)", name, strings.Join(validBindingNames, ", "))
+		}
+		switch binding.OnBusy {
+		case "", OnBusyCancel, OnBusyQueue, OnBusyIgnore:
+		default:
+			return fmt.Errorf("binding '%s': unknown on_busy action '%s'", name, binding.OnBusy)
+		}
+		switch binding.Confirm {
+		case "", ConfirmNever, ConfirmAlways, ConfirmAuto:
+		default:
+			return fmt.Errorf("binding '%s': unknown confirm mode '%s'", name, binding.Confirm)
+		}
+		for _, source := range binding.Context {
+			if !containsString(validContextSources, source) {
+				return fmt.Errorf("binding '%s': unknown context source '%s'", name, source)
+			}
+			if source == ContextClipboardHistory && !c.ClipboardHistory.Enabled {
+				return fmt.Errorf("binding '%s': the clipboard_history context needs clipboard_history.enabled", name)
+			}
+		}
+		if _, err := NewResponsePipeline(binding.Process); err != nil {
+			return fmt.Errorf("binding '%s': %v", name, err)
+		}
+		switch binding.Input {
+		case "", InputDialog, InputVoice:
+		default:
+			return fmt.Errorf("binding '%s': unknown input '%s'", name, binding.Input)
+		}
+		if binding.Input == InputVoice && !c.Voice.Enabled {
+			return fmt.Errorf("binding '%s': voice input needs voice.enabled", name)
+		}
+		for _, sink := range binding.Output {
+			if err := sink.Validate(); err != nil {
+				return fmt.Errorf("binding '%s': %v", name, err)
+			}
+		}
+	}
+	if c.Interactions.MaxConcurrentQueries < 0 {
+		return fmt.Errorf("interactions.max_concurrent_queries must not be negative")
+	}
+	for name, mode := range c.Tools.Confirm {
+		switch mode {
+		case ConfirmNever, ConfirmAlways:
+		default:
+			return fmt.Errorf("tools: unknown confirm mode '%s' for %s", mode, name)
+		}
+	}
+	servers := make(map[string]bool)
+	for i, server := range c.MCPServers {
+		if server.Name == "" {
+			return fmt.Errorf("mcp server %d has no name", i)
+		}
+		if servers[server.Name] {
+			return fmt.Errorf("duplicate mcp server name '%s'", server.Name)
+		}
+		servers[server.Name] = true
+		if (len(server.Command) > 0) == (server.URL != "") {
+			return fmt.Errorf("mcp server '%s' must set exactly one of command or url", server.Name)
+		}
+		switch server.Confirm {
+		case "", ConfirmNever, ConfirmAlways:
+		default:
+			return fmt.Errorf("mcp server '%s': unknown confirm mode '%s'", server.Name, server.Confirm)
+		}
+	}
+	for _, name := range c.MCPServe.Allow {
+		if !containsString(MCPServeTools, name) {
+			return fmt.Errorf("mcp_serve: unknown tool '%s'", name)
+		}
+	}
+	for name, mode := range c.MCPServe.Confirm {
+		switch mode {
+		case ConfirmNever, ConfirmAlways:
+		default:
+			return fmt.Errorf("mcp_serve: unknown confirm mode '%s' for %s", mode, name)
+		}
+	}
+	if c.Knowledge.ChunkSize < 0 || c.Knowledge.ChunkOverlap < 0 || c.Knowledge.TopK < 0 {
+		return fmt.Errorf("knowledge sizes must not be negative")
+	}
+	if c.Knowledge.ChunkOverlap >= c.Knowledge.chunkSize() {
+		return fmt.Errorf("knowledge.chunk_overlap must be smaller than the chunk size")
+	}
+	switch c.ClipboardHistory.Mode {
+	case "", ClipsLast, ClipsPick:
+	default:
+		return fmt.Errorf("clipboard_history: unknown mode '%s'", c.ClipboardHistory.Mode)
+	}
+	switch c.ClipboardHistory.Persist {
+	case "", PersistOff, PersistPlain, PersistEncrypted:
+	default:
+		return fmt.Errorf("clipboard_history: unknown persist mode '%s'", c.ClipboardHistory.Persist)
+	}
+	if c.ClipboardHistory.Size < 0 || c.ClipboardHistory.Last < 0 || c.ClipboardHistory.PollMS < 0 || c.ClipboardHistory.MaxEntryBytes < 0 {
+		return fmt.Errorf("clipboard_history: sizes and intervals must not be negative")
+	}
+	if key := c.ClipboardHistory.keyPath(); key != "" && sameDirectory(filepath.Dir(key), filepath.Dir(ClipboardHistoryPath(c.ClipboardHistory))) {
+		return fmt.Errorf("clipboard_history: key_path must not be in the history's directory")
+	}
+	if name := c.Display.Clipboard; name != "" && name != "auto" {
+		if _, ok := clipboardBackends[name]; !ok {
+			return fmt.Errorf("display: unknown clipboard backend '%s'", name)
+		}
+	}
+	switch c.Display.Screenshot {
+	case "", "auto", ScreenshotPortal, ScreenshotGrim, ScreenshotX11, ScreenshotGnome, ScreenshotScrot:
+	default:
+		return fmt.Errorf("display: unknown screenshot backend '%s'", c.Display.Screenshot)
+	}
+	if c.Voice.Recorder != "" && c.Voice.Recorder != "auto" {
+		if _, ok := voiceRecorders[c.Voice.Recorder]; !ok {
+			return fmt.Errorf("voice: unknown recorder '%s'", c.Voice.Recorder)
+		}
+	}
+	switch c.OCR.Mode {
+	case "", OCRAuto, OCRAlways, OCRNever:
+	default:
+		return fmt.Errorf("ocr: unknown mode '%s'", c.OCR.Mode)
+	}
+	if _, err := NewOCREngine(c.OCR); err != nil {
+		return fmt.Errorf("ocr: %v", err)
+	}
+	if c.Tools.TimeoutSeconds < 0 || c.Tools.MaxOutputBytes < 0 || c.Tools.MaxRounds < 0 {
+		return fmt.Errorf("tools limits must not be negative")
+	}
+
+	profiles := map[string]bool{DefaultProfileName: true}
+	for i, profile := range c.Profiles {
+		if profile.Name == "" {
+			return fmt.Errorf("profile %d has no name", i)
+		}
+		if profiles[profile.Name] {
+			return fmt.Errorf("duplicate profile name '%s'", profile.Name)
+		}
+		profiles[profile.Name] = true
+	}
+	return nil
+}
+
+// delimiters returns the configured delimiters or the defaults
+func (sc SnippetConfig) delimiters() string {
+	if sc.Delimiters != "" {
+		return sc.Delimiters
+	}
+	return " "
+}
+
 // ParseKeyCombination parses a key combination string into individual key codes
 func ParseKeyCombination(combination string) ([]uint16, error) {
 	parts := strings.Split(strings.ToLower(combination), "+")
@@ -63,17 +834,82 @@ func ParseKeyCombination(combination string) ([]uint16, error) {
 	return keys, nil
 }
 
+// ParseKeyBinding parses a key binding string of the form
+// "keys[:trigger[:milliseconds]]" into a KeyCombination, e.g. "win+c",
+// "capslock:tap", "rightalt:doubletap:250" or "f9:hold"
+func ParseKeyBinding(name, binding string) (KeyCombination, error) {
+	parts := strings.Split(strings.ToLower(strings.TrimSpace(binding)), ":")
+	if len(parts) > 3 {
+		return KeyCombination{}, fmt.Errorf("invalid key binding '%s': too many ':' separated fields", binding)
+	}
+
+	keys, err := ParseKeyCombination(parts[0])
+	if err != nil {
+		return KeyCombination{}, err
+	}
+	combination := KeyCombination{
+		Name: name,
+		Keys: keys,
+	}
+
+	if len(parts) > 1 {
+		trigger, err := parseTriggerType(strings.TrimSpace(parts[1]))
+		if err != nil {
+			return KeyCombination{}, fmt.Errorf("invalid key binding '%s': %v", binding, err)
+		}
+		combination.Trigger = trigger
+	}
+
+	if len(parts) > 2 {
+		ms, err := strconv.ParseUint(strings.TrimSpace(parts[2]), 10, 32)
+		if err != nil {
+			return KeyCombination{}, fmt.Errorf("invalid threshold '%s' in key binding '%s': %v", parts[2], binding, err)
+		}
+		combination.Threshold = time.Duration(ms) * time.Millisecond
+	}
+
+	return combination, nil
+}
+
+// parseTriggerType converts a trigger name to its TriggerType
+func parseTriggerType(trigger string) (TriggerType, error) {
+	switch trigger {
+	case "", "press":
+		return TriggerPress, nil
+	case "tap":
+		return TriggerTap, nil
+	case "doubletap", "double-tap", "double":
+		return TriggerDoubleTap, nil
+	case "longpress", "long-press", "long":
+		return TriggerLongPress, nil
+	case "hold":
+		return TriggerHold, nil
+	default:
+		return TriggerPress, fmt.Errorf("unknown trigger type: %s", trigger)
+	}
+}
+
 // stringToKeyCode converts a string representation of a key to its key code
 func stringToKeyCode(key string) (uint16, error) {
 	switch key {
-	case "ctrl", "control":
+	case "ctrl", "control", "leftctrl":
 		return KEY_LEFTCTRL, nil
-	case "alt":
+	case "alt", "leftalt":
 		return KEY_LEFTALT, nil
-	case "shift":
+	case "shift", "leftshift":
 		return KEY_LEFTSHIFT, nil
-	case "win", "windows", "meta":
+	case "win", "windows", "meta", "leftmeta":
 		return KEY_LEFTMETA, nil
+	case "rightctrl":
+		return KEY_RIGHTCTRL, nil
+	case "rightalt", "altgr":
+		return KEY_RIGHTALT, nil
+	case "rightshift":
+		return KEY_RIGHTSHIFT, nil
+	case "rightwin", "rightmeta":
+		return KEY_RIGHTMETA, nil
+	case "capslock", "caps":
+		return KEY_CAPSLOCK, nil
 	case "a":
 		return KEY_A, nil
 	case "b":
@@ -178,6 +1014,10 @@ func stringToKeyCode(key string) (uint16, error) {
 		return KEY_TAB, nil
 	case "escape", "esc":
 		return KEY_ESC, nil
+	case "pause", "break":
+		return KEY_PAUSE, nil
+	case "scrolllock":
+		return KEY_SCROLLLOCK, nil
 	case "backspace":
 		return KEY_BACKSPACE, nil
 	default:
@@ -0,0 +1,199 @@
+package keyboard
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ControlHandler runs a control command and returns a JSON-serializable result
+type ControlHandler func(args []string) (interface{}, error)
+
+// ControlResponse is the JSON line written back for every command
+type ControlResponse struct {
+	OK     bool            `json:"ok"`
+	Result json.RawMessage `json:"result,omitempty"`
+	Error  string          `json:"error,omitempty"`
+}
+
+// ControlServer accepts line-based commands ("status", "cancel", ...) on a
+// Unix socket and answers each with a ControlResponse
+type ControlServer struct {
+	listener net.Listener
+	mu       sync.RWMutex
+	handlers map[string]ControlHandler
+}
+
+// ControlSocketPath returns KEYGEIST_CONTROL_SOCKET if set, otherwise
+// keygeist.sock in XDG_RUNTIME_DIR (or the temporary directory)
+func ControlSocketPath() string {
+	if env := os.Getenv("KEYGEIST_CONTROL_SOCKET"); env != "" {
+		return env
+	}
+	dir := os.Getenv("XDG_RUNTIME_DIR")
+	if dir == "" {
+		dir = filepath.Join(os.TempDir(), fmt.Sprintf("keygeist-%d", os.Getuid()))
+	}
+	return filepath.Join(dir, "keygeist.sock")
+}
+
+// ListenControl returns the control socket passed by systemd socket
+// activation, or creates one at ControlSocketPath
+func ListenControl() (net.Listener, error) {
+	listeners, err := SdListeners()
+	if err != nil {
+		return nil, err
+	}
+	if len(listeners) > 0 {
+		for _, extra := range listeners[1:] {
+			extra.Close()
+		}
+		return listeners[0], nil
+	}
+
+	path := ControlSocketPath()
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, fmt.Errorf("failed to create control socket directory: %v", err)
+	}
+	// A stale socket from a previous run would make Listen fail
+	if conn, err := net.DialTimeout("unix", path, time.Second); err == nil {
+		conn.Close()
+		return nil, fmt.Errorf("control socket %s is in use by another keygeist", path)
+	}
+	os.Remove(path)
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s: %v", path, err)
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("failed to restrict %s: %v", path, err)
+	}
+	return listener, nil
+}
+
+// NewControlServer creates a control server with the built-in "ping" and
+// "help" commands
+func NewControlServer(listener net.Listener) *ControlServer {
+	cs := &ControlServer{
+		listener: listener,
+		handlers: make(map[string]ControlHandler),
+	}
+	cs.Handle("ping", func(args []string) (interface{}, error) {
+		return "pong", nil
+	})
+	cs.Handle("help", func(args []string) (interface{}, error) {
+		return cs.commands(), nil
+	})
+	return cs
+}
+
+// Handle registers a command; it may be called while serving
+func (cs *ControlServer) Handle(command string, handler ControlHandler) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	cs.handlers[command] = handler
+}
+
+// Serve accepts connections until the server is closed
+func (cs *ControlServer) Serve() error {
+	for {
+		conn, err := cs.listener.Accept()
+		if err != nil {
+			if isClosedError(err) {
+				return nil
+			}
+			return err
+		}
+		go cs.serveConn(conn)
+	}
+}
+
+// Close stops accepting connections
+func (cs *ControlServer) Close() error {
+	return cs.listener.Close()
+}
+
+// serveConn answers commands from one client, one per line
+func (cs *ControlServer) serveConn(conn net.Conn) {
+	defer conn.Close()
+	scanner := bufio.NewScanner(conn)
+	encoder := json.NewEncoder(conn)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if err := encoder.Encode(cs.dispatch(fields[0], fields[1:])); err != nil {
+			return
+		}
+	}
+}
+
+// dispatch runs a command and wraps its outcome in a response
+func (cs *ControlServer) dispatch(command string, args []string) ControlResponse {
+	cs.mu.RLock()
+	handler, ok := cs.handlers[command]
+	cs.mu.RUnlock()
+	if !ok {
+		return ControlResponse{Error: fmt.Sprintf("unknown command: %s (try 'help')", command)}
+	}
+
+	result, err := handler(args)
+	if err != nil {
+		return ControlResponse{Error: err.Error()}
+	}
+	data, err := json.Marshal(result)
+	if err != nil {
+		return ControlResponse{Error: fmt.Sprintf("failed to encode result: %v", err)}
+	}
+	return ControlResponse{OK: true, Result: data}
+}
+
+// commands returns the registered command names
+func (cs *ControlServer) commands() []string {
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+	names := make([]string, 0, len(cs.handlers))
+	for name := range cs.handlers {
+		names = append(names, name)
+	}
+	return names
+}
+
+// ControlRequest sends a command to a running keygeist and returns its result
+func ControlRequest(command string, args ...string) (json.RawMessage, error) {
+	path := ControlSocketPath()
+	conn, err := net.DialTimeout("unix", path, 5*time.Second)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %s (is keygeist running?): %v", path, err)
+	}
+	defer conn.Close()
+
+	line := strings.Join(append([]string{command}, args...), " ")
+	if _, err := fmt.Fprintln(conn, line); err != nil {
+		return nil, fmt.Errorf("failed to send command: %v", err)
+	}
+
+	var response ControlResponse
+	if err := json.NewDecoder(bufio.NewReader(conn)).Decode(&response); err != nil {
+		return nil, fmt.Errorf("failed to read response: %v", err)
+	}
+	if !response.OK {
+		return nil, fmt.Errorf("%s", response.Error)
+	}
+	return response.Result, nil
+}
+
+// isClosedError checks if an error comes from using a closed listener
+func isClosedError(err error) bool {
+	return errors.Is(err, net.ErrClosed)
+}
@@ -0,0 +1,58 @@
+package keyboard
+
+import (
+	"fmt"
+	"strings"
+)
+
+// unifiedDiff returns a line diff between two versions of a file, with
+// unchanged lines as context. Files handled by the installer are small, so
+// the whole file is shown rather than individual hunks.
+func unifiedDiff(path, oldContent, newContent string) string {
+	oldLines := splitLines(oldContent)
+	newLines := splitLines(newContent)
+
+	// Longest common subsequence table
+	lcs := make([][]int, len(oldLines)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(newLines)+1)
+	}
+	for i := len(oldLines) - 1; i >= 0; i-- {
+		for j := len(newLines) - 1; j >= 0; j-- {
+			if oldLines[i] == newLines[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "--- %s\n+++ %s\n", path, path)
+	i, j := 0, 0
+	for i < len(oldLines) || j < len(newLines) {
+		switch {
+		case i < len(oldLines) && j < len(newLines) && oldLines[i] == newLines[j]:
+			fmt.Fprintf(&b, " %s\n", oldLines[i])
+			i++
+			j++
+		case i < len(oldLines) && (j >= len(newLines) || lcs[i+1][j] >= lcs[i][j+1]):
+			fmt.Fprintf(&b, "-%s\n", oldLines[i])
+			i++
+		default:
+			fmt.Fprintf(&b, "+%s\n", newLines[j])
+			j++
+		}
+	}
+	return b.String()
+}
+
+// splitLines splits content into lines without the trailing empty line
+func splitLines(content string) []string {
+	if content == "" {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(content, "\n"), "\n")
+}
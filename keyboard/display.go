@@ -0,0 +1,472 @@
+package keyboard
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"image/png"
+	"log/slog"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+	"github.com/kbinani/screenshot"
+)
+
+// Clipboard backends
+const (
+	ClipboardWayland = "wl-clipboard"
+	ClipboardXclip   = "xclip"
+	ClipboardXsel    = "xsel"
+)
+
+// Screenshot backends
+const (
+	ScreenshotPortal = "portal"
+	ScreenshotGrim   = "grim"
+	ScreenshotX11    = "x11"
+	ScreenshotGnome  = "gnome-screenshot"
+	ScreenshotScrot  = "scrot"
+)
+
+// portalName is the bus name of xdg-desktop-portal
+const portalName = "org.freedesktop.portal.Desktop"
+
+// screenshotTimeout bounds a capture, including a portal permission dialog
+const screenshotTimeout = 30 * time.Second
+
+// ClipboardBackend reads and writes the clipboard with a command line tool
+type ClipboardBackend struct {
+	Name string
+	// read, write and types are the commands; types lists the formats the
+	// clipboard owner offers. primary reads the primary selection.
+	read, write, types, primary []string
+	// empty matches the error output of read when the clipboard holds no text
+	empty []string
+	// unavailable is why no clipboard tool can be used, returned by every
+	// command
+	unavailable error
+}
+
+// clipboardBackends are the supported clipboard tools
+var clipboardBackends = map[string]ClipboardBackend{
+	ClipboardWayland: {
+		Name:    ClipboardWayland,
+		read:    []string{"wl-paste", "--no-newline", "--type", "text"},
+		write:   []string{"wl-copy", "--type", "text/plain;charset=utf-8"},
+		types:   []string{"wl-paste", "--list-types"},
+		primary: []string{"wl-paste", "--primary", "--no-newline", "--type", "text"},
+		empty:   []string{"Nothing is copied", "No selection", "not offered"},
+	},
+	ClipboardXclip: {
+		Name:    ClipboardXclip,
+		read:    []string{"xclip", "-selection", "clipboard", "-o"},
+		write:   []string{"xclip", "-selection", "clipboard", "-i"},
+		types:   []string{"xclip", "-selection", "clipboard", "-o", "-t", "TARGETS"},
+		primary: []string{"xclip", "-selection", "primary", "-o"},
+		empty:   []string{"target STRING not available", "target UTF8_STRING not available"},
+	},
+	ClipboardXsel: {
+		Name:    ClipboardXsel,
+		read:    []string{"xsel", "--clipboard", "--output"},
+		write:   []string{"xsel", "--clipboard", "--input"},
+		primary: []string{"xsel", "--primary", "--output"},
+	},
+}
+
+// NewClipboardBackend returns the clipboard backend for config. When none
+// can be used, the backend's commands fail with the reason.
+func NewClipboardBackend(config DisplayConfig) ClipboardBackend {
+	backend, err := selectClipboard(config.Clipboard)
+	if err != nil {
+		return ClipboardBackend{Name: "none", unavailable: err}
+	}
+	return backend
+}
+
+// selectClipboard returns the named clipboard backend, or the one matching
+// the session: wl-clipboard on Wayland, xclip or xsel on X11
+func selectClipboard(name string) (ClipboardBackend, error) {
+	if name != "" && name != "auto" {
+		backend, ok := clipboardBackends[name]
+		if !ok {
+			return ClipboardBackend{}, fmt.Errorf("unknown clipboard backend '%s'", name)
+		}
+		return backend, nil
+	}
+	switch DisplayServer() {
+	case "wayland":
+		if _, err := exec.LookPath("wl-paste"); err != nil {
+			return ClipboardBackend{}, fmt.Errorf("wl-paste not found in the Wayland session; install wl-clipboard")
+		}
+		return clipboardBackends[ClipboardWayland], nil
+	case "x11":
+		for _, name := range []string{ClipboardXclip, ClipboardXsel} {
+			if _, err := exec.LookPath(name); err == nil {
+				return clipboardBackends[name], nil
+			}
+		}
+		return ClipboardBackend{}, fmt.Errorf("neither xclip nor xsel found in the X11 session; install xclip")
+	}
+	return ClipboardBackend{}, fmt.Errorf("no display server detected: neither WAYLAND_DISPLAY nor DISPLAY is set")
+}
+
+// command prepares one of the backend's commands
+func (cb ClipboardBackend) command(ctx context.Context, command []string) (*exec.Cmd, error) {
+	if cb.unavailable != nil {
+		return nil, cb.unavailable
+	}
+	if len(command) == 0 {
+		return nil, fmt.Errorf("%s can't do this", cb.Name)
+	}
+	if err := helperAllowed("clipboard tools"); err != nil {
+		return nil, err
+	}
+	return helperCommand(ctx, command[0], command[1:]...)
+}
+
+// output runs a reading command; output matching the empty messages means
+// no text rather than an error
+func (cb ClipboardBackend) output(command []string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	cmd, err := cb.command(ctx, command)
+	if err != nil {
+		return nil, err
+	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil {
+		message := strings.TrimSpace(stderr.String())
+		for _, empty := range cb.empty {
+			if strings.Contains(message, empty) {
+				return nil, nil
+			}
+		}
+		if message == "" {
+			return nil, fmt.Errorf("%s failed: %v", command[0], err)
+		}
+		return nil, fmt.Errorf("%s failed: %v: %s", command[0], err, message)
+	}
+	return output, nil
+}
+
+// Read returns the clipboard text; an empty clipboard is not an error
+func (cb ClipboardBackend) Read() (string, error) {
+	output, err := cb.output(cb.read)
+	if err != nil {
+		return "", fmt.Errorf("failed to read clipboard: %v", err)
+	}
+	return string(output), nil
+}
+
+// ReadPrimary returns the primary selection: the text last selected, which
+// copying doesn't change. Nothing selected is not an error.
+func (cb ClipboardBackend) ReadPrimary() (string, error) {
+	output, err := cb.output(cb.primary)
+	if err != nil {
+		return "", fmt.Errorf("failed to read the primary selection: %v", err)
+	}
+	return string(output), nil
+}
+
+// Write replaces the clipboard text. The tools fork to keep serving the
+// clipboard, so their output isn't captured: it would never be closed.
+func (cb ClipboardBackend) Write(text string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	cmd, err := cb.command(ctx, cb.write)
+	if err != nil {
+		return fmt.Errorf("failed to write clipboard: %v", err)
+	}
+	cmd.Stdin = strings.NewReader(text)
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("failed to write clipboard: %s failed: %v", cb.write[0], err)
+	}
+	return nil
+}
+
+// Types lists the formats offered by the clipboard owner
+func (cb ClipboardBackend) Types() ([]string, error) {
+	output, err := cb.output(cb.types)
+	if err != nil {
+		return nil, err
+	}
+	return strings.Fields(string(output)), nil
+}
+
+// wlrootsDesktop reports whether the compositor is wlroots based, where
+// grim works and the portal may not be installed
+func wlrootsDesktop() bool {
+	if os.Getenv("SWAYSOCK") != "" || os.Getenv("HYPRLAND_INSTANCE_SIGNATURE") != "" {
+		return true
+	}
+	desktop := strings.ToLower(os.Getenv("XDG_CURRENT_DESKTOP"))
+	for _, name := range []string{"sway", "hyprland", "river", "wayfire", "labwc", "niri"} {
+		if strings.Contains(desktop, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// dataControlDesktop reports whether the compositor offers the data-control
+// protocol, letting wl-paste read the clipboard without mapping a window.
+// Mutter (GNOME) doesn't, so wl-paste there briefly takes the focus.
+func dataControlDesktop() bool {
+	if wlrootsDesktop() {
+		return true
+	}
+	desktop := strings.ToLower(os.Getenv("XDG_CURRENT_DESKTOP"))
+	for _, name := range []string{"kde", "cosmic"} {
+		if strings.Contains(desktop, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// screenshotBackends returns the backends to try in order: the one set in
+// config, or those matching the session
+func screenshotBackends(config DisplayConfig) ([]string, error) {
+	if name := config.Screenshot; name != "" && name != "auto" {
+		return []string{name}, nil
+	}
+	switch DisplayServer() {
+	case "wayland":
+		if wlrootsDesktop() {
+			return []string{ScreenshotGrim, ScreenshotPortal}, nil
+		}
+		return []string{ScreenshotPortal, ScreenshotGrim}, nil
+	case "x11":
+		return []string{ScreenshotX11, ScreenshotGnome, ScreenshotScrot}, nil
+	}
+	return nil, fmt.Errorf("no display server detected: neither WAYLAND_DISPLAY nor DISPLAY is set")
+}
+
+// captureScreenshots takes PNG screenshots with the first backend that
+// works, one per display when the backend captures them separately
+func captureScreenshots(log *slog.Logger, config DisplayConfig) ([][]byte, error) {
+	backends, err := screenshotBackends(config)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), screenshotTimeout)
+	defer cancel()
+	var failures []string
+	for _, name := range backends {
+		start := time.Now()
+		images, err := captureWith(ctx, name)
+		if err == nil && len(images) == 0 {
+			err = fmt.Errorf("no display captured")
+		}
+		if err == nil {
+			log.Debug("captured screenshot", "backend", name, "displays", len(images), "latency", time.Since(start))
+			return images, nil
+		}
+		log.Debug("screenshot backend failed", "backend", name, "error", err)
+		failures = append(failures, fmt.Sprintf("%s: %v", name, err))
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, fmt.Errorf("%s", strings.Join(failures, "; "))
+}
+
+// captureWith takes screenshots with one backend
+func captureWith(ctx context.Context, name string) ([][]byte, error) {
+	switch name {
+	case ScreenshotPortal:
+		image, err := portalScreenshot(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return [][]byte{image}, nil
+	case ScreenshotGrim:
+		image, err := commandScreenshot(ctx, "grim", "-t", "png", "-")
+		if err != nil {
+			return nil, err
+		}
+		return [][]byte{image}, nil
+	case ScreenshotGnome:
+		image, err := fileScreenshot(ctx, "gnome-screenshot", "-f")
+		if err != nil {
+			return nil, err
+		}
+		return [][]byte{image}, nil
+	case ScreenshotScrot:
+		image, err := fileScreenshot(ctx, "scrot", "--overwrite")
+		if err != nil {
+			return nil, err
+		}
+		return [][]byte{image}, nil
+	case ScreenshotX11:
+		return x11Screenshots()
+	}
+	return nil, fmt.Errorf("unknown screenshot backend '%s'", name)
+}
+
+// x11Screenshots captures every display through the X server
+func x11Screenshots() ([][]byte, error) {
+	displays := screenshot.NumActiveDisplays()
+	if displays == 0 {
+		return nil, fmt.Errorf("no display found")
+	}
+	var images [][]byte
+	for i := 0; i < displays; i++ {
+		img, err := screenshot.CaptureRect(screenshot.GetDisplayBounds(i))
+		if err != nil {
+			return nil, fmt.Errorf("display %d: %v", i, err)
+		}
+		var buf bytes.Buffer
+		if err := png.Encode(&buf, img); err != nil {
+			return nil, fmt.Errorf("failed to encode display %d: %v", i, err)
+		}
+		images = append(images, buf.Bytes())
+	}
+	return images, nil
+}
+
+// commandScreenshot runs a tool writing a PNG to its standard output
+func commandScreenshot(ctx context.Context, name string, args ...string) ([]byte, error) {
+	if _, err := exec.LookPath(name); err != nil {
+		return nil, fmt.Errorf("%s not found", name)
+	}
+	cmd, err := helperCommand(ctx, name, args...)
+	if err != nil {
+		return nil, err
+	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("%s failed: %v: %s", name, err, strings.TrimSpace(stderr.String()))
+	}
+	return output, nil
+}
+
+// fileScreenshot runs a tool saving a PNG to the file named by its last
+// argument
+func fileScreenshot(ctx context.Context, name string, args ...string) ([]byte, error) {
+	if _, err := exec.LookPath(name); err != nil {
+		return nil, fmt.Errorf("%s not found", name)
+	}
+	tmpFile, err := os.CreateTemp("", "screenshot-*.png")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temp file: %v", err)
+	}
+	tmpFile.Close()
+	defer os.Remove(tmpFile.Name())
+
+	cmd, err := helperCommand(ctx, name, append(args, tmpFile.Name())...)
+	if err != nil {
+		return nil, err
+	}
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return nil, fmt.Errorf("%s failed: %v: %s", name, err, strings.TrimSpace(string(output)))
+	}
+	image, err := os.ReadFile(tmpFile.Name())
+	if err != nil {
+		return nil, fmt.Errorf("failed to read screenshot file: %v", err)
+	}
+	if len(image) == 0 {
+		return nil, fmt.Errorf("%s saved an empty file", name)
+	}
+	return image, nil
+}
+
+// portalAvailable reports whether xdg-desktop-portal runs or can be started
+// on the session bus
+func portalAvailable() bool {
+	conn, err := dbus.ConnectSessionBus()
+	if err != nil {
+		return false
+	}
+	defer conn.Close()
+	var owned bool
+	if err := conn.BusObject().Call("org.freedesktop.DBus.NameHasOwner", 0, portalName).Store(&owned); err == nil && owned {
+		return true
+	}
+	var activatable []string
+	if err := conn.BusObject().Call("org.freedesktop.DBus.ListActivatableNames", 0).Store(&activatable); err != nil {
+		return false
+	}
+	return containsString(activatable, portalName)
+}
+
+// portalScreenshot asks the xdg-desktop-portal Screenshot interface for a
+// non-interactive screenshot. The desktop may ask the user for permission
+// the first time. The file the portal saves is removed once read.
+func portalScreenshot(ctx context.Context) ([]byte, error) {
+	conn, err := dbus.ConnectSessionBus()
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to the session bus: %v", err)
+	}
+	defer conn.Close()
+
+	// The request object path is known in advance from the token, so the
+	// response can't be missed
+	random := make([]byte, 8)
+	if _, err := rand.Read(random); err != nil {
+		return nil, err
+	}
+	token := "keygeist_" + hex.EncodeToString(random)
+	sender := strings.ReplaceAll(strings.TrimPrefix(conn.Names()[0], ":"), ".", "_")
+	request := dbus.ObjectPath("/org/freedesktop/portal/desktop/request/" + sender + "/" + token)
+	if err := conn.AddMatchSignal(
+		dbus.WithMatchInterface("org.freedesktop.portal.Request"),
+		dbus.WithMatchMember("Response"),
+	); err != nil {
+		return nil, fmt.Errorf("failed to watch portal responses: %v", err)
+	}
+	signals := make(chan *dbus.Signal, 4)
+	conn.Signal(signals)
+
+	portal := conn.Object(portalName, "/org/freedesktop/portal/desktop")
+	options := map[string]dbus.Variant{
+		"handle_token": dbus.MakeVariant(token),
+		"interactive":  dbus.MakeVariant(false),
+	}
+	var handle dbus.ObjectPath
+	if err := portal.CallWithContext(ctx, "org.freedesktop.portal.Screenshot.Screenshot", 0, "", options).Store(&handle); err != nil {
+		return nil, fmt.Errorf("screenshot portal unavailable: %v", err)
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			conn.Object(portalName, handle).Call("org.freedesktop.portal.Request.Close", 0)
+			return nil, fmt.Errorf("no answer from the screenshot portal: %v", ctx.Err())
+		case signal := <-signals:
+			if signal.Path != handle && signal.Path != request || len(signal.Body) < 2 {
+				continue
+			}
+			response, _ := signal.Body[0].(uint32)
+			results, _ := signal.Body[1].(map[string]dbus.Variant)
+			switch response {
+			case 0:
+			case 1:
+				return nil, fmt.Errorf("screenshot denied by the user")
+			default:
+				return nil, fmt.Errorf("the screenshot portal failed")
+			}
+			uri, _ := results["uri"].Value().(string)
+			location, err := url.Parse(uri)
+			if err != nil || location.Scheme != "file" {
+				return nil, fmt.Errorf("unexpected screenshot location '%s'", uri)
+			}
+			image, err := os.ReadFile(location.Path)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read the portal screenshot: %v", err)
+			}
+			os.Remove(location.Path)
+			return image, nil
+		}
+	}
+}
@@ -0,0 +1,500 @@
+package keyboard
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sashabaranov/go-openai"
+	"golang.org/x/sys/unix"
+)
+
+// DoctorStatus is the outcome of a diagnostic check
+type DoctorStatus int
+
+const (
+	DoctorOK DoctorStatus = iota
+	DoctorWarn
+	DoctorFail
+)
+
+// String returns the label printed for the status
+func (s DoctorStatus) String() string {
+	switch s {
+	case DoctorWarn:
+		return "WARN"
+	case DoctorFail:
+		return "FAIL"
+	default:
+		return "OK"
+	}
+}
+
+// DoctorResult is the result of a single diagnostic check
+type DoctorResult struct {
+	Name   string
+	Status DoctorStatus
+	Detail string
+	// Fix is an actionable suggestion, possibly spanning several lines
+	Fix string
+}
+
+// DoctorOptions configures the diagnostics
+type DoctorOptions struct {
+	APIKey         string
+	Model          string
+	BaseURL        string
+	KeyboardDevice string
+	// SkipLLM disables the test request against the LLM endpoint
+	SkipLLM bool
+	// Timeout bounds the LLM test request
+	Timeout time.Duration
+}
+
+// InputDevice describes an evdev device found under /dev/input
+type InputDevice struct {
+	Path     string
+	Name     string
+	Keyboard bool
+	Readable bool
+}
+
+// RunDoctor checks the environment Keygeist needs and suggests fixes
+func RunDoctor(ctx context.Context, opts DoctorOptions) []DoctorResult {
+	// A broken config file is reported by checkConfiguration
+	var display DisplayConfig
+	if config, err := LoadConfig(); err == nil {
+		display = config.Display
+	}
+	var results []DoctorResult
+	results = append(results, checkUinput()...)
+	results = append(results, checkGroups()...)
+	results = append(results, checkInputDevices(opts.KeyboardDevice))
+	results = append(results, checkDisplayServer())
+	results = append(results, checkHelpers()...)
+	results = append(results, checkScreenshot(display))
+	results = append(results, checkConfiguration()...)
+	if !opts.SkipLLM {
+		results = append(results, checkLLM(ctx, opts))
+	}
+	return results
+}
+
+// udevFix is the suggestion printed for device permission problems
+func udevFix() string {
+	return fmt.Sprintf("Install these rules as %s (or run 'keygeist install'):\n\n%s\nthen run: sudo udevadm control --reload-rules && sudo udevadm trigger",
+		UdevRulesPath, RenderUdevRules("uinput", "input"))
+}
+
+// checkUinput checks that /dev/uinput exists and is writable
+func checkUinput() []DoctorResult {
+	const path = "/dev/uinput"
+	if _, err := os.Stat(path); err != nil {
+		return []DoctorResult{{
+			Name:   "uinput",
+			Status: DoctorFail,
+			Detail: fmt.Sprintf("%s not found: %v", path, err),
+			Fix:    "Load the module: sudo modprobe uinput && echo uinput | sudo tee /etc/modules-load.d/uinput.conf",
+		}}
+	}
+	if err := unix.Access(path, unix.W_OK); err != nil {
+		return []DoctorResult{{
+			Name:   "uinput",
+			Status: DoctorFail,
+			Detail: fmt.Sprintf("%s is not writable: %v", path, err),
+			Fix:    udevFix(),
+		}}
+	}
+	return []DoctorResult{{Name: "uinput", Status: DoctorOK, Detail: path + " is writable"}}
+}
+
+// checkGroups checks membership of the uinput and input groups, both in
+// the group database and in the current session
+func checkGroups() []DoctorResult {
+	if os.Geteuid() == 0 {
+		return []DoctorResult{{
+			Name:   "groups",
+			Status: DoctorWarn,
+			Detail: "running as root; group membership of your user was not checked",
+			Fix:    "Run 'keygeist doctor' as your regular user",
+		}}
+	}
+
+	current, err := user.Current()
+	if err != nil {
+		return []DoctorResult{{Name: "groups", Status: DoctorWarn, Detail: fmt.Sprintf("failed to look up current user: %v", err)}}
+	}
+	configured, _ := current.GroupIds()
+	active, _ := os.Getgroups()
+
+	var results []DoctorResult
+	for _, name := range []string{"uinput", "input"} {
+		result := DoctorResult{Name: "group " + name}
+		group, err := user.LookupGroup(name)
+		if err != nil {
+			result.Status = DoctorWarn
+			result.Detail = fmt.Sprintf("group %s does not exist", name)
+			result.Fix = fmt.Sprintf("sudo groupadd -f %s && sudo usermod -a -G %s %s", name, name, current.Username)
+			results = append(results, result)
+			continue
+		}
+		gid, _ := strconv.Atoi(group.Gid)
+		switch {
+		case containsInt(active, gid):
+			result.Status = DoctorOK
+			result.Detail = fmt.Sprintf("%s is a member of %s", current.Username, name)
+		case containsString(configured, group.Gid):
+			result.Status = DoctorWarn
+			result.Detail = fmt.Sprintf("%s was added to %s but this session predates it", current.Username, name)
+			result.Fix = "Log out and log back in (or reboot) for the group change to take effect"
+		default:
+			result.Status = DoctorWarn
+			result.Detail = fmt.Sprintf("%s is not a member of %s", current.Username, name)
+			result.Fix = fmt.Sprintf("sudo usermod -a -G %s %s, then log out and back in", name, current.Username)
+		}
+		results = append(results, result)
+	}
+	return results
+}
+
+// checkInputDevices checks that at least one keyboard device is readable
+func checkInputDevices(keyboardDevice string) DoctorResult {
+	result := DoctorResult{Name: "input devices"}
+
+	if keyboardDevice != "" {
+		if err := unix.Access(keyboardDevice, unix.R_OK); err != nil {
+			result.Status = DoctorFail
+			result.Detail = fmt.Sprintf("KEYBOARD_DEVICE %s is not readable: %v", keyboardDevice, err)
+			result.Fix = udevFix()
+			return result
+		}
+		result.Status = DoctorOK
+		result.Detail = fmt.Sprintf("KEYBOARD_DEVICE %s is readable", keyboardDevice)
+		return result
+	}
+
+	devices, err := ListInputDevices()
+	if err != nil {
+		result.Status = DoctorFail
+		result.Detail = err.Error()
+		result.Fix = "Make sure the evdev module is loaded: sudo modprobe evdev"
+		return result
+	}
+
+	var keyboards, readable []string
+	for _, device := range devices {
+		if !device.Keyboard {
+			continue
+		}
+		label := fmt.Sprintf("%s (%s)", device.Path, device.Name)
+		keyboards = append(keyboards, label)
+		if device.Readable {
+			readable = append(readable, label)
+		}
+	}
+
+	switch {
+	case len(keyboards) == 0:
+		result.Status = DoctorFail
+		result.Detail = "no keyboard devices found under /dev/input"
+		result.Fix = "Connect a keyboard or set KEYBOARD_DEVICE to the right /dev/input/eventN"
+	case len(readable) == 0:
+		result.Status = DoctorFail
+		result.Detail = fmt.Sprintf("found keyboards but none is readable: %s", strings.Join(keyboards, ", "))
+		result.Fix = udevFix()
+	default:
+		result.Status = DoctorOK
+		result.Detail = fmt.Sprintf("readable keyboards: %s", strings.Join(readable, ", "))
+	}
+	return result
+}
+
+// ListInputDevices enumerates evdev devices and their keyboard capability
+func ListInputDevices() ([]InputDevice, error) {
+	paths, err := filepath.Glob("/dev/input/event*")
+	if err != nil {
+		return nil, err
+	}
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("no event devices found under /dev/input")
+	}
+
+	devices := make([]InputDevice, 0, len(paths))
+	for _, path := range paths {
+		sysDir := filepath.Join("/sys/class/input", filepath.Base(path), "device")
+		device := InputDevice{Path: path}
+		if name, err := os.ReadFile(filepath.Join(sysDir, "name")); err == nil {
+			device.Name = strings.TrimSpace(string(name))
+		}
+		if caps, err := os.ReadFile(filepath.Join(sysDir, "capabilities", "key")); err == nil {
+			device.Keyboard = hasKeyboardKeys(strings.TrimSpace(string(caps)))
+		}
+		device.Readable = unix.Access(path, unix.R_OK) == nil
+		devices = append(devices, device)
+	}
+	return devices, nil
+}
+
+// hasKeyboardKeys checks a sysfs key capability bitmap for letter and enter keys
+func hasKeyboardKeys(bitmap string) bool {
+	words := strings.Fields(bitmap)
+	// The words are the kernel's longs, which may be wider than ours. All
+	// but the first are zero padded, giving away their width; a single word
+	// holds every bit either way.
+	wordBits := uint(64)
+	if len(words) > 1 {
+		wordBits = uint(len(words[1]) * 4)
+	}
+	if wordBits == 0 || wordBits > 64 {
+		return false
+	}
+	hasKey := func(code uint) bool {
+		index := len(words) - 1 - int(code/wordBits)
+		if index < 0 {
+			return false
+		}
+		word, err := strconv.ParseUint(words[index], 16, 64)
+		if err != nil {
+			return false
+		}
+		return word&(1<<(code%wordBits)) != 0
+	}
+	for _, code := range []uint{KEY_A, KEY_Z, KEY_SPACE, KEY_ENTER} {
+		if !hasKey(code) {
+			return false
+		}
+	}
+	return true
+}
+
+// DisplayServer returns the session type: "wayland", "x11" or "" if unknown
+func DisplayServer() string {
+	switch session := os.Getenv("XDG_SESSION_TYPE"); session {
+	case "wayland", "x11":
+		return session
+	}
+	if os.Getenv("WAYLAND_DISPLAY") != "" {
+		return "wayland"
+	}
+	if os.Getenv("DISPLAY") != "" {
+		return "x11"
+	}
+	return ""
+}
+
+// checkDisplayServer reports the display server type
+func checkDisplayServer() DoctorResult {
+	server := DisplayServer()
+	if server == "" {
+		return DoctorResult{
+			Name:   "display server",
+			Status: DoctorWarn,
+			Detail: "neither WAYLAND_DISPLAY nor DISPLAY is set",
+			Fix:    "Run keygeist from your graphical session, or import its environment (systemctl --user import-environment DISPLAY WAYLAND_DISPLAY)",
+		}
+	}
+	return DoctorResult{
+		Name:   "display server",
+		Status: DoctorOK,
+		Detail: fmt.Sprintf("%s (XDG_SESSION_TYPE=%q WAYLAND_DISPLAY=%q DISPLAY=%q)", server, os.Getenv("XDG_SESSION_TYPE"), os.Getenv("WAYLAND_DISPLAY"), os.Getenv("DISPLAY")),
+	}
+}
+
+// checkHelpers checks the external tools used for dialogs, clipboard,
+// screenshots and window detection
+func checkHelpers() []DoctorResult {
+	wayland := DisplayServer() == "wayland"
+	clipboardTools := []string{"xclip", "xsel"}
+	clipboardPackage := "xclip"
+	if wayland {
+		clipboardTools = []string{"wl-paste"}
+		clipboardPackage = "wl-clipboard"
+	}
+
+	checks := []struct {
+		name     string
+		tools    []string
+		status   DoctorStatus
+		install  string
+		required string
+	}{
+		{"dialog helper", []string{"zenity"}, DoctorFail, "zenity", "needed to ask for your prompt"},
+		{"clipboard helper", clipboardTools, DoctorWarn, clipboardPackage, "needed for clipboard context"},
+		{"window helper", []string{"xdotool", "hyprctl", "swaymsg", "kdotool"}, DoctorWarn, "xdotool (X11) or your compositor's CLI", "needed for per-application snippet settings"},
+	}
+
+	results := make([]DoctorResult, 0, len(checks))
+	for _, check := range checks {
+		result := DoctorResult{Name: check.name}
+		var found []string
+		for _, tool := range check.tools {
+			if path, err := exec.LookPath(tool); err == nil {
+				found = append(found, path)
+			}
+		}
+		if len(found) > 0 {
+			result.Status = DoctorOK
+			result.Detail = strings.Join(found, ", ")
+		} else {
+			result.Status = check.status
+			result.Detail = fmt.Sprintf("none of %s found (%s)", strings.Join(check.tools, ", "), check.required)
+			result.Fix = fmt.Sprintf("Install %s with your package manager (e.g. sudo dnf install / sudo apt install)", check.install)
+		}
+		results = append(results, result)
+	}
+	return results
+}
+
+// checkScreenshot reports which of the screenshot backends for the session
+// and config are available
+func checkScreenshot(config DisplayConfig) DoctorResult {
+	result := DoctorResult{Name: "screenshot backend"}
+	backends, err := screenshotBackends(config)
+	if err != nil {
+		result.Status = DoctorWarn
+		result.Detail = err.Error()
+		return result
+	}
+	var available []string
+	for _, name := range backends {
+		switch name {
+		case ScreenshotPortal:
+			if portalAvailable() {
+				available = append(available, name)
+			}
+		case ScreenshotX11:
+			if os.Getenv("DISPLAY") != "" {
+				available = append(available, name)
+			}
+		default:
+			if _, err := exec.LookPath(name); err == nil {
+				available = append(available, name)
+			}
+		}
+	}
+	if len(available) > 0 {
+		result.Status = DoctorOK
+		result.Detail = strings.Join(available, ", ")
+		return result
+	}
+	result.Status = DoctorWarn
+	result.Detail = fmt.Sprintf("none of %s available (needed for screenshot context)", strings.Join(backends, ", "))
+	if DisplayServer() == "wayland" {
+		result.Fix = "Install xdg-desktop-portal with your desktop's backend (xdg-desktop-portal-gnome, -kde or -wlr), or grim on wlroots compositors"
+	} else {
+		result.Fix = "Install gnome-screenshot or scrot with your package manager"
+	}
+	return result
+}
+
+// checkConfiguration validates the key bindings and the configuration file
+func checkConfiguration() []DoctorResult {
+	keyConfig := LoadKeyBindingConfig()
+	result := DoctorResult{Name: "key bindings", Status: DoctorOK}
+	bindings := []struct{ env, value string }{
+		{"CLIPBOARD_KEY", keyConfig.ClipboardKey},
+		{"SCREENSHOT_KEY", keyConfig.ScreenshotKey},
+		{"ALL_CONTEXT_KEY", keyConfig.AllContextKey},
+		{"TEXT_ONLY_KEY", keyConfig.TextOnlyKey},
+	}
+	result.Detail = fmt.Sprintf("%d bindings valid", len(bindings))
+	for _, binding := range bindings {
+		if _, err := ParseKeyBinding(binding.env, binding.value); err != nil {
+			result.Status = DoctorFail
+			result.Detail = fmt.Sprintf("%s=%q: %v", binding.env, binding.value, err)
+			result.Fix = "Use the modifier+key[:trigger[:ms]] format, e.g. win+c or capslock:tap"
+			break
+		}
+	}
+
+	configResult := DoctorResult{Name: "config file", Status: DoctorOK}
+	path := ConfigPath()
+	config, err := LoadConfig()
+	switch {
+	case err != nil:
+		configResult.Status = DoctorFail
+		configResult.Detail = err.Error()
+		configResult.Fix = "Fix the JSON in " + path + " or point KEYGEIST_CONFIG to a valid file"
+	case path == "":
+		configResult.Detail = "no configuration directory, using defaults"
+	default:
+		if _, statErr := os.Stat(path); statErr != nil {
+			configResult.Detail = fmt.Sprintf("%s not present, using defaults", path)
+		} else {
+			configResult.Detail = fmt.Sprintf("%s is valid (%d snippets)", path, len(config.Snippets.Library))
+		}
+	}
+	return []DoctorResult{result, configResult}
+}
+
+// checkLLM sends a minimal request to the configured endpoint
+func checkLLM(ctx context.Context, opts DoctorOptions) DoctorResult {
+	result := DoctorResult{Name: "LLM endpoint"}
+	if opts.APIKey == "" || opts.Model == "" {
+		result.Status = DoctorFail
+		result.Detail = "OPENAI_API_KEY and OPENAI_MODEL must be set"
+		result.Fix = "export OPENAI_API_KEY=... OPENAI_MODEL=... (and OPENAI_BASE_URL for local servers)"
+		return result
+	}
+
+	config := openai.DefaultConfig(opts.APIKey)
+	if opts.BaseURL != "" {
+		config.BaseURL = opts.BaseURL
+	}
+	client := openai.NewClientWithConfig(config)
+
+	timeout := opts.Timeout
+	if timeout <= 0 {
+		timeout = 30 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	start := time.Now()
+	resp, err := client.CreateChatCompletion(ctx, openai.ChatCompletionRequest{
+		Model: opts.Model,
+		Messages: []openai.ChatCompletionMessage{
+			{Role: openai.ChatMessageRoleUser, Content: "Reply with OK."},
+		},
+	})
+	if err != nil {
+		result.Status = DoctorFail
+		result.Detail = fmt.Sprintf("request to %s failed: %v", config.BaseURL, err)
+		result.Fix = "Check OPENAI_BASE_URL, OPENAI_API_KEY and that OPENAI_MODEL is served by the endpoint"
+		return result
+	}
+	if len(resp.Choices) == 0 {
+		result.Status = DoctorFail
+		result.Detail = fmt.Sprintf("%s returned no choices for model %s", config.BaseURL, opts.Model)
+		return result
+	}
+	result.Status = DoctorOK
+	result.Detail = fmt.Sprintf("%s answered with model %s in %s", config.BaseURL, opts.Model, time.Since(start).Round(time.Millisecond))
+	return result
+}
+
+// containsInt checks if a slice contains a value
+func containsInt(values []int, value int) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// containsString checks if a slice contains a value
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
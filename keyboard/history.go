@@ -0,0 +1,108 @@
+package keyboard
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// HistoryEntry is one interaction recorded in the history file
+type HistoryEntry struct {
+	Time      time.Time `json:"time"`
+	Binding   string    `json:"binding"`
+	Profile   string    `json:"profile"`
+	Model     string    `json:"model"`
+	Prompt    string    `json:"prompt"`
+	Response  string    `json:"response,omitempty"`
+	Error     string    `json:"error,omitempty"`
+	LatencyMS int64     `json:"latency_ms"`
+}
+
+var historyMutex sync.Mutex
+
+// HistoryPath returns the history file location: the configured path, or
+// keygeist/history.jsonl in $XDG_STATE_HOME (default ~/.local/state)
+func HistoryPath(config HistoryConfig) string {
+	if config.Path != "" {
+		return config.Path
+	}
+	dir := os.Getenv("XDG_STATE_HOME")
+	if dir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return ""
+		}
+		dir = filepath.Join(home, ".local", "state")
+	}
+	return filepath.Join(dir, "keygeist", "history.jsonl")
+}
+
+// AppendHistory appends an entry to the history file as a JSON line
+func AppendHistory(path string, entry HistoryEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	historyMutex.Lock()
+	defer historyMutex.Unlock()
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("failed to create history directory: %v", err)
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open history %s: %v", path, err)
+	}
+	defer file.Close()
+	if _, err := file.Write(append(data, '\n')); err != nil {
+		return fmt.Errorf("failed to write history %s: %v", path, err)
+	}
+	return nil
+}
+
+// HistoryEnabled reports whether interactions are recorded
+func (ko *KeyboardOperator) HistoryEnabled() bool {
+	return ko.fileConfig.History.Enabled
+}
+
+// OpenHistory opens the history file with the desktop's default application
+func (ko *KeyboardOperator) OpenHistory() error {
+	if !ko.HistoryEnabled() {
+		return fmt.Errorf("history is disabled in the configuration")
+	}
+	path := HistoryPath(ko.fileConfig.History)
+	if _, err := os.Stat(path); err != nil {
+		return fmt.Errorf("no history yet: %v", err)
+	}
+	cmd, err := helperCommand(context.Background(), "xdg-open", path)
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to open history: %v", err)
+	}
+	go cmd.Wait()
+	return nil
+}
+
+// recordHistory appends an interaction to the history file when enabled
+func (ko *KeyboardOperator) recordHistory(log *slog.Logger, entry HistoryEntry, start time.Time) {
+	if !ko.HistoryEnabled() {
+		return
+	}
+	entry.Time = start
+	entry.LatencyMS = time.Since(start).Milliseconds()
+	path := HistoryPath(ko.fileConfig.History)
+	if path == "" {
+		log.Warn("cannot determine the history location")
+		return
+	}
+	if err := AppendHistory(path, entry); err != nil {
+		log.Warn("failed to record history", "error", err)
+	}
+}
@@ -0,0 +1,143 @@
+package keyboard
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// ReviewAction is the choice made in the review dialog
+type ReviewAction string
+
+const (
+	ReviewSend       ReviewAction = "send"
+	ReviewCopy       ReviewAction = "copy"
+	ReviewRegenerate ReviewAction = "regenerate"
+	ReviewCancel     ReviewAction = "cancel"
+)
+
+// InputBackend shows the dialogs of an interaction
+type InputBackend interface {
+	// Prompt asks for the user's request; an empty string means the dialog
+	// was dismissed
+	Prompt(ctx context.Context) (string, error)
+	// Review shows an editable response and returns the chosen action and
+	// the text: edited for ReviewSend, the original one for ReviewCopy.
+	// sendLabel names the action delivering the response.
+	Review(ctx context.Context, text, sendLabel string) (ReviewAction, string, error)
+	// Confirm asks a yes or no question
+	Confirm(ctx context.Context, question string) (bool, error)
+	// Choose shows rows with the given columns and returns the indexes of
+	// the rows checked; none when the dialog was dismissed
+	Choose(ctx context.Context, text string, columns []string, rows [][]string) ([]int, error)
+}
+
+// ZenityBackend implements InputBackend with zenity dialogs
+type ZenityBackend struct{}
+
+// Prompt shows a zenity entry dialog
+func (ZenityBackend) Prompt(ctx context.Context) (string, error) {
+	cmd, err := helperCommand(ctx, "zenity", "--entry", "--title=Zeygeist", "--text=What would you like me to help you with?", "--width=400", "--height=100")
+	if err != nil {
+		return "", err
+	}
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() == 1 {
+			return "", nil
+		}
+		return "", fmt.Errorf("zenity error: %v", err)
+	}
+	return strings.TrimSpace(string(output)), nil
+}
+
+// Review shows the response in an editable zenity text window with send,
+// Copy original, Regenerate and Cancel buttons. zenity prints only the label
+// of extra buttons, so the edits are kept by the send button alone.
+func (ZenityBackend) Review(ctx context.Context, text, sendLabel string) (ReviewAction, string, error) {
+	cmd, err := helperCommand(ctx, "zenity", "--text-info", "--editable",
+		"--title=Keygeist: review the response",
+		"--ok-label="+sendLabel, "--cancel-label=Cancel",
+		"--extra-button=Copy original", "--extra-button=Regenerate",
+		"--width=600", "--height=400")
+	if err != nil {
+		return ReviewCancel, "", err
+	}
+	cmd.Stdin = strings.NewReader(text)
+	output, err := cmd.Output()
+	edited := strings.TrimSuffix(string(output), "\n")
+	if err == nil {
+		return ReviewSend, edited, nil
+	}
+	exitErr, ok := err.(*exec.ExitError)
+	if !ok || exitErr.ExitCode() != 1 {
+		return ReviewCancel, "", fmt.Errorf("zenity error: %v", err)
+	}
+
+	// Extra buttons exit with 1 and print their label, after the text on
+	// some zenity versions
+	for label, action := range map[string]ReviewAction{"Copy original": ReviewCopy, "Regenerate": ReviewRegenerate} {
+		if edited == label || strings.HasSuffix(edited, "\n"+label) {
+			return action, text, nil
+		}
+	}
+	return ReviewCancel, "", nil
+}
+
+// Confirm shows a zenity question dialog with Allow and Deny buttons
+func (ZenityBackend) Confirm(ctx context.Context, question string) (bool, error) {
+	cmd, err := helperCommand(ctx, "zenity", "--question", "--no-markup",
+		"--title=Keygeist", "--text="+question,
+		"--ok-label=Allow", "--cancel-label=Deny", "--width=400")
+	if err != nil {
+		return false, err
+	}
+	if err := cmd.Run(); err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() == 1 {
+			return false, nil
+		}
+		return false, fmt.Errorf("zenity error: %v", err)
+	}
+	return true, nil
+}
+
+// Choose shows a zenity checklist, with a hidden column holding the row
+// indexes that are printed for the checked rows
+func (ZenityBackend) Choose(ctx context.Context, text string, columns []string, rows [][]string) ([]int, error) {
+	args := []string{"--list", "--checklist", "--no-markup",
+		"--title=Keygeist", "--text=" + text,
+		"--column=", "--column=index", "--hide-column=2", "--print-column=2",
+		"--separator=\n", "--width=700", "--height=400"}
+	for _, column := range columns {
+		args = append(args, "--column="+column)
+	}
+	for i, row := range rows {
+		args = append(args, "FALSE", strconv.Itoa(i))
+		args = append(args, row...)
+	}
+	cmd, err := helperCommand(ctx, "zenity", args...)
+	if err != nil {
+		return nil, err
+	}
+	output, err := cmd.Output()
+	if err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() == 1 {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("zenity error: %v", err)
+	}
+	var chosen []int
+	for _, line := range strings.Fields(string(output)) {
+		if i, err := strconv.Atoi(line); err == nil {
+			chosen = append(chosen, i)
+		}
+	}
+	return chosen, nil
+}
+
+// SetInputBackend replaces the dialogs used by interactions
+func (ko *KeyboardOperator) SetInputBackend(input InputBackend) {
+	ko.input = input
+}
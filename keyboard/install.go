@@ -0,0 +1,390 @@
+package keyboard
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"text/template"
+)
+
+// installMarker is written at the top of every generated file so that
+// uninstall only removes files the installer created
+const installMarker = "# Installed by keygeist"
+
+// modulesLoadPath makes sure the uinput module is loaded at boot
+const modulesLoadPath = "/etc/modules-load.d/uinput.conf"
+
+// systemdUnitTemplate is the systemd user unit running the operator
+var systemdUnitTemplate = template.Must(template.New("unit").Parse(`# Installed by keygeist
+[Unit]
+Description=Keygeist Service
+After=graphical-session.target
+Wants=graphical-session.target
+
+Requires=keygeist.socket
+
+[Service]
+Type=notify
+NotifyAccess=main
+ExecStart={{.BinaryPath}}
+Restart=always
+RestartSec=5
+WatchdogSec=30
+EnvironmentFile=-{{.EnvFile}}
+
+[Install]
+WantedBy=default.target
+Also=keygeist.socket
+`))
+
+// systemdSocketTemplate is the control socket, passed to the service by
+// socket activation so it exists before the service is ready
+var systemdSocketTemplate = template.Must(template.New("socket").Parse(`# Installed by keygeist
+[Unit]
+Description=Keygeist control socket
+
+[Socket]
+ListenStream=%t/keygeist.sock
+SocketMode=0600
+
+[Install]
+WantedBy=sockets.target
+`))
+
+// envFileTemplate is the initial environment file; it is never overwritten
+var envFileTemplate = template.Must(template.New("env").Parse(`# Installed by keygeist
+# Environment for the keygeist user service
+OPENAI_API_KEY=your_api_key_here
+OPENAI_MODEL=gpt-4o-mini
+#OPENAI_BASE_URL=https://api.openai.com/v1
+#OPENAI_SYSTEM_PROMPT=You are a coding assistant. Provide concise, practical code solutions.
+#CLIPBOARD_KEY=win+c
+#SCREENSHOT_KEY=win+s
+#ALL_CONTEXT_KEY=win+e
+#TEXT_ONLY_KEY=win+t
+`))
+
+// InstallOptions configures the install and uninstall subcommands
+type InstallOptions struct {
+	// BinaryPath is the keygeist executable started by the service
+	BinaryPath string
+	// EnvFile holds the API key and other settings for the service
+	EnvFile     string
+	UinputGroup string
+	InputGroup  string
+	// Udev and Systemd select which parts to (un)install
+	Udev    bool
+	Systemd bool
+	// DryRun shows what would change without writing anything
+	DryRun bool
+	// Out receives diffs and progress messages
+	Out io.Writer
+	// Confirm is asked before applying changes; nil applies them directly
+	Confirm func(prompt string) bool
+}
+
+// installFile is a file managed by the installer
+type installFile struct {
+	path    string
+	content string
+	mode    os.FileMode
+	// system files live outside the user's home and need root
+	system bool
+	// keep files are created once and then left to the user
+	keep bool
+}
+
+// installUser returns the user whose home receives the systemd unit: the
+// sudo caller when running as root, the current user otherwise
+func installUser() (*PrivilegeTarget, string, error) {
+	target, err := ResolvePrivilegeTarget()
+	if err != nil {
+		return nil, "", err
+	}
+	if target != nil {
+		return target, target.Home, nil
+	}
+	home, err := os.UserHomeDir()
+	return nil, home, err
+}
+
+// DefaultInstallOptions returns options for the running executable and the
+// default groups and paths
+func DefaultInstallOptions() (InstallOptions, error) {
+	binary, err := os.Executable()
+	if err != nil {
+		return InstallOptions{}, fmt.Errorf("failed to determine executable path: %v", err)
+	}
+	if resolved, err := filepath.EvalSymlinks(binary); err == nil {
+		binary = resolved
+	}
+	_, home, err := installUser()
+	if err != nil {
+		return InstallOptions{}, err
+	}
+	return InstallOptions{
+		BinaryPath:  binary,
+		EnvFile:     filepath.Join(home, ".config", "keygeist", "keygeist.env"),
+		UinputGroup: "uinput",
+		InputGroup:  "input",
+		Udev:        true,
+		Systemd:     true,
+		Out:         os.Stdout,
+	}, nil
+}
+
+// planInstall renders all files for the selected parts
+func planInstall(opts InstallOptions) ([]installFile, error) {
+	var files []installFile
+	if opts.Udev {
+		files = append(files,
+			installFile{path: UdevRulesPath, content: RenderUdevRules(opts.UinputGroup, opts.InputGroup), mode: 0644, system: true},
+			installFile{path: modulesLoadPath, content: installMarker + "\nuinput\n", mode: 0644, system: true},
+		)
+	}
+	if opts.Systemd {
+		_, home, err := installUser()
+		if err != nil {
+			return nil, err
+		}
+		data := struct{ BinaryPath, EnvFile string }{opts.BinaryPath, opts.EnvFile}
+		var unit, socket, env bytes.Buffer
+		if err := systemdUnitTemplate.Execute(&unit, data); err != nil {
+			return nil, err
+		}
+		if err := systemdSocketTemplate.Execute(&socket, data); err != nil {
+			return nil, err
+		}
+		if err := envFileTemplate.Execute(&env, data); err != nil {
+			return nil, err
+		}
+		files = append(files,
+			installFile{path: filepath.Join(home, ".config", "systemd", "user", "keygeist.service"), content: unit.String(), mode: 0644},
+			installFile{path: filepath.Join(home, ".config", "systemd", "user", "keygeist.socket"), content: socket.String(), mode: 0644},
+			installFile{path: opts.EnvFile, content: env.String(), mode: 0600, keep: true},
+		)
+	}
+	return files, nil
+}
+
+// Install writes the udev rules and systemd user unit, showing a diff for
+// every file that changes and reloading udev and systemd only when needed
+func Install(opts InstallOptions) error {
+	files, err := planInstall(opts)
+	if err != nil {
+		return err
+	}
+
+	var changed []installFile
+	for _, file := range files {
+		current, err := os.ReadFile(file.path)
+		switch {
+		case err == nil && file.keep:
+			fmt.Fprintf(opts.Out, "%s exists, keeping it\n", file.path)
+			continue
+		case err == nil && string(current) == file.content:
+			fmt.Fprintf(opts.Out, "%s is up to date\n", file.path)
+			continue
+		case err != nil && !os.IsNotExist(err):
+			return fmt.Errorf("failed to read %s: %v", file.path, err)
+		}
+		fmt.Fprint(opts.Out, unifiedDiff(file.path, string(current), file.content))
+		changed = append(changed, file)
+	}
+
+	if len(changed) == 0 {
+		fmt.Fprintln(opts.Out, "Nothing to do")
+		return nil
+	}
+	if opts.DryRun {
+		fmt.Fprintf(opts.Out, "Dry run: %d file(s) would be written\n", len(changed))
+		return nil
+	}
+	for _, file := range changed {
+		if file.system && os.Geteuid() != 0 {
+			return fmt.Errorf("writing %s requires root; rerun with sudo, or use --no-udev", file.path)
+		}
+	}
+	if opts.Confirm != nil && !opts.Confirm(fmt.Sprintf("Write %d file(s)?", len(changed))) {
+		return fmt.Errorf("aborted")
+	}
+
+	owner, _, err := installUser()
+	if err != nil {
+		return err
+	}
+	udevChanged, systemdChanged := false, false
+	for _, file := range changed {
+		if err := writeInstallFile(file, owner); err != nil {
+			return err
+		}
+		fmt.Fprintf(opts.Out, "Wrote %s\n", file.path)
+		if file.system {
+			udevChanged = true
+		} else {
+			systemdChanged = true
+		}
+	}
+
+	if udevChanged {
+		if err := reloadUdev(opts.Out); err != nil {
+			return err
+		}
+		fmt.Fprintf(opts.Out, "Make sure your user is in the %s and %s groups: sudo usermod -a -G %s,%s $USER (then log out and back in)\n",
+			opts.UinputGroup, opts.InputGroup, opts.UinputGroup, opts.InputGroup)
+	}
+	if systemdChanged {
+		if err := reloadSystemd(opts.Out, owner); err != nil {
+			return err
+		}
+		fmt.Fprintf(opts.Out, "Edit %s, then enable the service: systemctl --user enable --now keygeist.service\n", opts.EnvFile)
+	}
+	return nil
+}
+
+// Uninstall removes the files written by Install, leaving the environment
+// file (which holds the API key) and anything not created by the installer
+func Uninstall(opts InstallOptions) error {
+	files, err := planInstall(opts)
+	if err != nil {
+		return err
+	}
+
+	var remove []installFile
+	for _, file := range files {
+		if file.keep {
+			continue
+		}
+		current, err := os.ReadFile(file.path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %v", file.path, err)
+		}
+		if !strings.HasPrefix(string(current), installMarker) {
+			fmt.Fprintf(opts.Out, "Leaving %s alone: not created by keygeist\n", file.path)
+			continue
+		}
+		fmt.Fprint(opts.Out, unifiedDiff(file.path, string(current), ""))
+		remove = append(remove, file)
+	}
+
+	if len(remove) == 0 {
+		fmt.Fprintln(opts.Out, "Nothing to do")
+		return nil
+	}
+	if opts.DryRun {
+		fmt.Fprintf(opts.Out, "Dry run: %d file(s) would be removed\n", len(remove))
+		return nil
+	}
+	for _, file := range remove {
+		if file.system && os.Geteuid() != 0 {
+			return fmt.Errorf("removing %s requires root; rerun with sudo, or use --no-udev", file.path)
+		}
+	}
+	if opts.Confirm != nil && !opts.Confirm(fmt.Sprintf("Remove %d file(s)?", len(remove))) {
+		return fmt.Errorf("aborted")
+	}
+
+	owner, _, err := installUser()
+	if err != nil {
+		return err
+	}
+	udevChanged, systemdChanged := false, false
+	for _, file := range remove {
+		if !file.system {
+			// Stop the service before its unit disappears
+			_ = systemctlUser(owner, "disable", "--now", filepath.Base(file.path)).Run()
+		}
+		if err := os.Remove(file.path); err != nil {
+			return fmt.Errorf("failed to remove %s: %v", file.path, err)
+		}
+		fmt.Fprintf(opts.Out, "Removed %s\n", file.path)
+		if file.system {
+			udevChanged = true
+		} else {
+			systemdChanged = true
+		}
+	}
+
+	if udevChanged {
+		if err := reloadUdev(opts.Out); err != nil {
+			return err
+		}
+	}
+	if systemdChanged {
+		return reloadSystemd(opts.Out, owner)
+	}
+	return nil
+}
+
+// writeInstallFile writes a file, creating its directory, and hands files in
+// the user's home over to that user when running under sudo
+func writeInstallFile(file installFile, owner *PrivilegeTarget) error {
+	dir := filepath.Dir(file.path)
+	var created []string
+	for parent := dir; parent != "/" && parent != "."; parent = filepath.Dir(parent) {
+		if _, err := os.Stat(parent); err == nil {
+			break
+		}
+		created = append(created, parent)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create %s: %v", dir, err)
+	}
+	if err := os.WriteFile(file.path, []byte(file.content), file.mode); err != nil {
+		return fmt.Errorf("failed to write %s: %v", file.path, err)
+	}
+	if err := os.Chmod(file.path, file.mode); err != nil {
+		return fmt.Errorf("failed to set mode of %s: %v", file.path, err)
+	}
+	if !file.system && owner != nil {
+		for _, path := range append(created, file.path) {
+			if err := os.Chown(path, owner.UID, owner.GID); err != nil {
+				return fmt.Errorf("failed to hand %s over to %s: %v", path, owner.Username, err)
+			}
+		}
+	}
+	return nil
+}
+
+// reloadUdev reloads the udev rules and re-applies them to existing devices
+func reloadUdev(out io.Writer) error {
+	if _, err := exec.LookPath("modprobe"); err == nil {
+		_ = exec.Command("modprobe", "uinput").Run()
+	}
+	for _, args := range [][]string{
+		{"control", "--reload-rules"},
+		{"trigger", "--subsystem-match=misc", "--subsystem-match=input"},
+	} {
+		if output, err := exec.Command("udevadm", args...).CombinedOutput(); err != nil {
+			return fmt.Errorf("udevadm %s failed: %v: %s", strings.Join(args, " "), err, output)
+		}
+	}
+	fmt.Fprintln(out, "Reloaded udev rules")
+	return nil
+}
+
+// reloadSystemd reloads the user's systemd manager
+func reloadSystemd(out io.Writer, owner *PrivilegeTarget) error {
+	if output, err := systemctlUser(owner, "daemon-reload").CombinedOutput(); err != nil {
+		return fmt.Errorf("systemctl --user daemon-reload failed: %v: %s", err, output)
+	}
+	fmt.Fprintln(out, "Reloaded systemd user manager")
+	return nil
+}
+
+// systemctlUser builds a systemctl --user command, addressing the sudo
+// caller's manager when running as root
+func systemctlUser(owner *PrivilegeTarget, args ...string) *exec.Cmd {
+	base := []string{"--user"}
+	if owner != nil {
+		base = append(base, "--machine="+owner.Username+"@")
+	}
+	return exec.Command("systemctl", append(base, args...)...)
+}
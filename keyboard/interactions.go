@@ -0,0 +1,258 @@
+package keyboard
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Actions for a binding pressed while it already has a job
+const (
+	OnBusyCancel = "cancel"
+	OnBusyQueue  = "queue"
+	OnBusyIgnore = "ignore"
+)
+
+// JobInfo describes a pending or active interaction
+type JobInfo struct {
+	ID      string           `json:"id"`
+	Binding string           `json:"binding"`
+	State   InteractionState `json:"state"`
+	Created time.Time        `json:"created"`
+	Since   time.Time        `json:"since"`
+}
+
+// interactionJob is an interaction tracked by the manager
+type interactionJob struct {
+	info   JobInfo
+	ctx    context.Context
+	cancel context.CancelFunc
+	// released is closed when a hold binding is released, nil otherwise
+	released chan struct{}
+}
+
+// interactionManager tracks the jobs and the resources they take turns on:
+// one prompt at a time, a bounded number of model queries, and one job
+// typing at a time so that outputs never interleave
+type interactionManager struct {
+	mu        sync.Mutex
+	jobs      []*interactionJob
+	lastError *InteractionStatus
+
+	foreground chan struct{}
+	queries    chan struct{}
+	typing     chan struct{}
+}
+
+func newInteractionManager(maxQueries int) *interactionManager {
+	if maxQueries < 1 {
+		maxQueries = 1
+	}
+	return &interactionManager{
+		foreground: make(chan struct{}, 1),
+		queries:    make(chan struct{}, maxQueries),
+		typing:     make(chan struct{}, 1),
+	}
+}
+
+// add registers a new job for binding
+func (im *interactionManager) add(binding string) *interactionJob {
+	ctx, cancel := context.WithCancel(context.Background())
+	now := time.Now()
+	job := &interactionJob{
+		info:   JobInfo{ID: newInteractionID(), Binding: binding, State: StateQueued, Created: now, Since: now},
+		ctx:    ctx,
+		cancel: cancel,
+	}
+	im.mu.Lock()
+	defer im.mu.Unlock()
+	im.jobs = append(im.jobs, job)
+	im.lastError = nil
+	return job
+}
+
+// remove forgets a finished job; failure is the error status it ended with, if any
+func (im *interactionManager) remove(job *interactionJob, failure *InteractionStatus) {
+	job.cancel()
+	im.mu.Lock()
+	defer im.mu.Unlock()
+	for i, j := range im.jobs {
+		if j == job {
+			im.jobs = append(im.jobs[:i], im.jobs[i+1:]...)
+			break
+		}
+	}
+	if failure != nil {
+		im.lastError = failure
+	}
+}
+
+// setState records the phase a job is in
+func (im *interactionManager) setState(job *interactionJob, state InteractionState) {
+	im.mu.Lock()
+	defer im.mu.Unlock()
+	job.info.State = state
+	job.info.Since = time.Now()
+}
+
+// list returns the jobs in creation order
+func (im *interactionManager) list() []JobInfo {
+	im.mu.Lock()
+	defer im.mu.Unlock()
+	jobs := make([]JobInfo, len(im.jobs))
+	for i, job := range im.jobs {
+		jobs[i] = job.info
+	}
+	return jobs
+}
+
+// cancel cancels the jobs matching a job ID or binding name, or all jobs
+// when target is empty, and returns how many were cancelled
+func (im *interactionManager) cancel(target string) int {
+	im.mu.Lock()
+	defer im.mu.Unlock()
+	count := 0
+	for _, job := range im.jobs {
+		if target == "" || job.info.ID == target || job.info.Binding == target {
+			job.cancel()
+			count++
+		}
+	}
+	return count
+}
+
+// busy reports whether binding has a pending or active job
+func (im *interactionManager) busy(binding string) bool {
+	im.mu.Lock()
+	defer im.mu.Unlock()
+	for _, job := range im.jobs {
+		if job.info.Binding == binding {
+			return true
+		}
+	}
+	return false
+}
+
+// stateRank orders the phases to pick the one summarizing several jobs
+var stateRank = map[InteractionState]int{
+	StateQueued:       1,
+	StateCapturing:    2,
+	StatePrompting:    3,
+	StateRecording:    3,
+	StateTranscribing: 3,
+	StateWaiting:      4,
+	StateConfirming:   5,
+	StateDelivering:   6,
+	StateTyping:       7,
+}
+
+// status summarizes the jobs: the most advanced one, the last error, or idle
+func (im *interactionManager) status() InteractionStatus {
+	im.mu.Lock()
+	defer im.mu.Unlock()
+	if len(im.jobs) == 0 {
+		if im.lastError != nil {
+			return *im.lastError
+		}
+		return InteractionStatus{State: StateIdle, Since: time.Now()}
+	}
+	jobs := append([]*interactionJob{}, im.jobs...)
+	sort.SliceStable(jobs, func(i, j int) bool {
+		return stateRank[jobs[i].info.State] > stateRank[jobs[j].info.State]
+	})
+	top := jobs[0].info
+	return InteractionStatus{State: top.State, Binding: top.Binding, Since: top.Since, Jobs: len(im.jobs)}
+}
+
+// acquire waits for a slot of a resource unless ctx is cancelled first
+func acquire(ctx context.Context, slots chan struct{}) error {
+	select {
+	case slots <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// release frees a slot taken with acquire
+func release(slots chan struct{}) {
+	<-slots
+}
+
+// Jobs returns the pending and active interactions
+func (ko *KeyboardOperator) Jobs() []JobInfo {
+	return ko.interactions.list()
+}
+
+// Interacting reports whether an interaction is pending or in progress
+func (ko *KeyboardOperator) Interacting() bool {
+	return len(ko.interactions.list()) > 0
+}
+
+// CancelInteractions cancels the jobs matching a job ID or binding name, or
+// all of them when target is empty
+func (ko *KeyboardOperator) CancelInteractions(target string) int {
+	count := ko.interactions.cancel(target)
+	if count > 0 {
+		ko.logger.Info("cancelling interactions", "target", target, "count", count)
+	}
+	return count
+}
+
+// StopCurrentInteraction cancels every pending and active interaction
+func (ko *KeyboardOperator) StopCurrentInteraction() {
+	ko.CancelInteractions("")
+}
+
+// setJobState moves a job to a new phase and publishes the summary status
+func (ko *KeyboardOperator) setJobState(job *interactionJob, state InteractionState) {
+	ko.interactions.setState(job, state)
+	ko.refreshStatus()
+}
+
+// finishJob removes a job, remembering err as the last failure
+func (ko *KeyboardOperator) finishJob(job *interactionJob, err error) {
+	var failure *InteractionStatus
+	if err != nil {
+		failure = &InteractionStatus{State: StateError, Binding: job.info.Binding, Since: time.Now(), Error: err.Error()}
+	}
+	ko.interactions.remove(job, failure)
+	ko.refreshStatus()
+}
+
+// waitTurn moves a job to the queued state until it gets a slot. On error
+// the job was cancelled and holds no slot.
+func (ko *KeyboardOperator) waitTurn(job *interactionJob, slots chan struct{}) error {
+	select {
+	case slots <- struct{}{}:
+	default:
+		ko.setJobState(job, StateQueued)
+		if err := acquire(job.ctx, slots); err != nil {
+			return err
+		}
+	}
+	if err := job.ctx.Err(); err != nil {
+		release(slots)
+		return err
+	}
+	return nil
+}
+
+// registerJobCommands adds jobs and an extended cancel to a control server
+func (ko *KeyboardOperator) registerJobCommands(cs *ControlServer) {
+	cs.Handle("jobs", func(args []string) (interface{}, error) {
+		return ko.Jobs(), nil
+	})
+	cs.Handle("cancel", func(args []string) (interface{}, error) {
+		if len(args) > 1 {
+			return nil, fmt.Errorf("usage: cancel [job-id|binding]")
+		}
+		target := ""
+		if len(args) == 1 {
+			target = args[0]
+		}
+		return map[string]int{"cancelled": ko.CancelInteractions(target)}, nil
+	})
+}
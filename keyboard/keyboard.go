@@ -2,13 +2,16 @@ package keyboard
 
 import (
 	"fmt"
+	"log/slog"
 	"time"
+	"unicode/utf8"
 
 	"github.com/bendahl/uinput"
 )
 
 type KeyboardEmulator struct {
 	keyboard uinput.Keyboard
+	logger   *slog.Logger
 }
 
 func NewKeyboardEmulator() (*KeyboardEmulator, error) {
@@ -19,11 +22,19 @@ func NewKeyboardEmulator() (*KeyboardEmulator, error) {
 
 	return &KeyboardEmulator{
 		keyboard: keyboard,
+		logger:   slog.Default(),
 	}, nil
 }
 
+// SetLogger sets the logger used by the emulator
+func (ke *KeyboardEmulator) SetLogger(logger *slog.Logger) {
+	ke.logger = logger
+}
+
 func (ke *KeyboardEmulator) Close() {
-	ke.keyboard.Close()
+	if err := ke.keyboard.Close(); err != nil {
+		ke.logger.Warn("failed to close virtual keyboard", "error", err)
+	}
 }
 
 func (ke *KeyboardEmulator) PressKey(keyCode int) error {
@@ -44,27 +55,39 @@ func (ke *KeyboardEmulator) TapKey(keyCode int) error {
 }
 
 func (ke *KeyboardEmulator) TypeText(text string) error {
+	start := time.Now()
+	// The text may hold secrets, so only counts are logged
+	skipped := 0
+	defer func() {
+		if skipped > 0 {
+			ke.logger.Debug("skipped characters without key mapping", "count", skipped)
+		}
+		ke.logger.Debug("typed text", "chars", utf8.RuneCountInString(text), "latency", time.Since(start))
+	}()
+
 	for _, char := range text {
 		keyCode, shift := charToKeyCode(char)
-		if keyCode != 0 {
-			if shift {
-				if err := ke.PressKey(int(uinput.KeyLeftshift)); err != nil {
-					return err
-				}
-			}
-			if err := ke.TapKey(keyCode); err != nil {
-				if shift {
-					_ = ke.ReleaseKey(int(uinput.KeyLeftshift))
-				}
+		if keyCode == 0 {
+			skipped++
+			continue
+		}
+		if shift {
+			if err := ke.PressKey(int(uinput.KeyLeftshift)); err != nil {
 				return err
 			}
+		}
+		if err := ke.TapKey(keyCode); err != nil {
 			if shift {
-				if err := ke.ReleaseKey(int(uinput.KeyLeftshift)); err != nil {
-					return err
-				}
+				_ = ke.ReleaseKey(int(uinput.KeyLeftshift))
+			}
+			return err
+		}
+		if shift {
+			if err := ke.ReleaseKey(int(uinput.KeyLeftshift)); err != nil {
+				return err
 			}
-			//time.Sleep(10 * time.Millisecond)
 		}
+		//time.Sleep(10 * time.Millisecond)
 	}
 	return nil
 }
@@ -296,3 +319,29 @@ func charToKeyCode(char rune) (keyCode int, shift bool) {
 	}
 	return 0, false
 }
+
+// shiftedKey identifies a key code together with the shift state
+type shiftedKey struct {
+	code  uint16
+	shift bool
+}
+
+// keyCodeChars is the reverse mapping of charToKeyCode for printable ASCII
+var keyCodeChars = buildKeyCodeChars()
+
+// buildKeyCodeChars builds the reverse mapping of charToKeyCode
+func buildKeyCodeChars() map[shiftedKey]rune {
+	chars := make(map[shiftedKey]rune)
+	for char := rune(' '); char <= '~'; char++ {
+		if keyCode, shift := charToKeyCode(char); keyCode != 0 {
+			chars[shiftedKey{code: uint16(keyCode), shift: shift}] = char
+		}
+	}
+	return chars
+}
+
+// keyCodeToChar returns the printable character a key types on a US layout
+func keyCodeToChar(code uint16, shift bool) (rune, bool) {
+	char, ok := keyCodeChars[shiftedKey{code: code, shift: shift}]
+	return char, ok
+}
@@ -0,0 +1,490 @@
+package keyboard
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	openai "github.com/sashabaranov/go-openai"
+)
+
+// Knowledge defaults used when the configuration doesn't set them
+const (
+	DefaultEmbeddingModel       = "text-embedding-3-small"
+	DefaultKnowledgeChunkSize   = 1500
+	DefaultKnowledgeOverlap     = 200
+	DefaultKnowledgeTopK        = 5
+	DefaultKnowledgeMaxFileSize = 1 << 20
+	DefaultKnowledgeInterval    = 5 * time.Minute
+)
+
+// embeddingBatchSize bounds the chunks sent in one /embeddings request
+const embeddingBatchSize = 64
+
+// defaultKnowledgeExtensions are the file types indexed by default
+var defaultKnowledgeExtensions = []string{
+	".md", ".markdown", ".txt", ".org", ".rst", ".adoc",
+	".go", ".py", ".js", ".ts", ".tsx", ".jsx", ".rs", ".java", ".kt", ".c", ".h", ".cpp", ".hpp",
+	".rb", ".php", ".sh", ".lua", ".sql", ".yaml", ".yml", ".toml",
+}
+
+// defaultKnowledgeExclude are the directory names skipped by default
+var defaultKnowledgeExclude = []string{".git", ".hg", ".svn", "node_modules", "vendor", "target", "dist", "build", "__pycache__", ".venv"}
+
+// KnowledgePath returns the index file, by default under $XDG_CACHE_HOME
+// (or ~/.cache) as keygeist/knowledge.gob
+func KnowledgePath(config KnowledgeConfig) string {
+	if config.IndexPath != "" {
+		return config.IndexPath
+	}
+	dir := os.Getenv("XDG_CACHE_HOME")
+	if dir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return ""
+		}
+		dir = filepath.Join(home, ".cache")
+	}
+	return filepath.Join(dir, "keygeist", "knowledge.gob")
+}
+
+// knowledgeChunk is an indexed piece of a file
+type knowledgeChunk struct {
+	StartLine int
+	EndLine   int
+	Text      string
+	// Embedding is normalized, so that a dot product is the cosine similarity
+	Embedding []float32
+}
+
+// knowledgeFile is an indexed file
+type knowledgeFile struct {
+	ModTime time.Time
+	Size    int64
+	Hash    string
+	Chunks  []knowledgeChunk
+}
+
+// knowledgeStore is the on-disk index
+type knowledgeStore struct {
+	Model string
+	Files map[string]*knowledgeFile
+}
+
+// KnowledgeHit is a chunk retrieved for a prompt
+type KnowledgeHit struct {
+	Path      string
+	StartLine int
+	EndLine   int
+	Text      string
+	Score     float32
+}
+
+// KnowledgeIndex indexes directories into embedded chunks and retrieves the
+// chunks closest to a prompt
+type KnowledgeIndex struct {
+	logger *slog.Logger
+	config KnowledgeConfig
+	client *openai.Client
+	path   string
+
+	mu    sync.RWMutex
+	store knowledgeStore
+
+	// indexing serializes reindexing
+	indexing sync.Mutex
+}
+
+// NewKnowledgeIndex creates an index, loading the previous one from disk
+func NewKnowledgeIndex(config KnowledgeConfig, client *openai.Client) *KnowledgeIndex {
+	ki := &KnowledgeIndex{
+		logger: slog.Default(),
+		config: config,
+		client: client,
+		path:   KnowledgePath(config),
+		store:  knowledgeStore{Model: config.model(), Files: make(map[string]*knowledgeFile)},
+	}
+	if err := ki.load(); err != nil && !os.IsNotExist(err) {
+		ki.logger.Warn("ignoring unreadable knowledge index", "path", ki.path, "error", err)
+	}
+	return ki
+}
+
+// SetLogger sets the logger used for indexing
+func (ki *KnowledgeIndex) SetLogger(logger *slog.Logger) {
+	ki.logger = logger
+}
+
+// load reads the index file, discarding it when built with another model
+func (ki *KnowledgeIndex) load() error {
+	data, err := os.ReadFile(ki.path)
+	if err != nil {
+		return err
+	}
+	var store knowledgeStore
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&store); err != nil {
+		return err
+	}
+	if store.Model != ki.config.model() || store.Files == nil {
+		return fmt.Errorf("index built with model %s", store.Model)
+	}
+	ki.store = store
+	return nil
+}
+
+// save writes the index file atomically
+func (ki *KnowledgeIndex) save() error {
+	var buf bytes.Buffer
+	ki.mu.RLock()
+	err := gob.NewEncoder(&buf).Encode(&ki.store)
+	ki.mu.RUnlock()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(ki.path), 0700); err != nil {
+		return fmt.Errorf("failed to create knowledge directory: %v", err)
+	}
+	tmp := ki.path + ".tmp"
+	if err := os.WriteFile(tmp, buf.Bytes(), 0600); err != nil {
+		return fmt.Errorf("failed to write knowledge index: %v", err)
+	}
+	return os.Rename(tmp, ki.path)
+}
+
+// Stats returns the number of indexed files and chunks
+func (ki *KnowledgeIndex) Stats() (files, chunks int) {
+	ki.mu.RLock()
+	defer ki.mu.RUnlock()
+	for _, file := range ki.store.Files {
+		chunks += len(file.Chunks)
+	}
+	return len(ki.store.Files), chunks
+}
+
+// Run reindexes now and then periodically until ctx is cancelled
+func (ki *KnowledgeIndex) Run(ctx context.Context) {
+	interval := ki.config.interval()
+	for {
+		if _, err := ki.Reindex(ctx); err != nil && ctx.Err() == nil {
+			ki.logger.Warn("knowledge reindex failed", "error", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+// Reindex brings the index up to date with the directories: new and
+// changed files are chunked and embedded, removed files are dropped, and
+// unchanged files are kept as they are. It returns how many files changed.
+func (ki *KnowledgeIndex) Reindex(ctx context.Context) (int, error) {
+	ki.indexing.Lock()
+	defer ki.indexing.Unlock()
+	start := time.Now()
+
+	seen := make(map[string]bool)
+	changed := 0
+	var errs []string
+	for _, dir := range ki.config.Directories {
+		dir = expandHome(dir)
+		err := filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+			if err != nil {
+				ki.logger.Debug("skipping unreadable path", "path", path, "error", err)
+				return nil
+			}
+			if entry.IsDir() {
+				if path != dir && containsString(ki.config.exclude(), entry.Name()) {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if !entry.Type().IsRegular() || !containsString(ki.config.extensions(), strings.ToLower(filepath.Ext(path))) {
+				return nil
+			}
+			info, err := entry.Info()
+			if err != nil || info.Size() > ki.config.maxFileSize() {
+				return nil
+			}
+			seen[path] = true
+			updated, err := ki.indexFile(ctx, path, info)
+			if err != nil {
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
+				errs = append(errs, fmt.Sprintf("%s: %v", path, err))
+				return nil
+			}
+			if updated {
+				changed++
+			}
+			return nil
+		})
+		if err != nil {
+			if ctx.Err() != nil {
+				return changed, ctx.Err()
+			}
+			errs = append(errs, fmt.Sprintf("%s: %v", dir, err))
+		}
+	}
+
+	ki.mu.Lock()
+	for path := range ki.store.Files {
+		if !seen[path] {
+			delete(ki.store.Files, path)
+			changed++
+		}
+	}
+	ki.mu.Unlock()
+
+	if changed > 0 {
+		if err := ki.save(); err != nil {
+			return changed, err
+		}
+	}
+	files, chunks := ki.Stats()
+	ki.logger.Info("knowledge index updated", "changed", changed, "files", files, "chunks", chunks, "latency", time.Since(start))
+	if len(errs) > 0 {
+		return changed, fmt.Errorf("failed to index %d files: %s", len(errs), strings.Join(errs, "; "))
+	}
+	return changed, nil
+}
+
+// indexFile embeds a file unless the index already has its content
+func (ki *KnowledgeIndex) indexFile(ctx context.Context, path string, info fs.FileInfo) (bool, error) {
+	ki.mu.RLock()
+	existing := ki.store.Files[path]
+	ki.mu.RUnlock()
+	if existing != nil && existing.ModTime.Equal(info.ModTime()) && existing.Size == info.Size() {
+		return false, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return false, err
+	}
+	sum := sha256.Sum256(data)
+	hash := hex.EncodeToString(sum[:])
+	if existing != nil && existing.Hash == hash {
+		// Touched but not modified
+		ki.mu.Lock()
+		existing.ModTime, existing.Size = info.ModTime(), info.Size()
+		ki.mu.Unlock()
+		return false, nil
+	}
+
+	ext := strings.ToLower(filepath.Ext(path))
+	markdown := ext == ".md" || ext == ".markdown"
+	chunks := chunkText(string(data), ki.config.chunkSize(), ki.config.overlap(), markdown)
+	texts := make([]string, len(chunks))
+	for i, chunk := range chunks {
+		// The path gives the embedding context the chunk may lack
+		texts[i] = fmt.Sprintf("%s\n\n%s", filepath.Base(path), chunk.Text)
+	}
+	embeddings, err := ki.embed(ctx, texts)
+	if err != nil {
+		return false, err
+	}
+	for i := range chunks {
+		chunks[i].Embedding = embeddings[i]
+	}
+
+	ki.mu.Lock()
+	ki.store.Files[path] = &knowledgeFile{ModTime: info.ModTime(), Size: info.Size(), Hash: hash, Chunks: chunks}
+	ki.mu.Unlock()
+	ki.logger.Debug("indexed file", "path", path, "chunks", len(chunks))
+	return true, nil
+}
+
+// embed returns the normalized embeddings of texts, in batches
+func (ki *KnowledgeIndex) embed(ctx context.Context, texts []string) ([][]float32, error) {
+	embeddings := make([][]float32, 0, len(texts))
+	for start := 0; start < len(texts); start += embeddingBatchSize {
+		end := start + embeddingBatchSize
+		if end > len(texts) {
+			end = len(texts)
+		}
+		resp, err := ki.client.CreateEmbeddings(ctx, openai.EmbeddingRequestStrings{
+			Input: texts[start:end],
+			Model: openai.EmbeddingModel(ki.config.model()),
+		})
+		if err != nil {
+			return nil, fmt.Errorf("embeddings API error: %v", err)
+		}
+		if len(resp.Data) != end-start {
+			return nil, fmt.Errorf("embeddings API returned %d embeddings for %d inputs", len(resp.Data), end-start)
+		}
+		batch := make([][]float32, len(resp.Data))
+		for _, data := range resp.Data {
+			if data.Index < 0 || data.Index >= len(batch) {
+				return nil, fmt.Errorf("embeddings API returned an invalid index %d", data.Index)
+			}
+			batch[data.Index] = normalize(data.Embedding)
+		}
+		embeddings = append(embeddings, batch...)
+	}
+	return embeddings, nil
+}
+
+// Search returns the k chunks closest to the query
+func (ki *KnowledgeIndex) Search(ctx context.Context, query string, k int) ([]KnowledgeHit, error) {
+	embeddings, err := ki.embed(ctx, []string{query})
+	if err != nil {
+		return nil, err
+	}
+	target := embeddings[0]
+
+	ki.mu.RLock()
+	var hits []KnowledgeHit
+	for path, file := range ki.store.Files {
+		for _, chunk := range file.Chunks {
+			if len(chunk.Embedding) != len(target) {
+				continue
+			}
+			var score float32
+			for i, value := range chunk.Embedding {
+				score += value * target[i]
+			}
+			hits = append(hits, KnowledgeHit{Path: path, StartLine: chunk.StartLine, EndLine: chunk.EndLine, Text: chunk.Text, Score: score})
+		}
+	}
+	ki.mu.RUnlock()
+
+	sort.Slice(hits, func(i, j int) bool { return hits[i].Score > hits[j].Score })
+	if len(hits) > k {
+		hits = hits[:k]
+	}
+	return hits, nil
+}
+
+// Context retrieves the chunks relevant to a prompt and formats them for
+// the user message, numbered so that the model can cite them
+func (ki *KnowledgeIndex) Context(ctx context.Context, prompt string) (string, error) {
+	hits, err := ki.Search(ctx, prompt, ki.config.topK())
+	if err != nil {
+		return "", err
+	}
+	if len(hits) == 0 {
+		return "", nil
+	}
+	var b strings.Builder
+	b.WriteString("Excerpts from the user's files. Cite them as [n] when you use them:\n\n")
+	for i, hit := range hits {
+		fmt.Fprintf(&b, "[%d] %s:%d-%d\n%s\n\n", i+1, hit.Path, hit.StartLine, hit.EndLine, hit.Text)
+	}
+	return b.String(), nil
+}
+
+// knowledgeSegment is a line, or a piece of a line longer than a chunk
+type knowledgeSegment struct {
+	text string
+	line int
+	// continued marks the pieces after the first of a line
+	continued bool
+}
+
+// splitSegments splits text into lines, cutting lines longer than size
+// into pieces of at most size bytes without splitting characters
+func splitSegments(text string, size int) []knowledgeSegment {
+	var segments []knowledgeSegment
+	for i, line := range strings.Split(text, "\n") {
+		continued := false
+		for len(line) > size {
+			cut := size
+			for cut > 0 && !utf8.RuneStart(line[cut]) {
+				cut--
+			}
+			if cut == 0 {
+				// A chunk smaller than a character holds one character
+				_, cut = utf8.DecodeRuneInString(line)
+			}
+			segments = append(segments, knowledgeSegment{text: line[:cut], line: i + 1, continued: continued})
+			line, continued = line[cut:], true
+		}
+		segments = append(segments, knowledgeSegment{text: line, line: i + 1, continued: continued})
+	}
+	return segments
+}
+
+// chunkText splits text into chunks of at most about size characters on
+// line boundaries, cutting longer lines, and repeating about overlap
+// characters between neighbours. Markdown chunks preferably start at
+// headings.
+func chunkText(text string, size, overlap int, markdown bool) []knowledgeChunk {
+	lines := splitSegments(text, size)
+	var chunks []knowledgeChunk
+	start, length := 0, 0
+	flush := func(end int) {
+		var b strings.Builder
+		for i, segment := range lines[start:end] {
+			if i > 0 && !segment.continued {
+				b.WriteByte('\n')
+			}
+			b.WriteString(segment.text)
+		}
+		body := strings.TrimSpace(b.String())
+		if body != "" {
+			chunks = append(chunks, knowledgeChunk{StartLine: lines[start].line, EndLine: lines[end-1].line, Text: body})
+		}
+	}
+	for i, segment := range lines {
+		line := segment.text
+		heading := markdown && !segment.continued && strings.HasPrefix(line, "#") && length > size/2
+		if i > start && (length+len(line) > size || heading) {
+			flush(i)
+			// Step back over the overlap, but always move forward
+			next, kept := i, 0
+			if !heading {
+				for next > start+1 && kept+len(lines[next-1].text) <= overlap {
+					next--
+					kept += len(lines[next].text) + 1
+				}
+			}
+			start, length = next, kept
+		}
+		length += len(line) + 1
+	}
+	flush(len(lines))
+	return chunks
+}
+
+// normalize scales a vector to unit length
+func normalize(vector []float32) []float32 {
+	var sum float64
+	for _, value := range vector {
+		sum += float64(value) * float64(value)
+	}
+	if sum == 0 {
+		return vector
+	}
+	norm := float32(math.Sqrt(sum))
+	out := make([]float32, len(vector))
+	for i, value := range vector {
+		out[i] = value / norm
+	}
+	return out
+}
+
+// expandHome replaces a leading ~/ with the home directory
+func expandHome(path string) string {
+	if strings.HasPrefix(path, "~/") {
+		if home, err := os.UserHomeDir(); err == nil {
+			return filepath.Join(home, path[2:])
+		}
+	}
+	return path
+}
@@ -0,0 +1,124 @@
+package keyboard
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+// joinChunks concatenates the text of chunks cut from a single line
+func joinChunks(chunks []knowledgeChunk) string {
+	var b strings.Builder
+	for _, chunk := range chunks {
+		b.WriteString(chunk.Text)
+	}
+	return b.String()
+}
+
+func TestChunkTextCutsLongLines(t *testing.T) {
+	line := strings.Repeat("a", 250)
+	chunks := chunkText(line, 100, 20, false)
+	if len(chunks) != 3 {
+		t.Fatalf("got %d chunks, want 3", len(chunks))
+	}
+	for _, chunk := range chunks {
+		if len(chunk.Text) > 100 || chunk.StartLine != 1 || chunk.EndLine != 1 {
+			t.Errorf("chunk of %d bytes on lines %d-%d, want at most 100 on line 1", len(chunk.Text), chunk.StartLine, chunk.EndLine)
+		}
+	}
+	if joinChunks(chunks) != line {
+		t.Error("the chunks don't add up to the line")
+	}
+}
+
+func TestChunkTextKeepsCharacters(t *testing.T) {
+	for _, test := range []struct {
+		line string
+		size int
+	}{
+		{strings.Repeat("é", 100), 15},
+		{strings.Repeat("日本語", 40), 10},
+		{strings.Repeat("😀a", 30), 7},
+		{strings.Repeat("日", 5), 1},
+	} {
+		chunks := chunkText(test.line, test.size, 0, false)
+		for _, chunk := range chunks {
+			if !utf8.ValidString(chunk.Text) {
+				t.Errorf("size %d: chunk %q splits a character", test.size, chunk.Text)
+			}
+			if len(chunk.Text) > test.size && utf8.RuneCountInString(chunk.Text) > 1 {
+				t.Errorf("size %d: chunk %q is too long", test.size, chunk.Text)
+			}
+		}
+		if joinChunks(chunks) != test.line {
+			t.Errorf("size %d: the chunks don't add up to the line", test.size)
+		}
+	}
+}
+
+func TestChunkTextOverlapMovesForward(t *testing.T) {
+	lines := func(count, width int) string {
+		var out []string
+		for i := 0; i < count; i++ {
+			out = append(out, fmt.Sprintf("%0*d", width, i))
+		}
+		return strings.Join(out, "\n")
+	}
+	for _, test := range []struct {
+		name                 string
+		text                 string
+		size, overlap, lines int
+	}{
+		{"short lines", lines(40, 9), 50, 25, 40},
+		{"lines longer than the overlap", lines(10, 80), 100, 50, 10},
+		{"overlap larger than the chunks", lines(20, 30), 60, 200, 20},
+		{"line longer than the chunks", lines(3, 250) + "\nend", 100, 90, 4},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			chunks := chunkText(test.text, test.size, test.overlap, false)
+			if len(chunks) == 0 {
+				t.Fatal("no chunks")
+			}
+			for i := 1; i < len(chunks); i++ {
+				previous, chunk := chunks[i-1], chunks[i]
+				if chunk.StartLine < previous.StartLine || chunk.EndLine < previous.EndLine {
+					t.Fatalf("chunk %d (lines %d-%d) doesn't move past chunk %d (lines %d-%d)",
+						i, chunk.StartLine, chunk.EndLine, i-1, previous.StartLine, previous.EndLine)
+				}
+			}
+			if last := chunks[len(chunks)-1]; last.EndLine != test.lines {
+				t.Errorf("the last chunk ends at line %d, want %d", last.EndLine, test.lines)
+			}
+		})
+	}
+
+	// Short lines are repeated between neighbouring chunks
+	chunks := chunkText(lines(40, 9), 50, 25, false)
+	for i := 1; i < len(chunks); i++ {
+		if chunks[i].StartLine > chunks[i-1].EndLine {
+			t.Errorf("chunk %d starts at line %d, after the end of chunk %d at line %d", i, chunks[i].StartLine, i-1, chunks[i-1].EndLine)
+		}
+	}
+}
+
+func TestChunkTextHeadingsOnlyInMarkdown(t *testing.T) {
+	text := strings.Join([]string{
+		"the first line of text",
+		"the second line of text",
+		"the third line of text",
+		"the fourth line of text",
+		"the fifth line of text",
+		"# Section",
+		"the last line of text",
+	}, "\n")
+	markdown := chunkText(text, 200, 0, true)
+	if len(markdown) != 2 || !strings.HasPrefix(markdown[1].Text, "# Section") {
+		t.Errorf("Markdown chunks = %+v, want the second to start at the heading", markdown)
+	}
+	// In a script, # starts a comment rather than a section
+	plain := chunkText(text, 200, 0, false)
+	if len(plain) != 1 || plain[0].EndLine != 7 {
+		t.Errorf("plain text chunks = %+v, want one chunk", plain)
+	}
+}
@@ -1,11 +1,16 @@
 package keyboard
 
 import (
+	"context"
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"log/slog"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
+	"time"
 
 	"golang.org/x/sys/unix"
 )
@@ -26,29 +31,139 @@ const (
 	KeyPressed  KeyState = true
 )
 
+// Values of InputEvent.Value for EV_KEY events
+const (
+	keyValueRelease = 0
+	keyValuePress   = 1
+	keyValueRepeat  = 2
+)
+
+// TriggerType selects when a key combination fires
+type TriggerType int
+
+const (
+	// TriggerPress fires once as soon as all keys of the combination are down
+	TriggerPress TriggerType = iota
+	// TriggerTap fires on release if no other key was pressed while the combination was held
+	TriggerTap
+	// TriggerDoubleTap fires on the second solo tap within Threshold of the first
+	TriggerDoubleTap
+	// TriggerLongPress fires once the combination has been held alone for Threshold
+	TriggerLongPress
+	// TriggerHold reports both the start and the end of a press (push-to-talk)
+	TriggerHold
+)
+
+// Default thresholds used when KeyCombination.Threshold is zero
+const (
+	DefaultTapThreshold       = 500 * time.Millisecond
+	DefaultDoubleTapThreshold = 300 * time.Millisecond
+	DefaultLongPressThreshold = 800 * time.Millisecond
+)
+
+// String returns the name used for the trigger type in key binding strings
+func (t TriggerType) String() string {
+	switch t {
+	case TriggerTap:
+		return "tap"
+	case TriggerDoubleTap:
+		return "doubletap"
+	case TriggerLongPress:
+		return "longpress"
+	case TriggerHold:
+		return "hold"
+	default:
+		return "press"
+	}
+}
+
+// CombinationPhase tells a callback which part of a combination's lifecycle fired
+type CombinationPhase int
+
+const (
+	// PhaseTriggered is reported by press, tap, double-tap and long-press triggers
+	PhaseTriggered CombinationPhase = iota
+	// PhaseStarted is reported by hold triggers when the combination goes down
+	PhaseStarted
+	// PhaseEnded is reported by hold triggers when the combination is released
+	PhaseEnded
+)
+
+// CombinationEvent is passed to combination callbacks
+type CombinationEvent struct {
+	Name  string
+	Phase CombinationPhase
+	// Duration is how long the combination was held (long-press and hold end only)
+	Duration time.Duration
+}
+
 // KeyCombination represents a combination of keys to listen for
 type KeyCombination struct {
-	Name string
-	Keys []uint16
+	Name    string
+	Keys    []uint16
+	Trigger TriggerType
+	// Threshold is the maximum hold time for a tap, the maximum gap between
+	// the two taps of a double-tap, or the minimum hold time for a long-press.
+	// Zero selects the default for the trigger type.
+	Threshold time.Duration
 }
 
-// KeyboardListener listens for keyboard events and detects key combinations
+// combinationState tracks the progress of a non-press trigger
+type combinationState struct {
+	active  bool
+	since   time.Time
+	tainted bool
+	fired   bool
+	lastTap time.Time
+}
+
+// dispatchQueueSize bounds the number of callback invocations waiting for the worker
+const dispatchQueueSize = 64
+
+// dispatchJob is a batch of callbacks to run for a combination event
+type dispatchJob struct {
+	event     CombinationEvent
+	callbacks []func(CombinationEvent)
+}
+
+// KeyboardListener listens for keyboard events and detects key combinations.
+// Combinations and callbacks may be added or removed while it is running.
 type KeyboardListener struct {
+	mu           sync.Mutex
+	logger       *slog.Logger
 	devicePath   string
 	file         *os.File
 	keyStates    map[uint16]KeyState
 	combinations []KeyCombination
-	callbacks    map[string][]func()
-	running      bool
+	states       map[string]*combinationState
+	callbacks    map[string][]func(CombinationEvent)
+	paused       bool
+	pauseExcept  map[string]bool
+
+	subsMu      sync.RWMutex
+	subscribers map[*Subscription]struct{}
+	subsClosed  bool
+
+	heartbeatInterval time.Duration
+	heartbeat         func()
+
+	started  bool
+	cancel   context.CancelFunc
+	dispatch chan dispatchJob
+	done     chan struct{}
+	err      error
 }
 
 // NewKeyboardListener creates a new keyboard listener
 func NewKeyboardListener(devicePath string) *KeyboardListener {
 	return &KeyboardListener{
+		logger:       slog.Default(),
 		devicePath:   devicePath,
 		keyStates:    make(map[uint16]KeyState),
 		combinations: make([]KeyCombination, 0),
-		callbacks:    make(map[string][]func()),
+		states:       make(map[string]*combinationState),
+		callbacks:    make(map[string][]func(CombinationEvent)),
+		done:         make(chan struct{}),
 	}
 }
 
@@ -69,7 +184,7 @@ func (kl *KeyboardListener) FindKeyboardDevice() (string, error) {
 			if err != nil {
 				continue
 			}
-			fmt.Println("Found keyboard device:", actualPath)
+			kl.logger.Info("found keyboard device", "device", actualPath)
 			if !filepath.IsAbs(actualPath) {
 				actualPath = filepath.Join("/dev/input/by-path", actualPath)
 			}
@@ -96,27 +211,181 @@ func (kl *KeyboardListener) FindKeyboardDevice() (string, error) {
 	return "", fmt.Errorf("no keyboard device found")
 }
 
+// SetLogger sets the logger used by the listener
+func (kl *KeyboardListener) SetLogger(logger *slog.Logger) {
+	kl.mu.Lock()
+	defer kl.mu.Unlock()
+	kl.logger = logger
+}
+
 // SetDevice sets the input device to listen on
 func (kl *KeyboardListener) SetDevice(devicePath string) {
+	kl.mu.Lock()
+	defer kl.mu.Unlock()
 	kl.devicePath = devicePath
 }
 
 // AddCombination adds a key combination to listen for
 func (kl *KeyboardListener) AddCombination(name string, keys ...uint16) {
-	combination := KeyCombination{
+	kl.AddKeyCombination(KeyCombination{
 		Name: name,
 		Keys: keys,
-	}
+	})
+}
+
+// AddKeyCombination adds a key combination with an explicit trigger type,
+// replacing any combination registered under the same name
+func (kl *KeyboardListener) AddKeyCombination(combination KeyCombination) {
+	kl.mu.Lock()
+	defer kl.mu.Unlock()
+	kl.removeCombinationLocked(combination.Name)
 	kl.combinations = append(kl.combinations, combination)
+	kl.states[combination.Name] = &combinationState{}
+}
+
+// RemoveCombination stops listening for a combination and drops its callbacks
+func (kl *KeyboardListener) RemoveCombination(name string) {
+	kl.mu.Lock()
+	defer kl.mu.Unlock()
+	kl.removeCombinationLocked(name)
+	delete(kl.callbacks, name)
 }
 
-// OnCombination registers a callback for when a combination is detected
+// removeCombinationLocked removes a combination; kl.mu must be held
+func (kl *KeyboardListener) removeCombinationLocked(name string) {
+	for i, combination := range kl.combinations {
+		if combination.Name == name {
+			kl.combinations = append(kl.combinations[:i], kl.combinations[i+1:]...)
+			break
+		}
+	}
+	delete(kl.states, name)
+}
+
+// OnCombination registers a callback for when a combination is detected.
+// For hold triggers the callback runs when the combination goes down.
 func (kl *KeyboardListener) OnCombination(name string, callback func()) {
+	kl.OnCombinationEvent(name, func(event CombinationEvent) {
+		if event.Phase != PhaseEnded {
+			callback()
+		}
+	})
+}
+
+// OnCombinationEvent registers a callback receiving every phase of a combination.
+// Callbacks run on a single worker goroutine, in the order events were detected.
+func (kl *KeyboardListener) OnCombinationEvent(name string, callback func(CombinationEvent)) {
+	kl.mu.Lock()
+	defer kl.mu.Unlock()
 	kl.callbacks[name] = append(kl.callbacks[name], callback)
 }
 
-// Start begins listening for keyboard events
+// SetHeartbeat makes the event loop call fn at least every interval while it
+// is alive, even when no keys are pressed. It must be called before Start.
+func (kl *KeyboardListener) SetHeartbeat(interval time.Duration, fn func()) {
+	kl.mu.Lock()
+	defer kl.mu.Unlock()
+	if interval <= 0 {
+		fn = nil
+	}
+	kl.heartbeatInterval = interval
+	kl.heartbeat = fn
+}
+
+// Pause stops matching every combination except the named ones, and stops
+// publishing key events to subscribers, until Resume is called
+func (kl *KeyboardListener) Pause(except ...string) {
+	kl.mu.Lock()
+	defer kl.mu.Unlock()
+	kl.paused = true
+	kl.pauseExcept = make(map[string]bool)
+	for _, name := range except {
+		kl.pauseExcept[name] = true
+	}
+	for _, combination := range kl.combinations {
+		if kl.pauseExcept[combination.Name] {
+			continue
+		}
+		// Close any hold in progress and forget pending taps
+		if state, ok := kl.states[combination.Name]; ok && state.active && state.fired && combination.Trigger == TriggerHold {
+			kl.triggerCallbacks(CombinationEvent{Name: combination.Name, Phase: PhaseEnded})
+		}
+		delete(kl.states, combination.Name)
+	}
+}
+
+// Resume undoes Pause
+func (kl *KeyboardListener) Resume() {
+	kl.mu.Lock()
+	defer kl.mu.Unlock()
+	kl.paused = false
+	kl.pauseExcept = nil
+}
+
+// Paused reports whether the listener is paused
+func (kl *KeyboardListener) Paused() bool {
+	kl.mu.Lock()
+	defer kl.mu.Unlock()
+	return kl.paused
+}
+
+// Start begins listening for keyboard events in the background
 func (kl *KeyboardListener) Start() error {
+	return kl.start(context.Background())
+}
+
+// Run listens for keyboard events until ctx is cancelled, Stop is called or
+// reading from the device fails. It returns the terminal read error, or nil
+// when the listener was stopped.
+func (kl *KeyboardListener) Run(ctx context.Context) error {
+	if err := kl.start(ctx); err != nil {
+		return err
+	}
+	<-kl.Done()
+	return kl.Err()
+}
+
+// Stop stops listening for keyboard events and waits for the event loop to exit
+func (kl *KeyboardListener) Stop() {
+	kl.mu.Lock()
+	cancel := kl.cancel
+	started := kl.started
+	kl.mu.Unlock()
+	if !started {
+		return
+	}
+	cancel()
+	<-kl.done
+}
+
+// Done returns a channel that is closed when the event loop has exited
+func (kl *KeyboardListener) Done() <-chan struct{} {
+	return kl.done
+}
+
+// Err returns the error that terminated the event loop, or nil if it was
+// stopped or is still running
+func (kl *KeyboardListener) Err() error {
+	kl.mu.Lock()
+	defer kl.mu.Unlock()
+	return kl.err
+}
+
+// Open finds and opens the input device without starting to listen. It is
+// optional: Start and Run open the device themselves if needed. Opening
+// early lets the caller drop privileges before the event loop starts.
+func (kl *KeyboardListener) Open() error {
+	kl.mu.Lock()
+	defer kl.mu.Unlock()
+	return kl.openLocked()
+}
+
+// openLocked opens the input device unless already open; kl.mu must be held
+func (kl *KeyboardListener) openLocked() error {
+	if kl.file != nil {
+		return nil
+	}
+
 	if kl.devicePath == "" {
 		devicePath, err := kl.FindKeyboardDevice()
 		if err != nil {
@@ -130,51 +399,215 @@ func (kl *KeyboardListener) Start() error {
 		return fmt.Errorf("failed to open device %s: %v", kl.devicePath, err)
 	}
 	kl.file = file
-	kl.running = true
-
-	fmt.Printf("Listening for keyboard events on %s\n", kl.devicePath)
-	fmt.Printf("Registered combinations: %v\n", kl.getCombinationNames())
-
-	go kl.listenLoop()
 	return nil
 }
 
-// Stop stops listening for keyboard events
-func (kl *KeyboardListener) Stop() {
-	kl.running = false
-	if kl.file != nil {
-		kl.file.Close()
+// start opens the device and launches the event and dispatch loops
+func (kl *KeyboardListener) start(ctx context.Context) error {
+	kl.mu.Lock()
+	defer kl.mu.Unlock()
+	if kl.started {
+		return fmt.Errorf("listener already started")
+	}
+	if err := kl.openLocked(); err != nil {
+		return err
 	}
+	file := kl.file
+	kl.started = true
+
+	ctx, kl.cancel = context.WithCancel(ctx)
+	kl.dispatch = make(chan dispatchJob, dispatchQueueSize)
+
+	kl.logger.Info("listening for keyboard events", "device", kl.devicePath, "combinations", kl.getCombinationNames())
+
+	go kl.dispatchLoop(kl.dispatch)
+	go kl.listenLoop(ctx, file, kl.devicePath, kl.dispatch)
+	return nil
 }
 
 // listenLoop is the main event listening loop
-func (kl *KeyboardListener) listenLoop() {
-	for kl.running {
+func (kl *KeyboardListener) listenLoop(ctx context.Context, file *os.File, device string, dispatch chan dispatchJob) {
+	loopDone := make(chan struct{})
+	go func() {
+		// Closing the device unblocks the pending read
+		select {
+		case <-ctx.Done():
+		case <-loopDone:
+		}
+		file.Close()
+	}()
+
+	kl.mu.Lock()
+	interval, heartbeat := kl.heartbeatInterval, kl.heartbeat
+	kl.mu.Unlock()
+	if heartbeat != nil && file.SetReadDeadline(time.Now().Add(interval)) != nil {
+		// Devices that can't time out reads get a heartbeat tied to the loop's lifetime
+		go heartbeatLoop(interval, heartbeat, loopDone)
+		heartbeat = nil
+	}
+	lastBeat := time.Now()
+
+	var err error
+	for {
 		var event InputEvent
-		err := kl.binaryRead(&event)
-		if err != nil {
-			if kl.running {
-				fmt.Printf("Read error: %v\n", err)
+		if heartbeat != nil {
+			if time.Since(lastBeat) >= interval {
+				heartbeat()
+				lastBeat = time.Now()
+			}
+			file.SetReadDeadline(time.Now().Add(interval))
+		}
+		if err = binaryRead(file, &event); err != nil {
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				continue
 			}
 			break
 		}
 
 		if event.Type == EV_KEY {
-			kl.handleKeyEvent(event)
+			if paused := kl.handleKeyEvent(event); !paused {
+				kl.publish(device, event)
+			}
+		}
+	}
+
+	stopped := ctx.Err() != nil || errors.Is(err, os.ErrClosed)
+	if !stopped {
+		kl.logger.Error("failed to read keyboard event", "device", device, "error", err)
+	}
+	close(loopDone)
+	kl.cancel()
+
+	kl.mu.Lock()
+	if !stopped {
+		kl.err = err
+	}
+	kl.dispatch = nil
+	kl.mu.Unlock()
+
+	close(dispatch)
+	kl.closeSubscribers()
+	close(kl.done)
+}
+
+// heartbeatLoop calls fn every interval until done is closed
+func heartbeatLoop(interval time.Duration, fn func(), done <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			fn()
+		}
+	}
+}
+
+// dispatchLoop runs combination callbacks so they can't stall event reading
+func (kl *KeyboardListener) dispatchLoop(dispatch <-chan dispatchJob) {
+	for job := range dispatch {
+		for _, callback := range job.callbacks {
+			callback(job.event)
 		}
 	}
 }
 
-// handleKeyEvent processes a key event and checks for combinations
-func (kl *KeyboardListener) handleKeyEvent(event InputEvent) {
-	keyState := event.Value != 0
+// handleKeyEvent processes a key event and checks for combinations. It
+// reports whether the listener is paused.
+func (kl *KeyboardListener) handleKeyEvent(event InputEvent) bool {
+	kl.mu.Lock()
+	defer kl.mu.Unlock()
+
+	// Key states are tracked while paused so that held keys are known on resume
+	keyState := event.Value != keyValueRelease
 	kl.keyStates[event.Code] = KeyState(keyState)
+	now := time.Unix(event.Time.Sec, event.Time.Usec*int64(time.Microsecond))
 
 	// Check all combinations
 	for _, combination := range kl.combinations {
-		if kl.isCombinationActive(combination) {
-			kl.triggerCallbacks(combination.Name)
+		if kl.paused && !kl.pauseExcept[combination.Name] {
+			continue
+		}
+		if combination.Trigger == TriggerPress {
+			// Only the press completing the combination fires: auto-repeat
+			// and other keys pressed while it is held don't
+			if event.Value == keyValuePress && combination.hasKey(event.Code) && kl.isCombinationActive(combination) {
+				kl.triggerCallbacks(CombinationEvent{Name: combination.Name, Phase: PhaseTriggered})
+			}
+			continue
 		}
+		kl.updateCombination(combination, event, now)
+	}
+	return kl.paused
+}
+
+// updateCombination advances the state machine of a tap, double-tap,
+// long-press or hold combination
+func (kl *KeyboardListener) updateCombination(combination KeyCombination, event InputEvent, now time.Time) {
+	state, ok := kl.states[combination.Name]
+	if !ok {
+		state = &combinationState{}
+		kl.states[combination.Name] = state
+	}
+	active := kl.isCombinationActive(combination)
+
+	switch {
+	case event.Value == keyValuePress && !combination.hasKey(event.Code):
+		// Another key pressed alongside the combination means it is not a solo tap
+		if kl.anyKeyDown(combination) {
+			state.tainted = true
+		}
+		state.lastTap = time.Time{}
+
+	case !state.active && active:
+		state.active = true
+		state.since = now
+		state.fired = false
+		if combination.Trigger == TriggerHold {
+			state.fired = true
+			kl.triggerCallbacks(CombinationEvent{Name: combination.Name, Phase: PhaseStarted})
+		}
+
+	case state.active && active && event.Value == keyValueRepeat:
+		// Auto-repeat events let a long-press fire while the keys are still held
+		if combination.Trigger == TriggerLongPress && !state.fired && !state.tainted &&
+			now.Sub(state.since) >= combination.threshold() {
+			state.fired = true
+			kl.triggerCallbacks(CombinationEvent{Name: combination.Name, Phase: PhaseTriggered, Duration: now.Sub(state.since)})
+		}
+
+	case state.active && !active:
+		state.active = false
+		held := now.Sub(state.since)
+		switch combination.Trigger {
+		case TriggerTap:
+			if !state.tainted && held <= combination.threshold() {
+				kl.triggerCallbacks(CombinationEvent{Name: combination.Name, Phase: PhaseTriggered, Duration: held})
+			}
+		case TriggerDoubleTap:
+			if state.tainted || held > DefaultTapThreshold {
+				state.lastTap = time.Time{}
+			} else if !state.lastTap.IsZero() && now.Sub(state.lastTap) <= combination.threshold() {
+				state.lastTap = time.Time{}
+				kl.triggerCallbacks(CombinationEvent{Name: combination.Name, Phase: PhaseTriggered})
+			} else {
+				state.lastTap = now
+			}
+		case TriggerLongPress:
+			if !state.fired && !state.tainted && held >= combination.threshold() {
+				kl.triggerCallbacks(CombinationEvent{Name: combination.Name, Phase: PhaseTriggered, Duration: held})
+			}
+		case TriggerHold:
+			if state.fired {
+				kl.triggerCallbacks(CombinationEvent{Name: combination.Name, Phase: PhaseEnded, Duration: held})
+			}
+		}
+		state.fired = false
+	}
+
+	if !kl.anyKeyDown(combination) {
+		state.tainted = false
 	}
 }
 
@@ -188,16 +621,81 @@ func (kl *KeyboardListener) isCombinationActive(combination KeyCombination) bool
 	return true
 }
 
-// triggerCallbacks executes all callbacks for a combination
-func (kl *KeyboardListener) triggerCallbacks(combinationName string) {
-	if callbacks, exists := kl.callbacks[combinationName]; exists {
-		for _, callback := range callbacks {
-			callback()
+// anyKeyDown checks if at least one key of a combination is currently pressed
+func (kl *KeyboardListener) anyKeyDown(combination KeyCombination) bool {
+	for _, key := range combination.Keys {
+		if kl.keyStates[key] {
+			return true
+		}
+	}
+	return false
+}
+
+// triggerCallbacks queues all callbacks for a combination on the dispatch
+// worker; kl.mu must be held
+func (kl *KeyboardListener) triggerCallbacks(event CombinationEvent) {
+	callbacks, exists := kl.callbacks[event.Name]
+	if !exists || kl.dispatch == nil {
+		return
+	}
+	job := dispatchJob{
+		event:     event,
+		callbacks: append([]func(CombinationEvent){}, callbacks...),
+	}
+	select {
+	case kl.dispatch <- job:
+	default:
+		kl.logger.Warn("callback queue full, dropping combination event", "binding", event.Name)
+	}
+}
+
+// hasKey checks if a key is part of the combination
+func (kc KeyCombination) hasKey(code uint16) bool {
+	for _, key := range kc.Keys {
+		if key == code {
+			return true
+		}
+	}
+	return false
+}
+
+// ModifiersOnly reports whether the combination consists solely of modifier
+// and lock keys, i.e. pressing it never produces a character
+func (kc KeyCombination) ModifiersOnly() bool {
+	for _, key := range kc.Keys {
+		if !isModifierKey(key) {
+			return false
 		}
 	}
+	return len(kc.Keys) > 0
+}
+
+// threshold returns the configured threshold or the trigger type's default
+func (kc KeyCombination) threshold() time.Duration {
+	if kc.Threshold > 0 {
+		return kc.Threshold
+	}
+	switch kc.Trigger {
+	case TriggerDoubleTap:
+		return DefaultDoubleTapThreshold
+	case TriggerLongPress:
+		return DefaultLongPressThreshold
+	default:
+		return DefaultTapThreshold
+	}
+}
+
+// isModifierKey checks if a key code is a modifier or lock key
+func isModifierKey(code uint16) bool {
+	switch code {
+	case KEY_LEFTCTRL, KEY_RIGHTCTRL, KEY_LEFTSHIFT, KEY_RIGHTSHIFT,
+		KEY_LEFTALT, KEY_RIGHTALT, KEY_LEFTMETA, KEY_RIGHTMETA, KEY_CAPSLOCK:
+		return true
+	}
+	return false
 }
 
-// getCombinationNames returns a list of registered combination names
+// getCombinationNames returns a list of registered combination names; kl.mu must be held
 func (kl *KeyboardListener) getCombinationNames() []string {
 	names := make([]string, len(kl.combinations))
 	for i, combo := range kl.combinations {
@@ -207,9 +705,9 @@ func (kl *KeyboardListener) getCombinationNames() []string {
 }
 
 // binaryRead reads InputEvent from device file
-func (kl *KeyboardListener) binaryRead(event *InputEvent) error {
+func binaryRead(file *os.File, event *InputEvent) error {
 	buf := make([]byte, 24)
-	_, err := kl.file.Read(buf)
+	_, err := file.Read(buf)
 	if err != nil {
 		return err
 	}
@@ -293,8 +791,12 @@ const (
 	KEY_F8         = 66
 	KEY_F9         = 67
 	KEY_F10        = 68
+	KEY_SCROLLLOCK = 70
 	KEY_F11        = 87
 	KEY_F12        = 88
+	KEY_RIGHTCTRL  = 97
+	KEY_RIGHTALT   = 100
+	KEY_PAUSE      = 119
 	KEY_LEFTMETA   = 125
 	KEY_RIGHTMETA  = 126
 )
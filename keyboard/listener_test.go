@@ -0,0 +1,204 @@
+package keyboard
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// testListener returns a listener for combinations whose detected events
+// are queued instead of run
+func testListener(combinations ...KeyCombination) *KeyboardListener {
+	kl := NewKeyboardListener("")
+	kl.dispatch = make(chan dispatchJob, dispatchQueueSize)
+	for _, combination := range combinations {
+		kl.AddKeyCombination(combination)
+		kl.OnCombinationEvent(combination.Name, func(CombinationEvent) {})
+	}
+	return kl
+}
+
+// keyEvent is a key event at an offset from the start of a test
+type keyEvent struct {
+	at    time.Duration
+	code  uint16
+	value int32
+}
+
+// feed passes events to the listener and returns the combination events
+// it detected
+func feed(kl *KeyboardListener, events ...keyEvent) []CombinationEvent {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, event := range events {
+		kl.handleKeyEvent(InputEvent{
+			Time:  unix.NsecToTimeval(start.Add(event.at).UnixNano()),
+			Type:  EV_KEY,
+			Code:  event.code,
+			Value: event.value,
+		})
+	}
+	var detected []CombinationEvent
+	for {
+		select {
+		case job := <-kl.dispatch:
+			detected = append(detected, job.event)
+		default:
+			return detected
+		}
+	}
+}
+
+func TestTapTrigger(t *testing.T) {
+	tap := KeyCombination{Name: "tap", Keys: []uint16{KEY_CAPSLOCK}, Trigger: TriggerTap}
+	for _, test := range []struct {
+		name   string
+		events []keyEvent
+		want   int
+	}{
+		{"solo tap", []keyEvent{
+			{0, KEY_CAPSLOCK, keyValuePress},
+			{100 * time.Millisecond, KEY_CAPSLOCK, keyValueRelease},
+		}, 1},
+		{"another key pressed while held", []keyEvent{
+			{0, KEY_CAPSLOCK, keyValuePress},
+			{50 * time.Millisecond, KEY_A, keyValuePress},
+			{60 * time.Millisecond, KEY_A, keyValueRelease},
+			{100 * time.Millisecond, KEY_CAPSLOCK, keyValueRelease},
+		}, 0},
+		{"held too long", []keyEvent{
+			{0, KEY_CAPSLOCK, keyValuePress},
+			{600 * time.Millisecond, KEY_CAPSLOCK, keyValueRelease},
+		}, 0},
+		{"tap after a tainted one", []keyEvent{
+			{0, KEY_CAPSLOCK, keyValuePress},
+			{50 * time.Millisecond, KEY_A, keyValuePress},
+			{60 * time.Millisecond, KEY_A, keyValueRelease},
+			{100 * time.Millisecond, KEY_CAPSLOCK, keyValueRelease},
+			{200 * time.Millisecond, KEY_CAPSLOCK, keyValuePress},
+			{250 * time.Millisecond, KEY_CAPSLOCK, keyValueRelease},
+		}, 1},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			detected := feed(testListener(tap), test.events...)
+			if len(detected) != test.want {
+				t.Fatalf("detected %v, want %d events", detected, test.want)
+			}
+			for _, event := range detected {
+				if event.Name != "tap" || event.Phase != PhaseTriggered {
+					t.Errorf("detected %+v, want a triggered tap", event)
+				}
+			}
+		})
+	}
+}
+
+func TestDoubleTapTrigger(t *testing.T) {
+	doubleTap := KeyCombination{Name: "double", Keys: []uint16{KEY_LEFTCTRL}, Trigger: TriggerDoubleTap}
+	taps := func(second time.Duration) []keyEvent {
+		return []keyEvent{
+			{0, KEY_LEFTCTRL, keyValuePress},
+			{50 * time.Millisecond, KEY_LEFTCTRL, keyValueRelease},
+			{second, KEY_LEFTCTRL, keyValuePress},
+			{second + 50*time.Millisecond, KEY_LEFTCTRL, keyValueRelease},
+		}
+	}
+	if detected := feed(testListener(doubleTap), taps(250*time.Millisecond)...); len(detected) != 1 {
+		t.Errorf("taps 250ms apart: detected %v, want one double-tap", detected)
+	}
+	if detected := feed(testListener(doubleTap), taps(400*time.Millisecond)...); len(detected) != 0 {
+		t.Errorf("taps 400ms apart: detected %v, want none", detected)
+	}
+
+	// A third quick tap starts a new pair rather than firing again
+	kl := testListener(doubleTap)
+	events := append(taps(150*time.Millisecond),
+		keyEvent{300 * time.Millisecond, KEY_LEFTCTRL, keyValuePress},
+		keyEvent{350 * time.Millisecond, KEY_LEFTCTRL, keyValueRelease},
+	)
+	if detected := feed(kl, events...); len(detected) != 1 {
+		t.Errorf("three quick taps: detected %v, want one double-tap", detected)
+	}
+
+	// A key typed between the taps breaks the pair
+	events = []keyEvent{
+		{0, KEY_LEFTCTRL, keyValuePress},
+		{50 * time.Millisecond, KEY_LEFTCTRL, keyValueRelease},
+		{100 * time.Millisecond, KEY_A, keyValuePress},
+		{120 * time.Millisecond, KEY_A, keyValueRelease},
+		{150 * time.Millisecond, KEY_LEFTCTRL, keyValuePress},
+		{200 * time.Millisecond, KEY_LEFTCTRL, keyValueRelease},
+	}
+	if detected := feed(testListener(doubleTap), events...); len(detected) != 0 {
+		t.Errorf("key typed between taps: detected %v, want none", detected)
+	}
+}
+
+func TestLongPressTrigger(t *testing.T) {
+	longPress := KeyCombination{Name: "long", Keys: []uint16{KEY_CAPSLOCK}, Trigger: TriggerLongPress}
+	kl := testListener(longPress)
+	detected := feed(kl,
+		keyEvent{0, KEY_CAPSLOCK, keyValuePress},
+		keyEvent{500 * time.Millisecond, KEY_CAPSLOCK, keyValueRepeat},
+	)
+	if len(detected) != 0 {
+		t.Fatalf("detected %v before the threshold", detected)
+	}
+	detected = feed(kl,
+		keyEvent{850 * time.Millisecond, KEY_CAPSLOCK, keyValueRepeat},
+		keyEvent{900 * time.Millisecond, KEY_CAPSLOCK, keyValueRepeat},
+		keyEvent{950 * time.Millisecond, KEY_CAPSLOCK, keyValueRelease},
+	)
+	if len(detected) != 1 || detected[0].Duration != 850*time.Millisecond {
+		t.Fatalf("detected %v, want one long-press fired by auto-repeat after 850ms", detected)
+	}
+
+	short := feed(testListener(longPress),
+		keyEvent{0, KEY_CAPSLOCK, keyValuePress},
+		keyEvent{300 * time.Millisecond, KEY_CAPSLOCK, keyValueRelease},
+	)
+	if len(short) != 0 {
+		t.Errorf("short press: detected %v, want none", short)
+	}
+}
+
+func TestHoldTrigger(t *testing.T) {
+	hold := KeyCombination{Name: "hold", Keys: []uint16{KEY_LEFTCTRL, KEY_A}, Trigger: TriggerHold}
+	detected := feed(testListener(hold),
+		keyEvent{0, KEY_LEFTCTRL, keyValuePress},
+		keyEvent{100 * time.Millisecond, KEY_A, keyValuePress},
+		keyEvent{600 * time.Millisecond, KEY_A, keyValueRepeat},
+		keyEvent{700 * time.Millisecond, KEY_A, keyValueRepeat},
+		keyEvent{1100 * time.Millisecond, KEY_A, keyValueRelease},
+		keyEvent{1200 * time.Millisecond, KEY_LEFTCTRL, keyValueRelease},
+	)
+	want := []CombinationEvent{
+		{Name: "hold", Phase: PhaseStarted},
+		{Name: "hold", Phase: PhaseEnded, Duration: time.Second},
+	}
+	if len(detected) != len(want) {
+		t.Fatalf("detected %v, want %v", detected, want)
+	}
+	for i := range want {
+		if detected[i] != want[i] {
+			t.Errorf("event %d = %+v, want %+v", i, detected[i], want[i])
+		}
+	}
+}
+
+func TestPressTriggerIgnoresRepeat(t *testing.T) {
+	press := KeyCombination{Name: "press", Keys: []uint16{KEY_LEFTCTRL, KEY_A}, Trigger: TriggerPress}
+	detected := feed(testListener(press),
+		keyEvent{0, KEY_LEFTCTRL, keyValuePress},
+		keyEvent{50 * time.Millisecond, KEY_A, keyValuePress},
+		keyEvent{550 * time.Millisecond, KEY_A, keyValueRepeat},
+		keyEvent{600 * time.Millisecond, KEY_A, keyValueRepeat},
+		keyEvent{650 * time.Millisecond, KEY_B, keyValuePress},
+		keyEvent{700 * time.Millisecond, KEY_B, keyValueRelease},
+		keyEvent{750 * time.Millisecond, KEY_A, keyValueRelease},
+		keyEvent{800 * time.Millisecond, KEY_A, keyValuePress},
+	)
+	if len(detected) != 2 {
+		t.Errorf("detected %v, want one event per press of the combination", detected)
+	}
+}
@@ -0,0 +1,55 @@
+package keyboard
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// NewLogger creates a logger writing to w. level is one of debug, info,
+// warn or error (default info); format is text (default) or json.
+func NewLogger(w io.Writer, level, format string) (*slog.Logger, error) {
+	var slogLevel slog.Level
+	switch strings.ToLower(level) {
+	case "debug":
+		slogLevel = slog.LevelDebug
+	case "", "info":
+		slogLevel = slog.LevelInfo
+	case "warn", "warning":
+		slogLevel = slog.LevelWarn
+	case "error":
+		slogLevel = slog.LevelError
+	default:
+		return nil, fmt.Errorf("unknown log level: %s", level)
+	}
+
+	opts := &slog.HandlerOptions{Level: slogLevel}
+	switch strings.ToLower(format) {
+	case "", "text":
+		return slog.New(slog.NewTextHandler(w, opts)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(w, opts)), nil
+	default:
+		return nil, fmt.Errorf("unknown log format: %s", format)
+	}
+}
+
+// LoggerFromEnv creates a stderr logger configured by KEYGEIST_LOG_LEVEL and
+// KEYGEIST_LOG_FORMAT
+func LoggerFromEnv() (*slog.Logger, error) {
+	return NewLogger(os.Stderr, os.Getenv("KEYGEIST_LOG_LEVEL"), os.Getenv("KEYGEIST_LOG_FORMAT"))
+}
+
+// newInteractionID returns a short random identifier to correlate the log
+// lines of one interaction
+func newInteractionID() string {
+	buf := make([]byte, 4)
+	if _, err := rand.Read(buf); err != nil {
+		return "00000000"
+	}
+	return hex.EncodeToString(buf)
+}
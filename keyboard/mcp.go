@@ -0,0 +1,677 @@
+package keyboard
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// mcpProtocolVersion is the Model Context Protocol revision requested
+const mcpProtocolVersion = "2025-03-26"
+
+// mcpConnectTimeout bounds the handshake and discovery with one server
+const mcpConnectTimeout = 20 * time.Second
+
+// mcpMaxResourcesListed bounds the resources described to the model
+const mcpMaxResourcesListed = 50
+
+// mcpInheritedEnv are the variables servers started as commands inherit;
+// the rest of the environment, such as OPENAI_API_KEY, is not passed on
+var mcpInheritedEnv = []string{"HOME", "LOGNAME", "PATH", "SHELL", "TERM", "USER", "LANG", "TMPDIR", "XDG_RUNTIME_DIR"}
+
+// mcpRequest is an outgoing JSON-RPC request, or a notification without ID
+type mcpRequest struct {
+	JSONRPC string      `json:"jsonrpc"`
+	ID      *int64      `json:"id,omitempty"`
+	Method  string      `json:"method"`
+	Params  interface{} `json:"params,omitempty"`
+}
+
+// mcpMessage is an incoming JSON-RPC response, request or notification
+type mcpMessage struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id,omitempty"`
+	Method  string          `json:"method,omitempty"`
+	Params  json.RawMessage `json:"params,omitempty"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Error   *mcpError       `json:"error,omitempty"`
+}
+
+// mcpError is a JSON-RPC error object
+type mcpError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *mcpError) Error() string {
+	return fmt.Sprintf("%s (code %d)", e.Message, e.Code)
+}
+
+// mcpTransport exchanges JSON-RPC messages with a server
+type mcpTransport interface {
+	// roundTrip sends a request and waits for its response; notifications
+	// return as soon as they are sent
+	roundTrip(ctx context.Context, req mcpRequest) (*mcpMessage, error)
+	Close() error
+}
+
+// mcpStdioTransport talks to a server started as a child process, one JSON
+// message per line on its standard input and output
+type mcpStdioTransport struct {
+	cmd     *exec.Cmd
+	stdin   io.WriteCloser
+	writeMu sync.Mutex
+
+	mu      sync.Mutex
+	pending map[int64]chan *mcpMessage
+	done    chan struct{}
+	err     error
+}
+
+// startMCPStdio starts the server command with a minimal environment plus env
+func startMCPStdio(log *slog.Logger, command []string, env map[string]string) (*mcpStdioTransport, error) {
+	cmd, err := helperCommand(context.Background(), command[0], command[1:]...)
+	if err != nil {
+		return nil, err
+	}
+	cmd.Env = nil
+	for _, key := range mcpInheritedEnv {
+		if value, ok := os.LookupEnv(key); ok {
+			cmd.Env = append(cmd.Env, key+"="+value)
+		}
+	}
+	for key, value := range env {
+		cmd.Env = append(cmd.Env, key+"="+value)
+	}
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to start %s: %v", command[0], err)
+	}
+
+	t := &mcpStdioTransport{
+		cmd:     cmd,
+		stdin:   stdin,
+		pending: make(map[int64]chan *mcpMessage),
+		done:    make(chan struct{}),
+	}
+	go func() {
+		scanner := bufio.NewScanner(stderr)
+		for scanner.Scan() {
+			log.Debug("mcp server stderr", "line", scanner.Text())
+		}
+	}()
+	go t.readLoop(log, stdout)
+	return t, nil
+}
+
+// readLoop dispatches responses to the waiting requests until the server exits
+func (t *mcpStdioTransport) readLoop(log *slog.Logger, stdout io.Reader) {
+	scanner := bufio.NewScanner(stdout)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var msg mcpMessage
+		if err := json.Unmarshal(scanner.Bytes(), &msg); err != nil {
+			log.Debug("ignoring invalid mcp message", "error", err)
+			continue
+		}
+		switch {
+		case msg.Method != "" && len(msg.ID) > 0:
+			t.answerServerRequest(msg)
+		case msg.Method != "":
+			log.Debug("mcp notification", "method", msg.Method)
+		default:
+			var id int64
+			if err := json.Unmarshal(msg.ID, &id); err != nil {
+				continue
+			}
+			t.mu.Lock()
+			ch := t.pending[id]
+			delete(t.pending, id)
+			t.mu.Unlock()
+			if ch != nil {
+				ch <- &msg
+			}
+		}
+	}
+
+	t.mu.Lock()
+	t.err = fmt.Errorf("server exited")
+	if err := scanner.Err(); err != nil {
+		t.err = fmt.Errorf("failed to read from server: %v", err)
+	}
+	t.mu.Unlock()
+	close(t.done)
+}
+
+// answerServerRequest replies to requests from the server: pings succeed,
+// everything else (sampling, roots) is not supported
+func (t *mcpStdioTransport) answerServerRequest(msg mcpMessage) {
+	reply := map[string]interface{}{"jsonrpc": "2.0", "id": msg.ID}
+	if msg.Method == "ping" {
+		reply["result"] = struct{}{}
+	} else {
+		reply["error"] = mcpError{Code: -32601, Message: "method not supported"}
+	}
+	t.write(reply)
+}
+
+// write sends one message line
+func (t *mcpStdioTransport) write(msg interface{}) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	t.writeMu.Lock()
+	defer t.writeMu.Unlock()
+	if _, err := t.stdin.Write(append(data, '\n')); err != nil {
+		return fmt.Errorf("failed to write to server: %v", err)
+	}
+	return nil
+}
+
+func (t *mcpStdioTransport) roundTrip(ctx context.Context, req mcpRequest) (*mcpMessage, error) {
+	if req.ID == nil {
+		return nil, t.write(req)
+	}
+	ch := make(chan *mcpMessage, 1)
+	t.mu.Lock()
+	if t.err != nil {
+		t.mu.Unlock()
+		return nil, t.err
+	}
+	t.pending[*req.ID] = ch
+	t.mu.Unlock()
+
+	if err := t.write(req); err != nil {
+		t.forget(*req.ID)
+		return nil, err
+	}
+	select {
+	case msg := <-ch:
+		return msg, nil
+	case <-t.done:
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		return nil, t.err
+	case <-ctx.Done():
+		t.forget(*req.ID)
+		t.write(mcpRequest{JSONRPC: "2.0", Method: "notifications/cancelled",
+			Params: map[string]interface{}{"requestId": *req.ID, "reason": ctx.Err().Error()}})
+		return nil, ctx.Err()
+	}
+}
+
+// forget stops waiting for a response
+func (t *mcpStdioTransport) forget(id int64) {
+	t.mu.Lock()
+	delete(t.pending, id)
+	t.mu.Unlock()
+}
+
+// Close closes the server's input and stops it if it doesn't exit
+func (t *mcpStdioTransport) Close() error {
+	t.stdin.Close()
+	select {
+	case <-t.done:
+	case <-time.After(2 * time.Second):
+		t.cmd.Process.Kill()
+	}
+	return t.cmd.Wait()
+}
+
+// mcpHTTPTransport talks to a server over the streamable HTTP transport,
+// where each request is a POST answered with JSON or an event stream
+type mcpHTTPTransport struct {
+	url     string
+	headers map[string]string
+	client  *http.Client
+
+	mu        sync.Mutex
+	sessionID string
+}
+
+func (t *mcpHTTPTransport) roundTrip(ctx context.Context, req mcpRequest) (*mcpMessage, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, t.url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	t.setHeaders(httpReq)
+	httpReq.Header.Set("Content-Type", "application/json")
+	httpReq.Header.Set("Accept", "application/json, text/event-stream")
+
+	resp, err := t.client.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if id := resp.Header.Get("Mcp-Session-Id"); id != "" {
+		t.mu.Lock()
+		t.sessionID = id
+		t.mu.Unlock()
+	}
+	if resp.StatusCode/100 != 2 {
+		text, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return nil, fmt.Errorf("server returned %s: %s", resp.Status, strings.TrimSpace(string(text)))
+	}
+	if req.ID == nil {
+		return nil, nil
+	}
+
+	if strings.HasPrefix(resp.Header.Get("Content-Type"), "text/event-stream") {
+		return readMCPEventStream(resp.Body, *req.ID)
+	}
+	var msg mcpMessage
+	if err := json.NewDecoder(resp.Body).Decode(&msg); err != nil {
+		return nil, fmt.Errorf("invalid response: %v", err)
+	}
+	return &msg, nil
+}
+
+// readMCPEventStream reads server-sent events until the response to id
+func readMCPEventStream(body io.Reader, id int64) (*mcpMessage, error) {
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	var data []string
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "data:") {
+			data = append(data, strings.TrimPrefix(strings.TrimPrefix(line, "data:"), " "))
+			continue
+		}
+		if line != "" || len(data) == 0 {
+			continue
+		}
+		var msg mcpMessage
+		err := json.Unmarshal([]byte(strings.Join(data, "\n")), &msg)
+		data = nil
+		if err != nil || msg.Method != "" {
+			continue
+		}
+		var got int64
+		if json.Unmarshal(msg.ID, &got) == nil && got == id {
+			return &msg, nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return nil, fmt.Errorf("event stream ended without a response")
+}
+
+// setHeaders adds the configured headers and the session to a request
+func (t *mcpHTTPTransport) setHeaders(req *http.Request) {
+	for key, value := range t.headers {
+		req.Header.Set(key, value)
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.sessionID != "" {
+		req.Header.Set("Mcp-Session-Id", t.sessionID)
+		req.Header.Set("Mcp-Protocol-Version", mcpProtocolVersion)
+	}
+}
+
+// Close ends the session on the server
+func (t *mcpHTTPTransport) Close() error {
+	t.mu.Lock()
+	session := t.sessionID
+	t.mu.Unlock()
+	if session == "" {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, t.url, nil)
+	if err != nil {
+		return err
+	}
+	t.setHeaders(req)
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// MCPTool is a tool offered by an MCP server
+type MCPTool struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description"`
+	InputSchema json.RawMessage `json:"inputSchema"`
+}
+
+// MCPResource is a resource offered by an MCP server
+type MCPResource struct {
+	URI         string `json:"uri"`
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	MimeType    string `json:"mimeType,omitempty"`
+}
+
+// MCPClient is a connection to one MCP server
+type MCPClient struct {
+	name         string
+	transport    mcpTransport
+	nextID       atomic.Int64
+	capabilities struct {
+		Tools     *struct{} `json:"tools"`
+		Resources *struct{} `json:"resources"`
+	}
+}
+
+// ConnectMCP starts or connects to the server and performs the handshake
+func ConnectMCP(ctx context.Context, log *slog.Logger, config MCPServerConfig) (*MCPClient, error) {
+	var transport mcpTransport
+	if len(config.Command) > 0 {
+		stdio, err := startMCPStdio(log, config.Command, config.Env)
+		if err != nil {
+			return nil, err
+		}
+		transport = stdio
+	} else {
+		transport = &mcpHTTPTransport{url: config.URL, headers: config.Headers, client: &http.Client{}}
+	}
+
+	client := &MCPClient{name: config.Name, transport: transport}
+	var result struct {
+		ProtocolVersion string          `json:"protocolVersion"`
+		Capabilities    json.RawMessage `json:"capabilities"`
+		ServerInfo      struct {
+			Name    string `json:"name"`
+			Version string `json:"version"`
+		} `json:"serverInfo"`
+	}
+	err := client.call(ctx, "initialize", map[string]interface{}{
+		"protocolVersion": mcpProtocolVersion,
+		"capabilities":    map[string]interface{}{},
+		"clientInfo":      map[string]string{"name": "keygeist", "version": "1.0"},
+	}, &result)
+	if err == nil {
+		err = json.Unmarshal(result.Capabilities, &client.capabilities)
+	}
+	if err == nil {
+		_, err = transport.roundTrip(ctx, mcpRequest{JSONRPC: "2.0", Method: "notifications/initialized"})
+	}
+	if err != nil {
+		transport.Close()
+		return nil, fmt.Errorf("mcp server %s: initialize failed: %v", config.Name, err)
+	}
+	log.Info("connected to mcp server",
+		"name", result.ServerInfo.Name, "version", result.ServerInfo.Version, "protocol", result.ProtocolVersion)
+	return client, nil
+}
+
+// call sends a request and decodes its result
+func (c *MCPClient) call(ctx context.Context, method string, params, result interface{}) error {
+	id := c.nextID.Add(1)
+	msg, err := c.transport.roundTrip(ctx, mcpRequest{JSONRPC: "2.0", ID: &id, Method: method, Params: params})
+	if err != nil {
+		return err
+	}
+	if msg.Error != nil {
+		return msg.Error
+	}
+	if result == nil {
+		return nil
+	}
+	return json.Unmarshal(msg.Result, result)
+}
+
+// ListTools returns the tools of the server, following pagination
+func (c *MCPClient) ListTools(ctx context.Context) ([]MCPTool, error) {
+	var tools []MCPTool
+	cursor := ""
+	for {
+		var page struct {
+			Tools      []MCPTool `json:"tools"`
+			NextCursor string    `json:"nextCursor"`
+		}
+		if err := c.call(ctx, "tools/list", mcpCursor(cursor), &page); err != nil {
+			return nil, err
+		}
+		tools = append(tools, page.Tools...)
+		if page.NextCursor == "" {
+			return tools, nil
+		}
+		cursor = page.NextCursor
+	}
+}
+
+// ListResources returns the resources of the server, following pagination
+func (c *MCPClient) ListResources(ctx context.Context) ([]MCPResource, error) {
+	var resources []MCPResource
+	cursor := ""
+	for {
+		var page struct {
+			Resources  []MCPResource `json:"resources"`
+			NextCursor string        `json:"nextCursor"`
+		}
+		if err := c.call(ctx, "resources/list", mcpCursor(cursor), &page); err != nil {
+			return nil, err
+		}
+		resources = append(resources, page.Resources...)
+		if page.NextCursor == "" {
+			return resources, nil
+		}
+		cursor = page.NextCursor
+	}
+}
+
+// mcpCursor builds the params of a paginated list request
+func mcpCursor(cursor string) interface{} {
+	if cursor == "" {
+		return nil
+	}
+	return map[string]string{"cursor": cursor}
+}
+
+// mcpContent is an item of a tool result or resource
+type mcpContent struct {
+	Type     string `json:"type"`
+	Text     string `json:"text"`
+	URI      string `json:"uri"`
+	MimeType string `json:"mimeType"`
+	Blob     string `json:"blob"`
+	Resource *struct {
+		URI  string `json:"uri"`
+		Text string `json:"text"`
+	} `json:"resource"`
+}
+
+// text renders the content for the model, leaving out binary data
+func (mc mcpContent) text() string {
+	switch {
+	case mc.Resource != nil:
+		return mc.Resource.Text
+	case mc.Type == "image" || mc.Type == "audio" || mc.Blob != "":
+		return fmt.Sprintf("[%s content omitted]", strings.TrimSpace(mc.Type+" "+mc.MimeType))
+	}
+	return mc.Text
+}
+
+// joinMCPContent renders a list of content items
+func joinMCPContent(content []mcpContent) string {
+	parts := make([]string, 0, len(content))
+	for _, item := range content {
+		parts = append(parts, item.text())
+	}
+	return strings.Join(parts, "\n")
+}
+
+// CallTool runs a tool and returns its text content; results flagged as
+// errors are returned as errors
+func (c *MCPClient) CallTool(ctx context.Context, name string, arguments json.RawMessage) (string, error) {
+	var result struct {
+		Content []mcpContent `json:"content"`
+		IsError bool         `json:"isError"`
+	}
+	if err := c.call(ctx, "tools/call", map[string]interface{}{"name": name, "arguments": arguments}, &result); err != nil {
+		return "", err
+	}
+	text := joinMCPContent(result.Content)
+	if result.IsError {
+		return "", fmt.Errorf("%s", text)
+	}
+	return text, nil
+}
+
+// ReadResource returns the text contents of a resource
+func (c *MCPClient) ReadResource(ctx context.Context, uri string) (string, error) {
+	var result struct {
+		Contents []mcpContent `json:"contents"`
+	}
+	if err := c.call(ctx, "resources/read", map[string]string{"uri": uri}, &result); err != nil {
+		return "", err
+	}
+	return joinMCPContent(result.Contents), nil
+}
+
+// Close disconnects from the server, stopping it if it was started
+func (c *MCPClient) Close() error {
+	return c.transport.Close()
+}
+
+// invalidToolNameChars are replaced in the names given to the model
+var invalidToolNameChars = regexp.MustCompile(`[^a-zA-Z0-9_-]`)
+
+// mcpToolName prefixes a tool with its server, within the 64 characters
+// accepted by the API
+func mcpToolName(server, tool string) string {
+	name := invalidToolNameChars.ReplaceAllString(server+"__"+tool, "_")
+	if len(name) > 64 {
+		name = name[:64]
+	}
+	return name
+}
+
+// registerTools adds the allowed tools of the server to the registry, and
+// a read_resource tool when the server has resources. Tools whose name is
+// already taken, possibly after shortening, are skipped.
+func (c *MCPClient) registerTools(ctx context.Context, log *slog.Logger, registry *ToolRegistry, config MCPServerConfig) (int, error) {
+	count := 0
+	if c.capabilities.Tools != nil {
+		tools, err := c.ListTools(ctx)
+		if err != nil {
+			return 0, fmt.Errorf("failed to list tools: %v", err)
+		}
+		for _, tool := range tools {
+			if len(config.Tools) > 0 && !containsString(config.Tools, tool.Name) {
+				continue
+			}
+			schema := tool.InputSchema
+			if len(schema) == 0 {
+				schema = json.RawMessage(`{"type":"object","properties":{}}`)
+			}
+			name := tool.Name
+			err := registry.Register(Tool{
+				Name:        mcpToolName(config.Name, name),
+				Description: fmt.Sprintf("[%s] %s", config.Name, tool.Description),
+				Parameters:  schema,
+				Confirm:     config.Confirm != ConfirmNever,
+				Run: func(ctx context.Context, env ToolEnv, arguments json.RawMessage) (string, error) {
+					return c.CallTool(ctx, name, arguments)
+				},
+			})
+			if err != nil {
+				log.Warn("skipping mcp tool", "tool", name, "error", err)
+				continue
+			}
+			count++
+		}
+	}
+
+	if c.capabilities.Resources != nil {
+		resources, err := c.ListResources(ctx)
+		if err != nil {
+			return count, fmt.Errorf("failed to list resources: %v", err)
+		}
+		if len(resources) > 0 {
+			if err := registry.Register(c.resourceTool(config, resources)); err != nil {
+				log.Warn("skipping mcp resources", "error", err)
+			} else {
+				count++
+			}
+		}
+	}
+	return count, nil
+}
+
+// resourceTool describes the resources of the server in a tool reading them
+func (c *MCPClient) resourceTool(config MCPServerConfig, resources []MCPResource) Tool {
+	var lines []string
+	for i, resource := range resources {
+		if i == mcpMaxResourcesListed {
+			lines = append(lines, fmt.Sprintf("- and %d more", len(resources)-i))
+			break
+		}
+		line := fmt.Sprintf("- %s (%s)", resource.URI, resource.Name)
+		if resource.Description != "" {
+			line += ": " + resource.Description
+		}
+		lines = append(lines, line)
+	}
+	return Tool{
+		Name:        mcpToolName(config.Name, "read_resource"),
+		Description: fmt.Sprintf("[%s] Read a resource by URI. Available resources:\n%s", config.Name, strings.Join(lines, "\n")),
+		Parameters:  json.RawMessage(`{"type":"object","properties":{"uri":{"type":"string","description":"URI of the resource"}},"required":["uri"]}`),
+		Confirm:     config.Confirm != ConfirmNever,
+		Run: func(ctx context.Context, env ToolEnv, arguments json.RawMessage) (string, error) {
+			var args struct {
+				URI string `json:"uri"`
+			}
+			if err := json.Unmarshal(arguments, &args); err != nil {
+				return "", fmt.Errorf("invalid arguments: %v", err)
+			}
+			return c.ReadResource(ctx, args.URI)
+		},
+	}
+}
+
+// ConnectMCPServers connects to the configured MCP servers and offers their
+// tools and resources to the model. Servers that fail are skipped.
+func (ko *KeyboardOperator) ConnectMCPServers() {
+	for _, config := range ko.fileConfig.MCPServers {
+		log := ko.logger.With("server", config.Name)
+		ctx, cancel := context.WithTimeout(context.Background(), mcpConnectTimeout)
+		client, err := ConnectMCP(ctx, log, config)
+		if err != nil {
+			cancel()
+			log.Warn("mcp server unavailable", "error", err)
+			continue
+		}
+		count, err := client.registerTools(ctx, log, ko.tools, config)
+		cancel()
+		if err != nil {
+			log.Warn("mcp server discovery failed", "error", err)
+		}
+		log.Info("mcp tools registered", "tools", count)
+		ko.mcpClients = append(ko.mcpClients, client)
+	}
+}
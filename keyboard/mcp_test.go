@@ -0,0 +1,366 @@
+package keyboard
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// stubMCPResponse answers a request like a small MCP server: two pages of
+// tools, one resource, and tools that echo, fail or report the environment.
+// Notifications get no response.
+func stubMCPResponse(msg mcpMessage) map[string]interface{} {
+	if len(msg.ID) == 0 {
+		return nil
+	}
+	var params struct {
+		Cursor    string          `json:"cursor"`
+		Name      string          `json:"name"`
+		Arguments json.RawMessage `json:"arguments"`
+		URI       string          `json:"uri"`
+	}
+	json.Unmarshal(msg.Params, &params)
+	text := func(text string) []map[string]string {
+		return []map[string]string{{"type": "text", "text": text}}
+	}
+
+	var result interface{}
+	switch msg.Method {
+	case "initialize":
+		result = map[string]interface{}{
+			"protocolVersion": mcpProtocolVersion,
+			"capabilities":    map[string]interface{}{"tools": map[string]interface{}{}, "resources": map[string]interface{}{}},
+			"serverInfo":      map[string]string{"name": "stub", "version": "1.0"},
+		}
+	case "tools/list":
+		if params.Cursor == "" {
+			result = map[string]interface{}{
+				"tools":      []MCPTool{{Name: "echo", Description: "Echo the text"}},
+				"nextCursor": "page2",
+			}
+		} else {
+			result = map[string]interface{}{
+				"tools": []MCPTool{{Name: "fail", Description: "Always fails"}, {Name: "env", Description: "Print a variable"}},
+			}
+		}
+	case "tools/call":
+		var args struct {
+			Text string `json:"text"`
+			Name string `json:"name"`
+		}
+		json.Unmarshal(params.Arguments, &args)
+		switch params.Name {
+		case "echo":
+			result = map[string]interface{}{"content": text(args.Text)}
+		case "fail":
+			result = map[string]interface{}{"content": text("boom"), "isError": true}
+		case "env":
+			result = map[string]interface{}{"content": text(args.Name + "=" + os.Getenv(args.Name))}
+		default:
+			return map[string]interface{}{"jsonrpc": "2.0", "id": msg.ID, "error": mcpError{Code: -32602, Message: "unknown tool"}}
+		}
+	case "resources/list":
+		result = map[string]interface{}{"resources": []MCPResource{{URI: "note://todo", Name: "todo"}}}
+	case "resources/read":
+		result = map[string]interface{}{"contents": []map[string]string{{"uri": params.URI, "text": "buy milk"}}}
+	default:
+		return map[string]interface{}{"jsonrpc": "2.0", "id": msg.ID, "error": mcpError{Code: -32601, Message: "method not found"}}
+	}
+	return map[string]interface{}{"jsonrpc": "2.0", "id": msg.ID, "result": result}
+}
+
+// TestMCPStubServer is not a test: it serves stubMCPResponse on standard
+// input and output when the test binary is started as an MCP server
+func TestMCPStubServer(t *testing.T) {
+	if os.Getenv("KEYGEIST_MCP_STUB") != "1" {
+		t.Skip("only runs as a stub MCP server")
+	}
+	scanner := bufio.NewScanner(os.Stdin)
+	for scanner.Scan() {
+		var msg mcpMessage
+		if err := json.Unmarshal(scanner.Bytes(), &msg); err != nil {
+			continue
+		}
+		if response := stubMCPResponse(msg); response != nil {
+			data, _ := json.Marshal(response)
+			os.Stdout.Write(append(data, '\n'))
+		}
+	}
+	os.Exit(0)
+}
+
+// testLogger discards log output
+func testLogger() *slog.Logger {
+	return slog.New(slog.NewTextHandler(io.Discard, nil))
+}
+
+// checkMCPClient exercises discovery, calls and resources on a stub server
+func checkMCPClient(t *testing.T, config MCPServerConfig) *MCPClient {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	client, err := ConnectMCP(ctx, testLogger(), config)
+	if err != nil {
+		t.Fatalf("ConnectMCP: %v", err)
+	}
+	t.Cleanup(func() { client.Close() })
+
+	tools, err := client.ListTools(ctx)
+	if err != nil {
+		t.Fatalf("ListTools: %v", err)
+	}
+	var names []string
+	for _, tool := range tools {
+		names = append(names, tool.Name)
+	}
+	if got := strings.Join(names, ","); got != "echo,fail,env" {
+		t.Errorf("tools across pages = %s, want echo,fail,env", got)
+	}
+
+	if got, err := client.CallTool(ctx, "echo", json.RawMessage(`{"text":"hello"}`)); err != nil || got != "hello" {
+		t.Errorf("CallTool(echo) = %q, %v; want hello", got, err)
+	}
+	if _, err := client.CallTool(ctx, "fail", json.RawMessage(`{}`)); err == nil || err.Error() != "boom" {
+		t.Errorf("CallTool(fail) error = %v, want boom", err)
+	}
+	if _, err := client.CallTool(ctx, "missing", json.RawMessage(`{}`)); err == nil || !strings.Contains(err.Error(), "unknown tool") {
+		t.Errorf("CallTool(missing) error = %v, want the JSON-RPC error", err)
+	}
+	if got, err := client.ReadResource(ctx, "note://todo"); err != nil || got != "buy milk" {
+		t.Errorf("ReadResource = %q, %v; want buy milk", got, err)
+	}
+	return client
+}
+
+func TestMCPStdioTransport(t *testing.T) {
+	t.Setenv("KEYGEIST_ALLOW_ROOT_HELPERS", "1")
+	t.Setenv("OPENAI_API_KEY", "secret")
+	config := MCPServerConfig{
+		Name:    "stub",
+		Command: []string{os.Args[0], "-test.run=^TestMCPStubServer$"},
+		Env:     map[string]string{"KEYGEIST_MCP_STUB": "1", "STUB_TOKEN": "token"},
+	}
+	client := checkMCPClient(t, config)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	for variable, want := range map[string]string{"OPENAI_API_KEY": "", "STUB_TOKEN": "token", "PATH": os.Getenv("PATH")} {
+		got, err := client.CallTool(ctx, "env", json.RawMessage(fmt.Sprintf(`{"name":%q}`, variable)))
+		if err != nil || got != variable+"="+want {
+			t.Errorf("server sees %q, %v; want %s=%s", got, err, variable, want)
+		}
+	}
+}
+
+// stubMCPHTTPServer serves stubMCPResponse over the streamable HTTP
+// transport, answering with an event stream when stream is set
+func stubMCPHTTPServer(t *testing.T, stream bool) (*httptest.Server, *[]string) {
+	var mu sync.Mutex
+	var log []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if r.Header.Get("Authorization") != "Bearer test" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		session := r.Header.Get("Mcp-Session-Id")
+		if r.Method == http.MethodDelete {
+			log = append(log, "DELETE "+session)
+			return
+		}
+		var msg mcpMessage
+		if err := json.NewDecoder(r.Body).Decode(&msg); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		log = append(log, msg.Method+" "+session)
+		if msg.Method == "initialize" {
+			w.Header().Set("Mcp-Session-Id", "session-1")
+		}
+		response := stubMCPResponse(msg)
+		if response == nil {
+			w.WriteHeader(http.StatusAccepted)
+			return
+		}
+		data, _ := json.Marshal(response)
+		if !stream {
+			w.Header().Set("Content-Type", "application/json")
+			w.Write(data)
+			return
+		}
+		// A notification and a multi-line event precede the response
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, "event: message\ndata: {\"jsonrpc\":\"2.0\",\"method\":\"notifications/progress\"}\n\n")
+		fmt.Fprint(w, ": keep-alive\n\n")
+		lines := strings.SplitAfter(string(data), ",")
+		for _, line := range lines {
+			fmt.Fprintf(w, "data: %s\n", line)
+		}
+		fmt.Fprint(w, "\n")
+	}))
+	t.Cleanup(server.Close)
+	return server, &log
+}
+
+func TestMCPHTTPTransport(t *testing.T) {
+	for _, stream := range []bool{false, true} {
+		t.Run(fmt.Sprintf("stream=%v", stream), func(t *testing.T) {
+			server, log := stubMCPHTTPServer(t, stream)
+			client := checkMCPClient(t, MCPServerConfig{
+				Name:    "stub",
+				URL:     server.URL,
+				Headers: map[string]string{"Authorization": "Bearer test"},
+			})
+			client.Close()
+
+			want := []string{
+				"initialize ",
+				"notifications/initialized session-1",
+				"tools/list session-1",
+				"tools/list session-1",
+			}
+			if len(*log) < len(want) {
+				t.Fatalf("requests = %q, want them to start with %q", *log, want)
+			}
+			for i := range want {
+				if (*log)[i] != want[i] {
+					t.Errorf("request %d = %q, want %q", i, (*log)[i], want[i])
+				}
+			}
+			if last := (*log)[len(*log)-1]; last != "DELETE session-1" {
+				t.Errorf("last request = %q, want the session to be deleted", last)
+			}
+		})
+	}
+}
+
+func TestMCPHTTPTransportErrors(t *testing.T) {
+	server, _ := stubMCPHTTPServer(t, false)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	_, err := ConnectMCP(ctx, testLogger(), MCPServerConfig{Name: "stub", URL: server.URL})
+	if err == nil || !strings.Contains(err.Error(), "401") {
+		t.Errorf("ConnectMCP without credentials error = %v, want the HTTP status", err)
+	}
+}
+
+func TestMCPRegisterToolsConfirmsByDefault(t *testing.T) {
+	server, _ := stubMCPHTTPServer(t, false)
+	for _, test := range []struct {
+		confirm ConfirmMode
+		want    bool
+	}{
+		{"", true},
+		{ConfirmAlways, true},
+		{ConfirmNever, false},
+	} {
+		config := MCPServerConfig{
+			Name:    "stub",
+			URL:     server.URL,
+			Headers: map[string]string{"Authorization": "Bearer test"},
+			Tools:   []string{"echo", "fail"},
+			Confirm: test.confirm,
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		client, err := ConnectMCP(ctx, testLogger(), config)
+		if err != nil {
+			cancel()
+			t.Fatalf("ConnectMCP: %v", err)
+		}
+		registry := NewToolRegistry(ToolsConfig{})
+		count, err := client.registerTools(ctx, testLogger(), registry, config)
+		cancel()
+		client.Close()
+		if err != nil {
+			t.Fatalf("registerTools: %v", err)
+		}
+
+		names := registry.Names()
+		if count != 3 || strings.Join(names, ",") != "stub__echo,stub__fail,stub__read_resource" {
+			t.Errorf("registered %d tools %v, want stub__echo, stub__fail and stub__read_resource", count, names)
+		}
+		for _, name := range names {
+			if got := registry.lookup(name).Confirm; got != test.want {
+				t.Errorf("confirm %q: %s.Confirm = %v, want %v", test.confirm, name, got, test.want)
+			}
+		}
+	}
+}
+
+func TestMCPRegisterToolsKeepsTakenNames(t *testing.T) {
+	server, _ := stubMCPHTTPServer(t, false)
+	registry := NewToolRegistry(ToolsConfig{})
+	// Both names become my_server once sanitized
+	for i, name := range []string{"my.server", "my_server"} {
+		config := MCPServerConfig{
+			Name:    name,
+			URL:     server.URL,
+			Headers: map[string]string{"Authorization": "Bearer test"},
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		client, err := ConnectMCP(ctx, testLogger(), config)
+		if err != nil {
+			cancel()
+			t.Fatalf("ConnectMCP: %v", err)
+		}
+		count, err := client.registerTools(ctx, testLogger(), registry, config)
+		cancel()
+		client.Close()
+		if err != nil {
+			t.Fatalf("registerTools: %v", err)
+		}
+		if want := []int{4, 0}[i]; count != want {
+			t.Errorf("server %s registered %d tools, want %d", name, count, want)
+		}
+	}
+	if got := registry.lookup("my_server__echo").Description; !strings.HasPrefix(got, "[my.server]") {
+		t.Errorf("my_server__echo is %q, want the tool of the first server", got)
+	}
+}
+
+func TestMCPInputGoesThroughOperator(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keygeist.sock")
+	t.Setenv("KEYGEIST_CONTROL_SOCKET", path)
+	client := &KeyboardOperator{logger: testLogger(), interactions: newInteractionManager(1)}
+
+	// Without a running operator, the input is sent locally
+	sent := false
+	if err := client.sendInput(context.Background(), "type", "aGk=", func() error { sent = true; return nil }); err != nil || !sent {
+		t.Fatalf("sendInput without an operator: sent %v, %v", sent, err)
+	}
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := NewControlServer(listener)
+	defer server.Close()
+	operator := &KeyboardOperator{logger: testLogger(), interactions: newInteractionManager(1)}
+	operator.registerInputCommands(server)
+	go server.Serve()
+
+	// A paused operator refuses input, which is then not sent locally either
+	operator.paused.Store(true)
+	for _, command := range []string{"type", "press"} {
+		err := client.sendInput(context.Background(), command, "aGk=", func() error {
+			t.Errorf("%s was sent locally while the operator runs", command)
+			return nil
+		})
+		if err == nil || !strings.Contains(err.Error(), "paused") {
+			t.Errorf("%s while paused: error = %v, want the operator's refusal", command, err)
+		}
+	}
+}
@@ -0,0 +1,411 @@
+package keyboard
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// mcpMaxTypedChars bounds the text type_text types, so that the
+// confirmation dialog can show all of it
+const mcpMaxTypedChars = 500
+
+// mcpInputTimeout bounds the wait for the operator's typing slot
+const mcpInputTimeout = time.Minute
+
+// mcpSupportedVersions are the protocol revisions the server can speak
+var mcpSupportedVersions = []string{"2024-11-05", "2025-03-26", "2025-06-18"}
+
+// mcpServeContent is an item of a tool result sent by the server
+type mcpServeContent struct {
+	Type     string `json:"type"`
+	Text     string `json:"text,omitempty"`
+	Data     string `json:"data,omitempty"`
+	MimeType string `json:"mimeType,omitempty"`
+}
+
+// mcpServeTool is a tool offered to MCP clients
+type mcpServeTool struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description"`
+	InputSchema json.RawMessage `json:"inputSchema"`
+	// injects marks tools sending input, which are confirmed by default
+	injects bool
+	run     func(ctx context.Context, arguments json.RawMessage) ([]mcpServeContent, error)
+	// question describes a call in the confirmation dialog
+	question func(arguments json.RawMessage) string
+	// check rejects arguments before the confirmation, if set
+	check func(arguments json.RawMessage) error
+}
+
+// MCPServeTools lists the tools "keygeist mcp" can offer
+var MCPServeTools = []string{"type_text", "press_hotkey", "get_clipboard", "take_screenshot", "get_active_window"}
+
+// mcpServeTools builds the tools offered by ServeMCP
+func (ko *KeyboardOperator) mcpServeTools() map[string]*mcpServeTool {
+	text := func(s string) []mcpServeContent {
+		return []mcpServeContent{{Type: "text", Text: s}}
+	}
+	return map[string]*mcpServeTool{
+		"type_text": {
+			Name:        "type_text",
+			Description: "Type text into the focused window with an emulated keyboard",
+			InputSchema: json.RawMessage(`{"type":"object","properties":{"text":{"type":"string"}},"required":["text"]}`),
+			injects:     true,
+			question: func(arguments json.RawMessage) string {
+				var args struct {
+					Text string `json:"text"`
+				}
+				json.Unmarshal(arguments, &args)
+				return "Allow an MCP client to type this text?\n\n" + args.Text
+			},
+			// The whole text must fit in the dialog, or hidden input
+			// would be typed without approval
+			check: func(arguments json.RawMessage) error {
+				var args struct {
+					Text string `json:"text"`
+				}
+				if err := json.Unmarshal(arguments, &args); err != nil {
+					return fmt.Errorf("invalid arguments: %v", err)
+				}
+				if utf8.RuneCountInString(args.Text) > mcpMaxTypedChars {
+					return fmt.Errorf("text longer than %d characters; split it into several calls", mcpMaxTypedChars)
+				}
+				return nil
+			},
+			run: func(ctx context.Context, arguments json.RawMessage) ([]mcpServeContent, error) {
+				var args struct {
+					Text string `json:"text"`
+				}
+				if err := json.Unmarshal(arguments, &args); err != nil {
+					return nil, fmt.Errorf("invalid arguments: %v", err)
+				}
+				encoded := base64.StdEncoding.EncodeToString([]byte(args.Text))
+				if err := ko.sendInput(ctx, "type", encoded, func() error {
+					return ko.emulator.TypeText(args.Text)
+				}); err != nil {
+					return nil, err
+				}
+				return text(fmt.Sprintf("typed %d characters", len([]rune(args.Text)))), nil
+			},
+		},
+		"press_hotkey": {
+			Name:        "press_hotkey",
+			Description: "Press a key combination such as ctrl+shift+t or enter",
+			InputSchema: json.RawMessage(`{"type":"object","properties":{"keys":{"type":"string","description":"Keys joined with +"}},"required":["keys"]}`),
+			injects:     true,
+			question: func(arguments json.RawMessage) string {
+				var args struct {
+					Keys string `json:"keys"`
+				}
+				json.Unmarshal(arguments, &args)
+				return "Allow an MCP client to press " + args.Keys + "?"
+			},
+			run: func(ctx context.Context, arguments json.RawMessage) ([]mcpServeContent, error) {
+				var args struct {
+					Keys string `json:"keys"`
+				}
+				if err := json.Unmarshal(arguments, &args); err != nil {
+					return nil, fmt.Errorf("invalid arguments: %v", err)
+				}
+				if _, err := ParseKeyCombination(args.Keys); err != nil {
+					return nil, err
+				}
+				if err := ko.sendInput(ctx, "press", args.Keys, func() error {
+					return ko.pressKeys(args.Keys)
+				}); err != nil {
+					return nil, err
+				}
+				return text("pressed " + args.Keys), nil
+			},
+		},
+		"get_clipboard": {
+			Name:        "get_clipboard",
+			Description: "Get the text on the clipboard",
+			InputSchema: json.RawMessage(`{"type":"object","properties":{}}`),
+			question: func(json.RawMessage) string {
+				return "Allow an MCP client to read the clipboard?"
+			},
+			run: func(ctx context.Context, arguments json.RawMessage) ([]mcpServeContent, error) {
+				content, err := ko.clipboard.Read()
+				if err != nil {
+					return nil, err
+				}
+				return text(content), nil
+			},
+		},
+		"take_screenshot": {
+			Name:        "take_screenshot",
+			Description: "Take a PNG screenshot of every display",
+			InputSchema: json.RawMessage(`{"type":"object","properties":{}}`),
+			question: func(json.RawMessage) string {
+				return "Allow an MCP client to take a screenshot?"
+			},
+			run: func(ctx context.Context, arguments json.RawMessage) ([]mcpServeContent, error) {
+				screenshots, err := ko.takeScreenshotBase64(ko.logger)
+				if err != nil {
+					return nil, err
+				}
+				if len(screenshots) == 0 {
+					return nil, fmt.Errorf("no display captured")
+				}
+				var content []mcpServeContent
+				for _, screenshot := range screenshots {
+					content = append(content, mcpServeContent{Type: "image", Data: screenshot, MimeType: "image/png"})
+				}
+				return content, nil
+			},
+		},
+		"get_active_window": {
+			Name:        "get_active_window",
+			Description: "Get the ID, class and title of the focused window",
+			InputSchema: json.RawMessage(`{"type":"object","properties":{}}`),
+			question: func(json.RawMessage) string {
+				return "Allow an MCP client to read the focused window?"
+			},
+			run: func(ctx context.Context, arguments json.RawMessage) ([]mcpServeContent, error) {
+				window, err := ActiveWindow()
+				if err != nil {
+					return nil, err
+				}
+				data, err := json.Marshal(map[string]string{"id": window.ID, "class": window.Class, "title": window.Title})
+				if err != nil {
+					return nil, err
+				}
+				return text(string(data)), nil
+			},
+		},
+	}
+}
+
+// sendInput runs an input command for an MCP client. When the operator is
+// running, the command goes through its control socket, so that the input
+// takes turns with the operator's own typing and is refused while it is
+// paused; otherwise send types with this process's keyboard device.
+func (ko *KeyboardOperator) sendInput(ctx context.Context, command, argument string, send func() error) error {
+	if _, err := ControlRequest("ping"); err != nil {
+		// No operator to take turns with
+		return ko.injectInput(ctx, send)
+	}
+	_, err := ControlRequest(command, argument)
+	return err
+}
+
+// injectInput runs send in the typing slot, unless hotkeys are paused
+func (ko *KeyboardOperator) injectInput(ctx context.Context, send func() error) error {
+	if ko.Paused() {
+		return fmt.Errorf("keygeist is paused")
+	}
+	if err := acquire(ctx, ko.interactions.typing); err != nil {
+		return err
+	}
+	defer release(ko.interactions.typing)
+	return send()
+}
+
+// pressKeys presses a key combination such as ctrl+shift+t
+func (ko *KeyboardOperator) pressKeys(combination string) error {
+	keys, err := ParseKeyCombination(combination)
+	if err != nil {
+		return err
+	}
+	codes := make([]int, len(keys))
+	for i, key := range keys {
+		codes[i] = int(key)
+	}
+	return ko.emulator.PressHotkey(codes...)
+}
+
+// registerInputCommands adds the type and press commands used by
+// "keygeist mcp" to a control server. Text is base64 encoded, since
+// commands are split at spaces.
+func (ko *KeyboardOperator) registerInputCommands(cs *ControlServer) {
+	cs.Handle("type", func(args []string) (interface{}, error) {
+		if len(args) != 1 {
+			return nil, fmt.Errorf("usage: type <base64 text>")
+		}
+		data, err := base64.StdEncoding.DecodeString(args[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid text: %v", err)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), mcpInputTimeout)
+		defer cancel()
+		if err := ko.injectInput(ctx, func() error { return ko.emulator.TypeText(string(data)) }); err != nil {
+			return nil, err
+		}
+		return map[string]int{"typed": utf8.RuneCount(data)}, nil
+	})
+	cs.Handle("press", func(args []string) (interface{}, error) {
+		if len(args) != 1 {
+			return nil, fmt.Errorf("usage: press <keys>")
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), mcpInputTimeout)
+		defer cancel()
+		if err := ko.injectInput(ctx, func() error { return ko.pressKeys(args[0]) }); err != nil {
+			return nil, err
+		}
+		return map[string]string{"pressed": args[0]}, nil
+	})
+}
+
+// confirm reports whether calls to the tool need the user's approval; tools
+// sending input do unless set to "never"
+func (mc MCPServeConfig) confirm(name string, injects bool) bool {
+	switch mc.Confirm[name] {
+	case ConfirmAlways:
+		return true
+	case ConfirmNever:
+		return false
+	}
+	return injects
+}
+
+// ServeMCP runs an MCP server on r and w, one JSON message per line, until
+// r is closed. Only the tools allowed in the mcp_serve configuration are
+// offered; calls are confirmed by the user when configured, and always
+// for tools sending input unless their confirm mode is "never".
+func (ko *KeyboardOperator) ServeMCP(ctx context.Context, r io.Reader, w io.Writer) error {
+	config := ko.fileConfig.MCPServe
+	all := ko.mcpServeTools()
+	tools := make(map[string]*mcpServeTool)
+	var listed []*mcpServeTool
+	for _, name := range MCPServeTools {
+		if len(config.Allow) > 0 && !containsString(config.Allow, name) {
+			continue
+		}
+		tools[name] = all[name]
+		listed = append(listed, all[name])
+	}
+	ko.logger.Info("serving mcp", "tools", len(listed))
+
+	var writeMu sync.Mutex
+	reply := func(id json.RawMessage, result interface{}, rpcErr *mcpError) {
+		msg := map[string]interface{}{"jsonrpc": "2.0", "id": id}
+		if rpcErr != nil {
+			msg["error"] = rpcErr
+		} else {
+			msg["result"] = result
+		}
+		data, err := json.Marshal(msg)
+		if err != nil {
+			ko.logger.Error("failed to encode mcp response", "error", err)
+			return
+		}
+		writeMu.Lock()
+		defer writeMu.Unlock()
+		w.Write(append(data, '\n'))
+	}
+
+	// When the client goes away, pending calls are cancelled and awaited
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var msg mcpMessage
+		if err := json.Unmarshal(scanner.Bytes(), &msg); err != nil {
+			reply(json.RawMessage("null"), nil, &mcpError{Code: -32700, Message: "parse error"})
+			continue
+		}
+		if len(msg.ID) == 0 {
+			// Notifications need no answer
+			continue
+		}
+
+		switch msg.Method {
+		case "initialize":
+			var params struct {
+				ProtocolVersion string `json:"protocolVersion"`
+				ClientInfo      struct {
+					Name string `json:"name"`
+				} `json:"clientInfo"`
+			}
+			json.Unmarshal(msg.Params, &params)
+			version := mcpProtocolVersion
+			if containsString(mcpSupportedVersions, params.ProtocolVersion) {
+				version = params.ProtocolVersion
+			}
+			ko.logger.Info("mcp client connected", "client", params.ClientInfo.Name, "protocol", version)
+			reply(msg.ID, map[string]interface{}{
+				"protocolVersion": version,
+				"capabilities":    map[string]interface{}{"tools": map[string]interface{}{}},
+				"serverInfo":      map[string]string{"name": "keygeist", "version": "1.0"},
+			}, nil)
+		case "ping":
+			reply(msg.ID, struct{}{}, nil)
+		case "tools/list":
+			reply(msg.ID, map[string]interface{}{"tools": listed}, nil)
+		case "tools/call":
+			wg.Add(1)
+			go func(msg mcpMessage) {
+				defer wg.Done()
+				result, rpcErr := ko.callMCPServeTool(ctx, tools, msg.Params)
+				reply(msg.ID, result, rpcErr)
+			}(msg)
+		default:
+			reply(msg.ID, nil, &mcpError{Code: -32601, Message: "method not found: " + msg.Method})
+		}
+	}
+	return scanner.Err()
+}
+
+// callMCPServeTool runs a tools/call request after the confirmation gate
+func (ko *KeyboardOperator) callMCPServeTool(ctx context.Context, tools map[string]*mcpServeTool, params json.RawMessage) (interface{}, *mcpError) {
+	var call struct {
+		Name      string          `json:"name"`
+		Arguments json.RawMessage `json:"arguments"`
+	}
+	if err := json.Unmarshal(params, &call); err != nil {
+		return nil, &mcpError{Code: -32602, Message: "invalid params"}
+	}
+	tool := tools[call.Name]
+	if tool == nil {
+		return nil, &mcpError{Code: -32602, Message: "unknown tool: " + call.Name}
+	}
+	if len(call.Arguments) == 0 {
+		call.Arguments = json.RawMessage("{}")
+	}
+	log := ko.logger.With("tool", call.Name)
+	failed := func(err error) (interface{}, *mcpError) {
+		log.Warn("mcp tool call failed", "error", err)
+		return map[string]interface{}{
+			"content": []mcpServeContent{{Type: "text", Text: err.Error()}},
+			"isError": true,
+		}, nil
+	}
+
+	if tool.check != nil {
+		if err := tool.check(call.Arguments); err != nil {
+			return failed(err)
+		}
+	}
+	if ko.fileConfig.MCPServe.confirm(call.Name, tool.injects) {
+		if err := acquire(ctx, ko.interactions.foreground); err != nil {
+			return failed(err)
+		}
+		allowed, err := ko.input.Confirm(ctx, tool.question(call.Arguments))
+		release(ko.interactions.foreground)
+		if err != nil {
+			return failed(fmt.Errorf("confirmation failed: %v", err))
+		}
+		if !allowed {
+			return failed(fmt.Errorf("the user denied this tool call"))
+		}
+	}
+
+	content, err := tool.run(ctx, call.Arguments)
+	if err != nil {
+		return failed(err)
+	}
+	log.Info("mcp tool call completed")
+	return map[string]interface{}{"content": content}, nil
+}
@@ -0,0 +1,242 @@
+package keyboard
+
+import (
+	"fmt"
+	"log/slog"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+)
+
+const (
+	notificationsService   = "org.freedesktop.Notifications"
+	notificationsPath      = "/org/freedesktop/Notifications"
+	notificationsInterface = "org.freedesktop.Notifications"
+	notificationAppName    = "Keygeist"
+)
+
+// NotificationUrgency is the urgency level of a desktop notification
+type NotificationUrgency byte
+
+const (
+	UrgencyLow      NotificationUrgency = 0
+	UrgencyNormal   NotificationUrgency = 1
+	UrgencyCritical NotificationUrgency = 2
+)
+
+// String returns the name notify-send uses for the urgency
+func (u NotificationUrgency) String() string {
+	switch u {
+	case UrgencyLow:
+		return "low"
+	case UrgencyCritical:
+		return "critical"
+	default:
+		return "normal"
+	}
+}
+
+// Notification is a desktop notification. A zero Timeout uses the server
+// default, a negative one keeps the notification until it is replaced.
+type Notification struct {
+	Summary string
+	Body    string
+	Urgency NotificationUrgency
+	Timeout time.Duration
+}
+
+// expireTimeout converts Timeout to the milliseconds used by the
+// notification specification (-1 default, 0 never)
+func (n Notification) expireTimeout() int32 {
+	switch {
+	case n.Timeout == 0:
+		return -1
+	case n.Timeout < 0:
+		return 0
+	default:
+		return int32(n.Timeout / time.Millisecond)
+	}
+}
+
+// Notifier shows desktop notifications. Each notification replaces the
+// previous one shown by the same notifier.
+type Notifier interface {
+	Notify(n Notification) error
+	Dismiss() error
+	Close() error
+}
+
+// NoopNotifier discards notifications
+type NoopNotifier struct{}
+
+func (NoopNotifier) Notify(Notification) error { return nil }
+func (NoopNotifier) Dismiss() error            { return nil }
+func (NoopNotifier) Close() error              { return nil }
+
+// DBusNotifier talks to org.freedesktop.Notifications on a D-Bus connection
+type DBusNotifier struct {
+	conn *dbus.Conn
+	mu   sync.Mutex
+	id   uint32
+}
+
+// NewDBusNotifier creates a notifier on an existing connection, such as a
+// private session bus. Close closes the connection.
+func NewDBusNotifier(conn *dbus.Conn) *DBusNotifier {
+	return &DBusNotifier{conn: conn}
+}
+
+// ConnectDBusNotifier connects to the session bus and checks that a
+// notification server is running
+func ConnectDBusNotifier() (*DBusNotifier, error) {
+	conn, err := dbus.ConnectSessionBus()
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to the session bus: %v", err)
+	}
+	notifier := NewDBusNotifier(conn)
+	var name, vendor, version, specVersion string
+	err = notifier.object().Call(notificationsInterface+".GetServerInformation", 0).Store(&name, &vendor, &version, &specVersion)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("no notification server on the session bus: %v", err)
+	}
+	return notifier, nil
+}
+
+func (d *DBusNotifier) object() dbus.BusObject {
+	return d.conn.Object(notificationsService, notificationsPath)
+}
+
+// Notify shows n, replacing the previous notification
+func (d *DBusNotifier) Notify(n Notification) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	hints := map[string]dbus.Variant{
+		"urgency": dbus.MakeVariant(byte(n.Urgency)),
+	}
+	var id uint32
+	err := d.object().Call(notificationsInterface+".Notify", 0,
+		notificationAppName, d.id, "", n.Summary, n.Body, []string{}, hints, n.expireTimeout()).Store(&id)
+	if err != nil {
+		return fmt.Errorf("failed to send notification: %v", err)
+	}
+	d.id = id
+	return nil
+}
+
+// Dismiss closes the current notification, if any
+func (d *DBusNotifier) Dismiss() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.id == 0 {
+		return nil
+	}
+	id := d.id
+	d.id = 0
+	if err := d.object().Call(notificationsInterface+".CloseNotification", 0, id).Err; err != nil {
+		return fmt.Errorf("failed to close notification: %v", err)
+	}
+	return nil
+}
+
+// Close closes the D-Bus connection
+func (d *DBusNotifier) Close() error {
+	return d.conn.Close()
+}
+
+// NotifySendNotifier shows notifications through the notify-send command
+type NotifySendNotifier struct {
+	mu sync.Mutex
+	id string
+}
+
+// NewNotifySendNotifier returns a notifier using notify-send, if installed
+func NewNotifySendNotifier() (*NotifySendNotifier, error) {
+	if _, err := exec.LookPath("notify-send"); err != nil {
+		return nil, fmt.Errorf("notify-send is not installed")
+	}
+	if err := helperAllowed("notify-send"); err != nil {
+		return nil, err
+	}
+	return &NotifySendNotifier{}, nil
+}
+
+// Notify shows n, replacing the previous notification when notify-send
+// supports it
+func (s *NotifySendNotifier) Notify(n Notification) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	args := []string{"--app-name=" + notificationAppName, "--urgency=" + n.Urgency.String(), "--print-id"}
+	if n.Timeout != 0 {
+		args = append(args, fmt.Sprintf("--expire-time=%d", n.expireTimeout()))
+	}
+	if s.id != "" {
+		args = append(args, "--replace-id="+s.id)
+	}
+	args = append(args, "--", n.Summary, n.Body)
+
+	output, err := helperOutput("notify-send", args...)
+	if err != nil {
+		return fmt.Errorf("notify-send failed: %v", err)
+	}
+	// Older notify-send versions neither print nor replace IDs
+	id := strings.TrimSpace(string(output))
+	if _, err := strconv.ParseUint(id, 10, 32); err == nil {
+		s.id = id
+	}
+	return nil
+}
+
+// Dismiss forgets the current notification; notify-send cannot close it
+func (s *NotifySendNotifier) Dismiss() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.id = ""
+	return nil
+}
+
+func (s *NotifySendNotifier) Close() error { return nil }
+
+// NewNotifier creates a notifier for mode: "dbus", "notify-send", "off", or
+// "auto"/"" to try D-Bus, then notify-send, then fall back to no
+// notifications
+func NewNotifier(mode string) (Notifier, error) {
+	switch strings.ToLower(mode) {
+	case "", "auto":
+		if notifier, err := ConnectDBusNotifier(); err == nil {
+			return notifier, nil
+		}
+		if notifier, err := NewNotifySendNotifier(); err == nil {
+			return notifier, nil
+		}
+		return NoopNotifier{}, nil
+	case "dbus":
+		return ConnectDBusNotifier()
+	case "notify-send":
+		return NewNotifySendNotifier()
+	case "off", "none":
+		return NoopNotifier{}, nil
+	default:
+		return nil, fmt.Errorf("unknown notification mode: %s", mode)
+	}
+}
+
+// SetNotifier sets the notifier used to report interaction progress
+func (ko *KeyboardOperator) SetNotifier(notifier Notifier) {
+	ko.notifier = notifier
+}
+
+// notify shows a notification, logging failures instead of interrupting the
+// interaction
+func (ko *KeyboardOperator) notify(log *slog.Logger, n Notification) {
+	if err := ko.notifier.Notify(n); err != nil {
+		log.Warn("failed to show notification", "error", err)
+	}
+}
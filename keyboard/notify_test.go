@@ -0,0 +1,254 @@
+package keyboard
+
+import (
+	"bufio"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+)
+
+// busConfig allows everything on the private test bus
+const busConfig = `<!DOCTYPE busconfig PUBLIC "-//freedesktop//DTD D-Bus Bus Configuration 1.0//EN"
+ "http://www.freedesktop.org/standards/dbus/1.0/busconfig.dtd">
+<busconfig>
+  <type>session</type>
+  <listen>unix:dir=%s</listen>
+  <auth>EXTERNAL</auth>
+  <policy context="default">
+    <allow send_destination="*" eavesdrop="true"/>
+    <allow eavesdrop="true"/>
+    <allow own="*"/>
+  </policy>
+</busconfig>
+`
+
+// startSessionBus starts a private dbus-daemon and returns its address
+func startSessionBus(t *testing.T) string {
+	t.Helper()
+	if _, err := exec.LookPath("dbus-daemon"); err != nil {
+		t.Skip("dbus-daemon is not installed")
+	}
+	dir := t.TempDir()
+	config := filepath.Join(dir, "bus.conf")
+	if err := os.WriteFile(config, []byte(strings.Replace(busConfig, "%s", dir, 1)), 0600); err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command("dbus-daemon", "--config-file="+config, "--nofork", "--print-address")
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("failed to start dbus-daemon: %v", err)
+	}
+	t.Cleanup(func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	})
+	address, err := bufio.NewReader(stdout).ReadString('\n')
+	if err != nil {
+		t.Fatalf("failed to read the bus address: %v", err)
+	}
+	return strings.TrimSpace(address)
+}
+
+// connectBus opens a connection to a private bus, closed with the test
+func connectBus(t *testing.T, address string) *dbus.Conn {
+	t.Helper()
+	conn, err := dbus.Connect(address)
+	if err != nil {
+		t.Fatalf("failed to connect to the private bus: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// notifyCall is a Notify call received by the stub server
+type notifyCall struct {
+	replacesID uint32
+	summary    string
+	body       string
+	urgency    byte
+	timeout    int32
+}
+
+// stubNotifications implements org.freedesktop.Notifications
+type stubNotifications struct {
+	mu     sync.Mutex
+	nextID uint32
+	calls  []notifyCall
+	closed []uint32
+}
+
+func (s *stubNotifications) GetServerInformation() (string, string, string, string, *dbus.Error) {
+	return "stub", "keygeist", "1.0", "1.2", nil
+}
+
+func (s *stubNotifications) Notify(app string, replacesID uint32, icon, summary, body string, actions []string, hints map[string]dbus.Variant, timeout int32) (uint32, *dbus.Error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	urgency, _ := hints["urgency"].Value().(byte)
+	s.calls = append(s.calls, notifyCall{replacesID: replacesID, summary: summary, body: body, urgency: urgency, timeout: timeout})
+	if replacesID != 0 {
+		return replacesID, nil
+	}
+	s.nextID++
+	return s.nextID, nil
+}
+
+func (s *stubNotifications) CloseNotification(id uint32) *dbus.Error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = append(s.closed, id)
+	return nil
+}
+
+// startStubNotifications registers a stub notification server on the bus
+func startStubNotifications(t *testing.T, address string) *stubNotifications {
+	t.Helper()
+	conn := connectBus(t, address)
+	stub := &stubNotifications{}
+	if err := conn.Export(stub, notificationsPath, notificationsInterface); err != nil {
+		t.Fatal(err)
+	}
+	reply, err := conn.RequestName(notificationsService, dbus.NameFlagDoNotQueue)
+	if err != nil || reply != dbus.RequestNameReplyPrimaryOwner {
+		t.Fatalf("failed to own %s: %v", notificationsService, err)
+	}
+	return stub
+}
+
+func TestDBusNotifierReplacesPreviousNotification(t *testing.T) {
+	address := startSessionBus(t)
+	stub := startStubNotifications(t, address)
+	t.Setenv("DBUS_SESSION_BUS_ADDRESS", address)
+
+	notifier, err := ConnectDBusNotifier()
+	if err != nil {
+		t.Fatalf("ConnectDBusNotifier: %v", err)
+	}
+	defer notifier.Close()
+
+	if err := notifier.Notify(Notification{Summary: "thinking", Body: "asking", Timeout: -1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := notifier.Notify(Notification{Summary: "done", Urgency: UrgencyCritical, Timeout: 3 * time.Second}); err != nil {
+		t.Fatal(err)
+	}
+	if err := notifier.Dismiss(); err != nil {
+		t.Fatal(err)
+	}
+	// A new notification after dismissing gets a new ID
+	if err := notifier.Notify(Notification{Summary: "again"}); err != nil {
+		t.Fatal(err)
+	}
+
+	stub.mu.Lock()
+	defer stub.mu.Unlock()
+	want := []notifyCall{
+		{replacesID: 0, summary: "thinking", body: "asking", urgency: byte(UrgencyLow), timeout: 0},
+		{replacesID: 1, summary: "done", urgency: byte(UrgencyCritical), timeout: 3000},
+		{replacesID: 0, summary: "again", urgency: byte(UrgencyLow), timeout: -1},
+	}
+	if len(stub.calls) != len(want) {
+		t.Fatalf("got %d Notify calls, want %d: %+v", len(stub.calls), len(want), stub.calls)
+	}
+	for i, call := range stub.calls {
+		if call != want[i] {
+			t.Errorf("Notify call %d = %+v, want %+v", i, call, want[i])
+		}
+	}
+	if len(stub.closed) != 1 || stub.closed[0] != 1 {
+		t.Errorf("CloseNotification calls = %v, want [1]", stub.closed)
+	}
+}
+
+func TestNewNotifierPrefersDBus(t *testing.T) {
+	address := startSessionBus(t)
+	startStubNotifications(t, address)
+	t.Setenv("DBUS_SESSION_BUS_ADDRESS", address)
+
+	notifier, err := NewNotifier("auto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer notifier.Close()
+	if _, ok := notifier.(*DBusNotifier); !ok {
+		t.Fatalf("NewNotifier(auto) = %T, want *DBusNotifier", notifier)
+	}
+}
+
+// fakeNotifySend installs a notify-send recording its arguments, one call
+// per line with each argument followed by '|', and printing the given ID
+func fakeNotifySend(t *testing.T, id string) string {
+	t.Helper()
+	dir := t.TempDir()
+	log := filepath.Join(dir, "calls")
+	script := "#!/bin/sh\n{ printf '%s|' \"$@\"; echo; } >> " + log + "\necho " + id + "\n"
+	if err := os.WriteFile(filepath.Join(dir, "notify-send"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	t.Setenv("KEYGEIST_ALLOW_ROOT_HELPERS", "1")
+	return log
+}
+
+func TestNewNotifierFallsBackToNotifySend(t *testing.T) {
+	// A bus without a notification server
+	t.Setenv("DBUS_SESSION_BUS_ADDRESS", startSessionBus(t))
+	log := fakeNotifySend(t, "42")
+
+	notifier, err := NewNotifier("auto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := notifier.(*NotifySendNotifier); !ok {
+		t.Fatalf("NewNotifier(auto) = %T, want *NotifySendNotifier", notifier)
+	}
+	if err := notifier.Notify(Notification{Summary: "thinking", Body: "asking", Timeout: -1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := notifier.Notify(Notification{Summary: "done", Urgency: UrgencyCritical}); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	calls := strings.Split(strings.TrimSpace(string(data)), "\n")
+	want := []string{
+		"--app-name=Keygeist|--urgency=low|--print-id|--expire-time=0|--|thinking|asking|",
+		"--app-name=Keygeist|--urgency=critical|--print-id|--replace-id=42|--|done||",
+	}
+	if len(calls) != len(want) {
+		t.Fatalf("notify-send calls = %q, want %q", calls, want)
+	}
+	for i := range want {
+		if calls[i] != want[i] {
+			t.Errorf("notify-send call %d = %q, want %q", i, calls[i], want[i])
+		}
+	}
+}
+
+func TestNewNotifierWithoutServers(t *testing.T) {
+	t.Setenv("DBUS_SESSION_BUS_ADDRESS", startSessionBus(t))
+	t.Setenv("PATH", t.TempDir())
+
+	notifier, err := NewNotifier("auto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := notifier.(NoopNotifier); !ok {
+		t.Fatalf("NewNotifier(auto) = %T, want NoopNotifier", notifier)
+	}
+	if _, err := NewNotifier("dbus"); err == nil {
+		t.Error("NewNotifier(dbus) succeeded without a notification server")
+	}
+}
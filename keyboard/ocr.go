@@ -0,0 +1,187 @@
+package keyboard
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os/exec"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// OCR engines
+const (
+	OCRTesseract = "tesseract"
+	OCRHTTP      = "http"
+)
+
+// Defaults used when the OCR configuration doesn't set them
+const (
+	DefaultOCRMaxChars = 8000
+	ocrTimeout         = 30 * time.Second
+)
+
+// OCREngine extracts the text of an image
+type OCREngine interface {
+	// Recognize returns the text of a PNG image, keeping its layout
+	Recognize(ctx context.Context, png []byte) (string, error)
+}
+
+// TesseractOCR runs the tesseract command line tool
+type TesseractOCR struct {
+	// Languages are tesseract language codes joined with +, as in eng+deu
+	Languages string
+}
+
+// Recognize reads the image from tesseract's standard input, keeping the
+// spacing between words so that columns and tables stay aligned
+func (t TesseractOCR) Recognize(ctx context.Context, png []byte) (string, error) {
+	args := []string{"stdin", "stdout", "--psm", "3", "-c", "preserve_interword_spaces=1"}
+	if t.Languages != "" {
+		args = append(args, "-l", t.Languages)
+	}
+	cmd, err := helperCommand(ctx, "tesseract", args...)
+	if err != nil {
+		return "", err
+	}
+	cmd.Stdin = bytes.NewReader(png)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil {
+		if _, ok := err.(*exec.ExitError); ok {
+			return "", fmt.Errorf("tesseract failed: %v: %s", err, strings.TrimSpace(stderr.String()))
+		}
+		return "", fmt.Errorf("failed to run tesseract: %v", err)
+	}
+	return string(output), nil
+}
+
+// HTTPOCR posts images to a local OCR service. The service receives the
+// PNG as the request body and answers with plain text or a JSON object
+// with a "text" field.
+type HTTPOCR struct {
+	URL     string
+	Headers map[string]string
+	Client  *http.Client
+}
+
+// Recognize sends the image to the service
+func (h HTTPOCR) Recognize(ctx context.Context, png []byte) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.URL, bytes.NewReader(png))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "image/png")
+	for key, value := range h.Headers {
+		req.Header.Set(key, value)
+	}
+	client := h.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("OCR service error: %v", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("failed to read OCR response: %v", err)
+	}
+	if resp.StatusCode/100 != 2 {
+		return "", fmt.Errorf("OCR service returned %s: %s", resp.Status, truncateOutput(strings.TrimSpace(string(body)), 200))
+	}
+	if strings.HasPrefix(resp.Header.Get("Content-Type"), "application/json") {
+		var result struct {
+			Text string `json:"text"`
+		}
+		if err := json.Unmarshal(body, &result); err != nil {
+			return "", fmt.Errorf("invalid OCR response: %v", err)
+		}
+		return result.Text, nil
+	}
+	return string(body), nil
+}
+
+// NewOCREngine creates the engine selected by the configuration
+func NewOCREngine(config OCRConfig) (OCREngine, error) {
+	switch config.Engine {
+	case "", OCRTesseract:
+		return TesseractOCR{Languages: config.Languages}, nil
+	case OCRHTTP:
+		if config.URL == "" {
+			return nil, fmt.Errorf("the http OCR engine needs a url")
+		}
+		return HTTPOCR{URL: config.URL, Headers: config.Headers, Client: &http.Client{Timeout: ocrTimeout}}, nil
+	default:
+		return nil, fmt.Errorf("unknown OCR engine '%s'", config.Engine)
+	}
+}
+
+// cleanOCRText drops the trailing spaces and runs of blank lines OCR
+// produces, keeping indentation
+func cleanOCRText(text string) string {
+	lines := strings.Split(strings.ReplaceAll(text, "\f", ""), "\n")
+	var out []string
+	blank := 0
+	for _, line := range lines {
+		line = strings.TrimRight(line, " \t\r")
+		if line == "" {
+			blank++
+			if blank > 1 {
+				continue
+			}
+		} else {
+			blank = 0
+		}
+		out = append(out, line)
+	}
+	return strings.Trim(strings.Join(out, "\n"), "\n")
+}
+
+// screenshotText extracts the text of base64 encoded screenshots, capped
+// at the configured length
+func (ko *KeyboardOperator) screenshotText(ctx context.Context, log *slog.Logger, screenshots []string) (string, error) {
+	if ko.ocr == nil {
+		return "", fmt.Errorf("no OCR engine available")
+	}
+	start := time.Now()
+	ctx, cancel := context.WithTimeout(ctx, ocrTimeout)
+	defer cancel()
+	var parts []string
+	for i, screenshot := range screenshots {
+		png, err := base64.StdEncoding.DecodeString(screenshot)
+		if err != nil {
+			return "", fmt.Errorf("invalid screenshot: %v", err)
+		}
+		text, err := ko.ocr.Recognize(ctx, png)
+		if err != nil {
+			return "", err
+		}
+		text = cleanOCRText(text)
+		if len(screenshots) > 1 {
+			text = fmt.Sprintf("--- Display %d ---\n%s", i+1, text)
+		}
+		parts = append(parts, text)
+	}
+	text := truncateChars(strings.Join(parts, "\n\n"), ko.fileConfig.OCR.maxChars())
+	log.Info("extracted screenshot text", "chars", utf8.RuneCountInString(text), "latency", time.Since(start))
+	return text, nil
+}
+
+// truncateChars cuts text to at most max characters, saying how many were
+// dropped
+func truncateChars(text string, max int) string {
+	runes := []rune(text)
+	if len(runes) <= max {
+		return text
+	}
+	return fmt.Sprintf("%s\n[truncated %d characters]", string(runes[:max]), len(runes)-max)
+}
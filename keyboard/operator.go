@@ -3,46 +3,73 @@ package keyboard
 import (
 	"context"
 	"encoding/base64"
+	"errors"
 	"fmt"
-	"image/png"
-	"io/ioutil"
+	"log/slog"
 	"os"
-	"os/exec"
-	"regexp"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
-	"github.com/atotto/clipboard"
-	"github.com/kbinani/screenshot"
 	"github.com/sashabaranov/go-openai"
 )
 
 type KeyboardOperator struct {
-	listener     *KeyboardListener
-	emulator     *KeyboardEmulator
+	logger     *slog.Logger
+	listener   *KeyboardListener
+	emulator   *KeyboardEmulator
+	config     *KeyBindingConfig
+	fileConfig *Config
+	expander   *SnippetExpander
+	notifier   Notifier
+	input      InputBackend
+	tools      *ToolRegistry
+	mcpClients []*MCPClient
+	knowledge  *KnowledgeIndex
+	ocr        OCREngine
+	clipboard  ClipboardBackend
+	// clipHistory is nil unless the clipboard history is enabled
+	clipHistory *ClipboardHistory
+	// pipelines are the response processors by binding, "" being the default
+	pipelines map[string]ResponsePipeline
+
+	profileMutex sync.Mutex
+	profiles     []Profile
+	profile      int
 	client       *openai.Client
-	apiKey       string
-	model        string
-	baseURL      string
-	systemPrompt string
-	config       *KeyBindingConfig
-
-	interactionMutex sync.Mutex
-	isInteracting    bool
-	cancelContext    context.CancelFunc
+	voiceClient  *openai.Client
+
+	// holding has the released channel of each binding whose hold trigger
+	// is down; it is only used by listener callbacks, which run one at a time
+	holding map[string]chan struct{}
+
+	pauseMutex   sync.Mutex
+	manualPause  bool
+	autoPauseApp string
+	paused       atomic.Bool
+	stopFocus    context.CancelFunc
+	stopIndex    context.CancelFunc
+	stopClips    context.CancelFunc
+
+	interactions *interactionManager
+
+	statusMutex     sync.Mutex
+	status          InteractionStatus
+	statusCallbacks []func(InteractionStatus)
 }
 
 func NewKeyboardOperator(apiKey, model, baseURL, keyboardDevice, systemPrompt string) (*KeyboardOperator, error) {
+	fileConfig, err := LoadConfig()
+	if err != nil {
+		return nil, err
+	}
 	emulator, err := NewKeyboardEmulator()
 	if err != nil {
 		return nil, fmt.Errorf("failed to initialize keyboard emulator: %v", err)
 	}
 	listener := NewKeyboardListener(keyboardDevice)
-	config := openai.DefaultConfig(apiKey)
-	if baseURL != "" {
-		config.BaseURL = baseURL
-	}
-	client := openai.NewClientWithConfig(config)
 
 	// Use default system prompt if none provided
 	if systemPrompt == "" {
@@ -52,20 +79,116 @@ func NewKeyboardOperator(apiKey, model, baseURL, keyboardDevice, systemPrompt st
 	// Load keybinding configuration from environment variables
 	keyConfig := LoadKeyBindingConfig()
 
-	return &KeyboardOperator{
-		listener:     listener,
-		emulator:     emulator,
-		client:       client,
-		apiKey:       apiKey,
-		model:        model,
-		baseURL:      baseURL,
-		systemPrompt: systemPrompt,
-		config:       keyConfig,
-	}, nil
+	clipboard := NewClipboardBackend(fileConfig.Display)
+
+	ocr, err := NewOCREngine(fileConfig.OCR)
+	if err != nil {
+		return nil, fmt.Errorf("invalid OCR configuration: %v", err)
+	}
+
+	pipelines := make(map[string]ResponsePipeline)
+	if pipelines[""], err = NewResponsePipeline(DefaultResponsePipeline); err != nil {
+		return nil, err
+	}
+	for name, binding := range fileConfig.Bindings {
+		if len(binding.Process) == 0 {
+			continue
+		}
+		if pipelines[name], err = NewResponsePipeline(binding.Process); err != nil {
+			return nil, fmt.Errorf("binding '%s': %v", name, err)
+		}
+	}
+
+	var clipHistory *ClipboardHistory
+	if fileConfig.ClipboardHistory.Enabled {
+		clipHistory = NewClipboardHistory(fileConfig.ClipboardHistory, clipboard)
+	}
+
+	tools, err := newToolRegistry(fileConfig.Tools, clipboard, clipHistory)
+	if err != nil {
+		return nil, fmt.Errorf("invalid tools configuration: %v", err)
+	}
+
+	ko := &KeyboardOperator{
+		logger:      slog.Default(),
+		listener:    listener,
+		emulator:    emulator,
+		config:      keyConfig,
+		fileConfig:  fileConfig,
+		notifier:    NoopNotifier{},
+		input:       ZenityBackend{},
+		tools:       tools,
+		ocr:         ocr,
+		clipboard:   clipboard,
+		clipHistory: clipHistory,
+		pipelines:   pipelines,
+		profiles: resolveProfiles(Profile{
+			Model:        model,
+			BaseURL:      baseURL,
+			APIKey:       apiKey,
+			SystemPrompt: systemPrompt,
+			Vision:       visionFromEnv(),
+		}, fileConfig.Profiles),
+		client:       newOpenAIClient(apiKey, baseURL),
+		interactions: newInteractionManager(fileConfig.Interactions.MaxConcurrentQueries),
+		holding:      make(map[string]chan struct{}),
+		status:       InteractionStatus{State: StateIdle, Profile: DefaultProfileName, Since: time.Now()},
+	}
+	if knowledge := fileConfig.Knowledge; len(knowledge.Directories) > 0 {
+		if knowledge.APIKey == "" {
+			knowledge.APIKey = apiKey
+		}
+		if knowledge.BaseURL == "" {
+			knowledge.BaseURL = baseURL
+		}
+		ko.knowledge = NewKnowledgeIndex(knowledge, newOpenAIClient(knowledge.APIKey, knowledge.BaseURL))
+	}
+	if voice := fileConfig.Voice; voice.Enabled {
+		if voice.APIKey == "" {
+			voice.APIKey = apiKey
+		}
+		if voice.BaseURL == "" {
+			voice.BaseURL = baseURL
+		}
+		ko.voiceClient = newOpenAIClient(voice.APIKey, voice.BaseURL)
+	}
+	if len(fileConfig.Snippets.Library) > 0 {
+		ko.expander = NewSnippetExpander(fileConfig.Snippets, emulator, clipboard, ko.interactions.typing, ko.completeSnippet)
+	}
+	return ko, nil
+}
+
+// SetLogger sets the logger used by the operator, its listener, emulator
+// and snippet expander
+func (ko *KeyboardOperator) SetLogger(logger *slog.Logger) {
+	ko.logger = logger
+	ko.listener.SetLogger(logger)
+	ko.emulator.SetLogger(logger)
+	if ko.knowledge != nil {
+		ko.knowledge.SetLogger(logger)
+	}
+	if ko.clipHistory != nil {
+		ko.clipHistory.SetLogger(logger)
+	}
+	if ko.expander != nil {
+		ko.expander.SetLogger(logger)
+	}
 }
 
 func (ko *KeyboardOperator) Close() {
 	ko.StopCurrentInteraction()
+	if ko.stopFocus != nil {
+		ko.stopFocus()
+	}
+	if ko.stopIndex != nil {
+		ko.stopIndex()
+	}
+	if ko.stopClips != nil {
+		ko.stopClips()
+	}
+	for _, client := range ko.mcpClients {
+		client.Close()
+	}
 	if ko.listener != nil {
 		ko.listener.Stop()
 	}
@@ -74,218 +197,520 @@ func (ko *KeyboardOperator) Close() {
 	}
 }
 
-func (ko *KeyboardOperator) StopCurrentInteraction() {
-	ko.interactionMutex.Lock()
-	defer ko.interactionMutex.Unlock()
-	if ko.isInteracting && ko.cancelContext != nil {
-		ko.cancelContext()
-		ko.isInteracting = false
-		ko.cancelContext = nil
-	}
+// SetHeartbeat makes the keyboard event loop call fn at least every
+// interval while it is alive, e.g. to ping the systemd watchdog
+func (ko *KeyboardOperator) SetHeartbeat(interval time.Duration, fn func()) {
+	ko.listener.SetHeartbeat(interval, fn)
 }
 
-func (ko *KeyboardOperator) showZenityInput() (string, error) {
-	cmd := exec.Command("zenity", "--entry", "--title=Zeygeist", "--text=What would you like me to help you with?", "--width=400", "--height=100")
-	cmd.Env = os.Environ()
-	output, err := cmd.CombinedOutput()
-	if err != nil {
-		if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() == 1 {
-			return "", nil
+// RegisterControlCommands adds the operator's commands to a control server
+func (ko *KeyboardOperator) RegisterControlCommands(cs *ControlServer) {
+	cs.Handle("status", func(args []string) (interface{}, error) {
+		return ko.Status(), nil
+	})
+	cs.Handle("profile", func(args []string) (interface{}, error) {
+		if len(args) > 1 {
+			return nil, fmt.Errorf("usage: profile [name]")
 		}
-		return "", fmt.Errorf("zenity error: %v", err)
-	}
-	return strings.TrimSpace(string(output)), nil
+		if len(args) == 1 {
+			if err := ko.SetProfile(args[0]); err != nil {
+				return nil, err
+			}
+		}
+		active, _ := ko.ActiveProfile()
+		return map[string]interface{}{"active": active, "profiles": ko.Profiles()}, nil
+	})
+	cs.Handle("clips", func(args []string) (interface{}, error) {
+		if ko.clipHistory == nil {
+			return nil, fmt.Errorf("clipboard history is disabled")
+		}
+		switch {
+		case len(args) == 0:
+		case len(args) == 1 && args[0] == "clear":
+			if err := ko.clipHistory.Clear(); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, fmt.Errorf("usage: clips [clear]")
+		}
+		return map[string]interface{}{"entries": ko.clipHistory.Len()}, nil
+	})
+	cs.Handle("reindex", func(args []string) (interface{}, error) {
+		if ko.knowledge == nil {
+			return nil, fmt.Errorf("no knowledge directories configured")
+		}
+		changed, err := ko.knowledge.Reindex(context.Background())
+		files, chunks := ko.knowledge.Stats()
+		result := map[string]interface{}{"changed": changed, "files": files, "chunks": chunks}
+		if err != nil {
+			result["error"] = err.Error()
+		}
+		return result, nil
+	})
+	ko.registerPauseCommands(cs)
+	ko.registerJobCommands(cs)
+	ko.registerInputCommands(cs)
 }
 
-func (ko *KeyboardOperator) getClipboardContent() string {
-	content, err := clipboard.ReadAll()
+// OpenDevices opens the input device ahead of Start, so that privileges can
+// be dropped in between
+func (ko *KeyboardOperator) OpenDevices() error {
+	return ko.listener.Open()
+}
+
+// capturedContext is the context captured when a binding is pressed
+type capturedContext struct {
+	clipboard string
+	selection string
+	// screenshots are base64 encoded PNGs
+	screenshots []string
+	clips       []ClipboardEntry
+}
+
+// getKnowledgeContent retrieves the indexed excerpts relevant to the prompt
+func (ko *KeyboardOperator) getKnowledgeContent(ctx context.Context, log *slog.Logger, prompt string) string {
+	if ko.knowledge == nil {
+		log.Warn("skipping knowledge context: no knowledge directories configured")
+		return ""
+	}
+	start := time.Now()
+	content, err := ko.knowledge.Context(ctx, prompt)
 	if err != nil {
+		log.Warn("failed to retrieve knowledge", "error", err)
 		return ""
 	}
-	return strings.TrimSpace(content)
+	log.Debug("retrieved knowledge", "latency", time.Since(start))
+	return content
 }
 
-func (ko *KeyboardOperator) takeScreenshotBase64() ([]string, error) {
-	displays := screenshot.NumActiveDisplays()
-	var screenshots []string
-
-	// Try using the screenshot library first
-	for i := 0; i < displays; i++ {
-		bounds := screenshot.GetDisplayBounds(i)
-		img, err := screenshot.CaptureRect(bounds)
-		if err != nil {
-			fmt.Printf("Screenshot library failed for display %d: %v, trying fallback tools\n", i, err)
-			// Fallback to external tools for this display
-			fallbackScreenshot, err := ko.takeScreenshotWithFallbackTools()
-			if err != nil {
-				return nil, fmt.Errorf("both screenshot library and fallback tools failed for display %d: %v", i, err)
-			}
-			screenshots = append(screenshots, fallbackScreenshot)
-			break // Use one fallback screenshot for all displays
-		}
-
-		var buf strings.Builder
-		encoder := base64.NewEncoder(base64.StdEncoding, &buf)
-		if err := png.Encode(encoder, img); err != nil {
-			fmt.Printf("Failed to encode screenshot for display %d: %v, trying fallback tools\n", i, err)
-			// Fallback to external tools for this display
-			fallbackScreenshot, err := ko.takeScreenshotWithFallbackTools()
-			if err != nil {
-				return nil, fmt.Errorf("both screenshot library and fallback tools failed for display %d: %v", i, err)
-			}
-			screenshots = append(screenshots, fallbackScreenshot)
-			break // Use one fallback screenshot for all displays
-		}
-		encoder.Close()
-		screenshots = append(screenshots, buf.String())
+// visionFromEnv reads whether the default model accepts images from
+// OPENAI_VISION, leaving it unset when the variable is
+func visionFromEnv() *bool {
+	vision, err := strconv.ParseBool(os.Getenv("OPENAI_VISION"))
+	if err != nil {
+		return nil
 	}
+	return &vision
+}
 
-	if len(screenshots) == 0 {
-		// If no displays were found or all failed, try fallback tools
-		fmt.Printf("No displays found with screenshot library, trying fallback tools\n")
-		fallbackScreenshot, err := ko.takeScreenshotWithFallbackTools()
-		if err != nil {
-			return nil, fmt.Errorf("no displays found and fallback tools failed: %v", err)
-		}
-		screenshots = append(screenshots, fallbackScreenshot)
+// KnowledgeEnabled reports whether directories are indexed for the
+// knowledge context
+func (ko *KeyboardOperator) KnowledgeEnabled() bool {
+	return ko.knowledge != nil
+}
+
+// bindingContext returns the context sources attached by a binding
+func (ko *KeyboardOperator) bindingContext(binding string) []string {
+	if sources := ko.fileConfig.Bindings[binding].Context; len(sources) > 0 {
+		return sources
 	}
+	return defaultContext(binding)
+}
 
-	return screenshots, nil
+// VoiceEnabled reports whether spoken prompts are configured
+func (ko *KeyboardOperator) VoiceEnabled() bool {
+	return ko.voiceClient != nil
 }
 
-func (ko *KeyboardOperator) takeScreenshotWithFallbackTools() (string, error) {
-	// Try multiple screenshot tools in order of preference
-	tools := []struct {
-		name string
-		args []string
-	}{
-		{"grim", []string{}},                 // Wayland - saves to file
-		{"gnome-screenshot", []string{"-f"}}, // GNOME - saves to file
-		{"scrot", []string{}},                // X11 - saves to file
+// bindingInput returns how a binding asks for its prompt
+func (ko *KeyboardOperator) bindingInput(binding string) string {
+	if input := ko.fileConfig.Bindings[binding].Input; input != "" {
+		return input
+	}
+	if binding == voiceBinding {
+		return InputVoice
 	}
+	return InputDialog
+}
 
-	for _, tool := range tools {
-		fmt.Printf("Trying screenshot tool: %s\n", tool.name)
-		screenshot, err := ko.tryScreenshotTool(tool.name, tool.args)
-		if err == nil {
-			fmt.Printf("Successfully captured screenshot with %s\n", tool.name)
-			return screenshot, nil
+// takeScreenshotBase64 captures the screen with the display backends and
+// returns one base64 encoded PNG per captured image
+func (ko *KeyboardOperator) takeScreenshotBase64(log *slog.Logger) ([]string, error) {
+	images, err := captureScreenshots(log, ko.fileConfig.Display)
+	if err != nil {
+		return nil, fmt.Errorf("screenshot failed: %v", err)
+	}
+	screenshots := make([]string, len(images))
+	for i, image := range images {
+		screenshots[i] = base64.StdEncoding.EncodeToString(image)
+	}
+	return screenshots, nil
+}
+
+// handleCombinationContext returns the callback of a binding. Pressing it
+// starts a job, unless the binding already has one: then its on_busy
+// option cancels that job (default), queues another one, or does nothing.
+// Releasing a hold trigger ends the job's voice recording.
+func (ko *KeyboardOperator) handleCombinationContext(ctxType string, clearTrigger bool) func(CombinationEvent) {
+	return func(event CombinationEvent) {
+		if event.Phase == PhaseEnded {
+			if released, ok := ko.holding[ctxType]; ok {
+				close(released)
+				delete(ko.holding, ctxType)
+			}
+			return
+		}
+		if ko.Paused() {
+			ko.logger.Info("hotkeys paused, ignoring binding", "binding", ctxType)
+			return
+		}
+		if ko.interactions.busy(ctxType) {
+			switch ko.fileConfig.Bindings[ctxType].OnBusy {
+			case OnBusyQueue:
+			case OnBusyIgnore:
+				ko.logger.Info("binding busy, ignoring", "binding", ctxType)
+				return
+			default:
+				ko.CancelInteractions(ctxType)
+				return
+			}
+		}
+		// Clear the combination now: by the time the job runs, another job's
+		// output may follow it
+		if clearTrigger {
+			ko.clearTrigger()
+		}
+		job := ko.interactions.add(ctxType)
+		if event.Phase == PhaseStarted {
+			job.released = make(chan struct{})
+			ko.holding[ctxType] = job.released
 		}
-		fmt.Printf("Failed to capture screenshot with %s: %v\n", tool.name, err)
+		ko.refreshStatus()
+		go ko.runInteraction(job)
 	}
+}
 
-	return "", fmt.Errorf("all screenshot tools failed")
+// clearTrigger types a backspace over the character typed by a combination,
+// unless another job is typing: the backspace would delete its output
+func (ko *KeyboardOperator) clearTrigger() {
+	select {
+	case ko.interactions.typing <- struct{}{}:
+	default:
+		ko.logger.Debug("not clearing the key combination while another job is typing")
+		return
+	}
+	defer release(ko.interactions.typing)
+	if err := ko.emulator.TypeText("\b"); err != nil {
+		ko.logger.Warn("failed to clear the key combination", "error", err)
+	}
 }
 
-func (ko *KeyboardOperator) tryScreenshotTool(toolName string, args []string) (string, error) {
-	// Check if tool exists
-	if _, err := exec.LookPath(toolName); err != nil {
-		return "", fmt.Errorf("tool not found: %v", err)
+// runInteraction captures the context, prompts the user, queries the model
+// and types the response, taking turns with the other jobs for the prompt
+// dialog, the model and the keyboard
+func (ko *KeyboardOperator) runInteraction(job *interactionJob) {
+	ctx, ctxType := job.ctx, job.info.Binding
+	profile, client := ko.currentProfile()
+	log := ko.logger.With("binding", ctxType, "interaction", job.info.ID, "profile", profile.Name)
+	entry := HistoryEntry{Binding: ctxType, Profile: profile.Name, Model: profile.Model}
+	start := time.Now()
+	log.Info("interaction started")
+
+	var failure error
+	defer func() {
+		// A failed interaction keeps reporting its error until the next one
+		ko.finishJob(job, failure)
+		log.Debug("interaction finished", "latency", time.Since(start))
+	}()
+	fail := func(msg string, err error) {
+		log.Error(msg, "error", err, "latency", time.Since(start))
+		if entry.Prompt != "" {
+			entry.Error = err.Error()
+			ko.recordHistory(log, entry, start)
+		}
+		failure = err
+		ko.notify(log, Notification{Summary: "Keygeist: " + msg, Body: err.Error(), Urgency: UrgencyCritical})
+	}
+	cancelled := func(msg string) {
+		log.Info(msg)
+		ko.notify(log, Notification{Summary: "Keygeist: interaction cancelled", Urgency: UrgencyLow, Timeout: 3 * time.Second})
 	}
+	var warnings []string
 
-	// Create a temporary file for the screenshot
-	tmpFile, err := ioutil.TempFile("", "screenshot-*.png")
+	// Remember the focused window to type into it after the dialogs
+	window, err := ActiveWindow()
 	if err != nil {
-		return "", fmt.Errorf("failed to create temp file: %v", err)
+		log.Debug("cannot determine the focused window", "error", err)
 	}
-	defer os.Remove(tmpFile.Name())
-	defer tmpFile.Close()
 
-	// Build command with filename
-	cmdArgs := append(args, tmpFile.Name())
-	cmd := exec.Command(toolName, cmdArgs...)
-	cmd.Env = os.Environ()
+	var captured capturedContext
+	sources := ko.bindingContext(ctxType)
+	if containsString(sources, ContextClipboard) {
+		content, err := ko.clipboard.Read()
+		if err != nil {
+			log.Error("failed to read clipboard, continuing without it", "error", err)
+			warnings = append(warnings, fmt.Sprintf("No clipboard content: %v", err))
+		}
+		captured.clipboard = strings.TrimSpace(content)
+	}
+	if containsString(sources, ContextSelection) {
+		content, err := ko.clipboard.ReadPrimary()
+		if err != nil {
+			log.Error("failed to read the primary selection, continuing without it", "error", err)
+			warnings = append(warnings, fmt.Sprintf("No selected text: %v", err))
+		}
+		captured.selection = strings.TrimSpace(content)
+	}
 
-	// Capture output
-	output, err := cmd.CombinedOutput()
-	if err != nil {
-		return "", fmt.Errorf("tool failed: %v, output: %s", err, string(output))
+	// One prompt dialog at a time; the screenshot is taken right before it
+	if err := ko.waitTurn(job, ko.interactions.foreground); err != nil {
+		cancelled("interaction cancelled while queued")
+		return
+	}
+	if containsString(sources, ContextScreenshot) {
+		ko.setJobState(job, StateCapturing)
+		screenshots, err := ko.takeScreenshotBase64(log)
+		if err != nil {
+			log.Error("failed to take screenshot, continuing without it", "error", err)
+			warnings = append(warnings, fmt.Sprintf("No screenshot captured: %v", err))
+		}
+		captured.screenshots = screenshots
 	}
 
-	// Read the file and encode to base64
-	imageData, err := ioutil.ReadFile(tmpFile.Name())
+	var input string
+	if ko.bindingInput(ctxType) == InputVoice {
+		input, err = ko.voicePrompt(ctx, log, job)
+	} else {
+		ko.setJobState(job, StatePrompting)
+		input, err = ko.input.Prompt(ctx)
+	}
+	// The clipboard history picker follows the prompt it applies to
+	if err == nil && input != "" && containsString(sources, ContextClipboardHistory) {
+		var clipErr error
+		if captured.clips, clipErr = ko.historyClips(ctx, log); clipErr != nil && ctx.Err() == nil {
+			log.Warn("failed to choose clipboard entries, continuing without them", "error", clipErr)
+			warnings = append(warnings, fmt.Sprintf("No clipboard history attached: %v", clipErr))
+		}
+	}
+	release(ko.interactions.foreground)
+	if ctx.Err() != nil {
+		cancelled("interaction cancelled while prompting")
+		return
+	}
 	if err != nil {
-		return "", fmt.Errorf("failed to read screenshot file: %v", err)
+		fail("failed to get the prompt", err)
+		return
 	}
-
-	// Convert to base64
-	return base64.StdEncoding.EncodeToString(imageData), nil
-}
-
-func (ko *KeyboardOperator) handleCombinationContext(ctxType string) func() {
-	return func() {
-		ko.interactionMutex.Lock()
-		if ko.isInteracting {
-			if ko.cancelContext != nil {
-				ko.cancelContext()
+	if input == "" {
+		log.Info("prompt dismissed")
+		return
+	}
+	entry.Prompt = input
+
+	// Tool calls needing approval take turns on the dialogs with the prompts
+	tools := &toolSession{
+		registry: ko.tools,
+		env:      ToolEnv{Window: window},
+		log:      log,
+		confirm: func(ctx context.Context, question string) (bool, error) {
+			if err := acquire(ctx, ko.interactions.foreground); err != nil {
+				return false, err
 			}
-			ko.isInteracting = false
-			ko.cancelContext = nil
-			ko.interactionMutex.Unlock()
+			defer release(ko.interactions.foreground)
+			ko.setJobState(job, StateConfirming)
+			defer ko.setJobState(job, StateWaiting)
+			return ko.input.Confirm(ctx, question)
+		},
+	}
+
+	sinks := ko.outputSinks(ctxType)
+	var out Output
+	var queryDuration time.Duration
+	for {
+		if err := ko.waitTurn(job, ko.interactions.queries); err != nil {
+			cancelled("interaction cancelled before querying the model")
 			return
 		}
-		ko.isInteracting = true
-		ctx, cancel := context.WithCancel(context.Background())
-		ko.cancelContext = cancel
-		ko.interactionMutex.Unlock()
-		go func() {
-			defer func() {
-				ko.interactionMutex.Lock()
-				ko.isInteracting = false
-				ko.cancelContext = nil
-				ko.interactionMutex.Unlock()
-			}()
-
-			// Type backspace to clear the combination that was pressed
-			ko.emulator.TypeText("\b")
-
-			// Take screenshot before showing Zenity dialog
-			var screenshots []string
-			if ctxType == "screenshot" || ctxType == "all" {
-				var err error
-				screenshots, err = ko.takeScreenshotBase64()
-				if err != nil {
-					fmt.Printf("Failed to take screenshot: %v\n", err)
-					screenshots = nil
-				}
+		ko.setJobState(job, StateWaiting)
+		ko.notify(log, Notification{
+			Summary: "Keygeist: thinking…",
+			Body:    strings.Join(append([]string{fmt.Sprintf("Asking %s (%s)", profile.Model, ctxType)}, warnings...), "\n"),
+			Timeout: -1,
+		})
+		queryStart := time.Now()
+		response, err := ko.queryOpenAIWithContext(ctx, log, client, profile, input, ctxType, captured, tools)
+		release(ko.interactions.queries)
+		if err != nil {
+			if ctx.Err() != nil {
+				cancelled("interaction cancelled while waiting for the model")
+				return
 			}
+			fail("model query failed", err)
+			return
+		}
+		queryDuration = time.Since(queryStart)
+		log.Info("model responded", "model", profile.Model, "latency", queryDuration)
+
+		// Clean the response before delivering it
+		cleanedResponse := ko.processResponse(ctxType, response)
+		entry.Response = cleanedResponse
+		out = Output{Binding: ctxType, Prompt: input, Text: cleanedResponse, Elapsed: time.Since(start)}
+		if !ko.needsReview(ctxType, sinks, window, cleanedResponse) {
+			break
+		}
 
-			input, err := ko.showZenityInput()
-			if err != nil || input == "" {
+		if err := ko.waitTurn(job, ko.interactions.foreground); err != nil {
+			cancelled("interaction cancelled before review")
+			return
+		}
+		ko.setJobState(job, StateConfirming)
+		action, edited, err := ko.input.Review(ctx, cleanedResponse, reviewSendLabel(sinks))
+		release(ko.interactions.foreground)
+		if ctx.Err() != nil {
+			cancelled("interaction cancelled during review")
+			return
+		}
+		if err != nil {
+			fail("failed to show review dialog", err)
+			return
+		}
+		log.Info("response reviewed", "action", action)
+		switch action {
+		case ReviewRegenerate:
+			continue
+		case ReviewCopy:
+			entry.Response = edited
+			if err := ko.clipboard.Write(edited); err != nil {
+				fail("failed to copy response", err)
 				return
 			}
-			select {
-			case <-ctx.Done():
+			ko.recordHistory(log, entry, start)
+			ko.notify(log, Notification{Summary: "Keygeist: response copied", Urgency: UrgencyLow, Timeout: 3 * time.Second})
+			return
+		case ReviewSend:
+			entry.Response = edited
+			out.Text = edited
+		default:
+			cancelled("response discarded")
+			return
+		}
+		break
+	}
+
+	var errs []string
+	notified := false
+	for _, sink := range sinks {
+		var err error
+		if sink.usesKeyboard() {
+			// Responses are typed one at a time so that they never interleave
+			if err := ko.waitTurn(job, ko.interactions.typing); err != nil {
+				cancelled("interaction cancelled before typing")
 				return
-			default:
 			}
-			response, err := ko.queryOpenAIWithContext(ctx, input, ctxType, screenshots)
-			if err != nil {
-				return
+			ko.setJobState(job, StateTyping)
+			// The dialogs may have moved the focus away from the original window
+			if window.ID != "" {
+				if err := window.Focus(); err != nil {
+					log.Warn("failed to refocus the original window", "error", err)
+				} else {
+					time.Sleep(refocusDelay)
+				}
 			}
-			select {
-			case <-ctx.Done():
-				return
-			default:
+			err = ko.deliver(ctx, sink, out)
+			release(ko.interactions.typing)
+		} else {
+			ko.setJobState(job, StateDelivering)
+			err = ko.deliver(ctx, sink, out)
+		}
+		if err != nil {
+			log.Error("failed to deliver response", "output", sink.Type, "error", err)
+			errs = append(errs, fmt.Sprintf("%s: %v", sink.Type, err))
+			continue
+		}
+		notified = notified || sink.Type == SinkNotification
+	}
+	if len(errs) > 0 {
+		fail("failed to deliver response", errors.New(strings.Join(errs, "; ")))
+		return
+	}
+	log.Info("interaction completed", "latency", time.Since(start))
+	ko.recordHistory(log, entry, start)
+	// The notification output already replaced the progress notification
+	if !notified {
+		ko.notify(log, Notification{
+			Summary: "Keygeist: done",
+			Body:    fmt.Sprintf("Answered in %.1fs (model %.1fs)", time.Since(start).Seconds(), queryDuration.Seconds()),
+			Urgency: UrgencyLow,
+			Timeout: 3 * time.Second,
+		})
+	}
+}
+
+// refocusDelay lets the compositor settle after refocusing a window
+const refocusDelay = 150 * time.Millisecond
+
+// needsReview decides whether the response is shown for review before
+// delivery, according to the binding's confirm mode
+func (ko *KeyboardOperator) needsReview(binding string, sinks []SinkConfig, window WindowInfo, response string) bool {
+	switch ko.fileConfig.Bindings[binding].Confirm {
+	case ConfirmAlways:
+		return true
+	case "", ConfirmAuto:
+		// Only typing and pasting can run something by accident
+		for _, sink := range sinks {
+			if sink.usesKeyboard() {
+				return window.MatchesApp(ko.fileConfig.Interactions.terminalApps()) || strings.Contains(response, "\n")
 			}
-			// Clean the response before typing
-			cleanedResponse := ko.cleanResponse(response)
-			_ = ko.emulator.TypeText(cleanedResponse)
-		}()
+		}
 	}
+	return false
 }
 
-func (ko *KeyboardOperator) queryOpenAIWithContext(ctx context.Context, prompt, ctxType string, screenshots []string) (string, error) {
-	clipboardContent := ""
-	if ctxType == "clipboard" || ctxType == "all" {
-		clipboardContent = ko.getClipboardContent()
+// reviewSendLabel names the review action that delivers the response
+func reviewSendLabel(sinks []SinkConfig) string {
+	if len(sinks) == 1 {
+		switch sinks[0].Type {
+		case SinkType:
+			return "Type"
+		case SinkPaste:
+			return "Paste"
+		}
+	}
+	return "Send"
+}
+
+// queryOpenAIWithContext asks the model, offering it the tools of the
+// session when there is one
+func (ko *KeyboardOperator) queryOpenAIWithContext(ctx context.Context, log *slog.Logger, client *openai.Client, profile Profile, prompt, ctxType string, captured capturedContext, tools *toolSession) (string, error) {
+	sources := ko.bindingContext(ctxType)
+	clipboardContent, screenshots, clips := captured.clipboard, captured.screenshots, captured.clips
+	knowledgeContent := ""
+	if containsString(sources, ContextKnowledge) {
+		knowledgeContent = ko.getKnowledgeContent(ctx, log, prompt)
 	}
 
-	systemMessage := ko.systemPrompt
+	systemMessage := profile.SystemPrompt
 	userMessage := fmt.Sprintf("User question: %s\n\n", prompt)
 	if clipboardContent != "" {
 		userMessage += fmt.Sprintf("Clipboard content:\n%s\n\n", clipboardContent)
 	}
+	if captured.selection != "" {
+		userMessage += fmt.Sprintf("Selected text:\n%s\n\n", captured.selection)
+	}
+	if len(clips) > 0 {
+		userMessage += fmt.Sprintf("Recent clipboard entries (most recent first):\n%s\n", formatClips(clips))
+	}
+	if knowledgeContent != "" {
+		userMessage += knowledgeContent
+	}
+
+	// Text-only models get the text of the screenshots instead
+	ocrMode := ko.fileConfig.OCR.Mode
+	if len(screenshots) > 0 && (!profile.vision() || ocrMode == OCRAlways) {
+		if !profile.vision() && ocrMode == OCRNever {
+			log.Info("leaving screenshots out for a text-only model")
+		} else if text, err := ko.screenshotText(ctx, log, screenshots); err != nil {
+			if ctx.Err() != nil {
+				return "", ctx.Err()
+			}
+			log.Warn("failed to extract screenshot text", "error", err)
+		} else if text != "" {
+			userMessage += fmt.Sprintf("Text on the screen (OCR):\n%s\n\n", text)
+		}
+		if !profile.vision() {
+			screenshots = nil
+		}
+	}
 
 	messages := []openai.ChatCompletionMessage{
 		{
@@ -295,7 +720,7 @@ func (ko *KeyboardOperator) queryOpenAIWithContext(ctx context.Context, prompt,
 	}
 
 	if len(screenshots) > 0 {
-		fmt.Printf("Sending %d screenshots to OpenAI\n", len(screenshots))
+		log.Debug("attaching screenshots", "screenshots", len(screenshots))
 
 		// Create multi-content message with text and all screenshots
 		multiContent := []openai.ChatMessagePart{
@@ -327,85 +752,156 @@ func (ko *KeyboardOperator) queryOpenAIWithContext(ctx context.Context, prompt,
 		})
 	}
 
-	resp, err := ko.client.CreateChatCompletion(
-		ctx,
-		openai.ChatCompletionRequest{
-			Model:    ko.model,
-			Messages: messages,
-		},
-	)
-	if err != nil {
-		return "", fmt.Errorf("OpenAI API error: %v", err)
+	request := openai.ChatCompletionRequest{
+		Model:    profile.Model,
+		Messages: messages,
+	}
+	if tools != nil {
+		request.Tools = tools.registry.definitions()
 	}
-	if len(resp.Choices) == 0 {
-		return "", fmt.Errorf("no response from OpenAI")
+	for round := 0; ; round++ {
+		if len(request.Tools) > 0 && round >= tools.registry.maxRounds {
+			// Out of rounds: the model has to answer with what it has
+			log.Warn("tool call limit reached", "rounds", round)
+			request.ToolChoice = "none"
+		}
+		resp, err := client.CreateChatCompletion(ctx, request)
+		if err != nil {
+			return "", fmt.Errorf("OpenAI API error: %v", err)
+		}
+		if len(resp.Choices) == 0 {
+			return "", fmt.Errorf("no response from OpenAI")
+		}
+		message := resp.Choices[0].Message
+		// Tool calls are only answered when tools were offered and rounds
+		// are left; otherwise the text of the message is the answer
+		if len(message.ToolCalls) == 0 || len(request.Tools) == 0 || request.ToolChoice == "none" {
+			return message.Content, nil
+		}
+
+		request.Messages = append(request.Messages, message)
+		for _, call := range message.ToolCalls {
+			log.Debug("model called a tool", "tool", call.Function.Name, "arguments", call.Function.Arguments)
+			result := tools.registry.call(ctx, tools, call)
+			if ctx.Err() != nil {
+				return "", ctx.Err()
+			}
+			request.Messages = append(request.Messages, openai.ChatCompletionMessage{
+				Role:       openai.ChatMessageRoleTool,
+				Content:    result,
+				Name:       call.Function.Name,
+				ToolCallID: call.ID,
+			})
+		}
 	}
-	return resp.Choices[0].Message.Content, nil
 }
 
 func (ko *KeyboardOperator) Start() error {
 	// Parse key combinations from configuration
-	clipboardKeys, err := ParseKeyCombination(ko.config.ClipboardKey)
+	clipboardCombination, err := ParseKeyBinding("clipboard", ko.config.ClipboardKey)
 	if err != nil {
 		return fmt.Errorf("invalid clipboard key combination '%s': %v", ko.config.ClipboardKey, err)
 	}
 
-	screenshotKeys, err := ParseKeyCombination(ko.config.ScreenshotKey)
+	screenshotCombination, err := ParseKeyBinding("screenshot", ko.config.ScreenshotKey)
 	if err != nil {
 		return fmt.Errorf("invalid screenshot key combination '%s': %v", ko.config.ScreenshotKey, err)
 	}
 
-	allContextKeys, err := ParseKeyCombination(ko.config.AllContextKey)
+	allContextCombination, err := ParseKeyBinding("all", ko.config.AllContextKey)
 	if err != nil {
 		return fmt.Errorf("invalid all context key combination '%s': %v", ko.config.AllContextKey, err)
 	}
 
-	textOnlyKeys, err := ParseKeyCombination(ko.config.TextOnlyKey)
+	textOnlyCombination, err := ParseKeyBinding("textonly", ko.config.TextOnlyKey)
 	if err != nil {
 		return fmt.Errorf("invalid text only key combination '%s': %v", ko.config.TextOnlyKey, err)
 	}
 
 	// Register combinations with parsed keys
-	ko.listener.AddCombination("clipboard", clipboardKeys...)
-	ko.listener.OnCombination("clipboard", ko.handleCombinationContext("clipboard"))
-
-	ko.listener.AddCombination("screenshot", screenshotKeys...)
-	ko.listener.OnCombination("screenshot", ko.handleCombinationContext("screenshot"))
+	for _, combination := range []KeyCombination{clipboardCombination, screenshotCombination, allContextCombination, textOnlyCombination} {
+		ko.listener.AddKeyCombination(combination)
+		// Combinations made only of modifiers don't type a character that needs clearing
+		ko.listener.OnCombinationEvent(combination.Name, ko.handleCombinationContext(combination.Name, !combination.ModifiersOnly()))
+	}
 
-	ko.listener.AddCombination("all", allContextKeys...)
-	ko.listener.OnCombination("all", ko.handleCombinationContext("all"))
+	// The knowledge binding only exists when there is something to search
+	if ko.knowledge != nil && ko.config.KnowledgeKey != "" {
+		knowledgeCombination, err := ParseKeyBinding(ContextKnowledge, ko.config.KnowledgeKey)
+		if err != nil {
+			return fmt.Errorf("invalid knowledge key combination '%s': %v", ko.config.KnowledgeKey, err)
+		}
+		ko.listener.AddKeyCombination(knowledgeCombination)
+		ko.listener.OnCombinationEvent(ContextKnowledge, ko.handleCombinationContext(ContextKnowledge, !knowledgeCombination.ModifiersOnly()))
+	}
 
-	ko.listener.AddCombination("textonly", textOnlyKeys...)
-	ko.listener.OnCombination("textonly", ko.handleCombinationContext("textonly"))
+	if ko.voiceClient != nil && ko.config.VoiceKey != "" {
+		voiceCombination, err := ParseKeyBinding(voiceBinding, ko.config.VoiceKey)
+		if err != nil {
+			return fmt.Errorf("invalid voice key combination '%s': %v", ko.config.VoiceKey, err)
+		}
+		ko.listener.AddKeyCombination(voiceCombination)
+		ko.listener.OnCombinationEvent(voiceBinding, ko.handleCombinationContext(voiceBinding, !voiceCombination.ModifiersOnly()))
+	}
 
-	return ko.listener.Start()
-}
+	if ko.config.PauseKey != "" {
+		pauseCombination, err := ParseKeyBinding(pauseBinding, ko.config.PauseKey)
+		if err != nil {
+			return fmt.Errorf("invalid pause key combination '%s': %v", ko.config.PauseKey, err)
+		}
+		ko.listener.AddKeyCombination(pauseCombination)
+		ko.listener.OnCombination(pauseBinding, ko.TogglePause)
+	}
 
-func (ko *KeyboardOperator) cleanResponse(response string) string {
-	// Unwrap code blocks with language specifier (```lang\n...```)
-	codeBlockWithLang := regexp.MustCompile("(?m)```[a-zA-Z0-9_+-]*\\n([\\w\\W]*?)```[ \t\r\n]*")
-	response = codeBlockWithLang.ReplaceAllString(response, "$1")
+	if err := ko.listener.Start(); err != nil {
+		return err
+	}
 
-	// Unwrap code blocks without language specifier (```...```)
-	codeBlock := regexp.MustCompile("(?m)```\\n?([\\w\\W]*?)```[ \t\r\n]*")
-	response = codeBlock.ReplaceAllString(response, "$1")
+	if len(ko.fileConfig.Pause.Apps) > 0 {
+		ctx, cancel := context.WithCancel(context.Background())
+		ko.stopFocus = cancel
+		go ko.watchFocus(ctx)
+	}
 
-	// Remove thinking tags (<thinking>...</thinking>)
-	thinkingRegex := regexp.MustCompile("(?m)<thinking>[\\w\\W]*?</thinking>")
-	response = thinkingRegex.ReplaceAllString(response, "")
+	if ko.knowledge != nil {
+		ctx, cancel := context.WithCancel(context.Background())
+		ko.stopIndex = cancel
+		go ko.knowledge.Run(ctx)
+	}
 
-	// Remove think tags (<think>...</think>)
-	thinkRegex := regexp.MustCompile("(?m)<think>[\\w\\W]*?</think>")
-	response = thinkRegex.ReplaceAllString(response, "")
+	if ko.clipHistory != nil {
+		ctx, cancel := context.WithCancel(context.Background())
+		ko.stopClips = cancel
+		// Nothing is recorded while hotkeys are paused, e.g. with a password
+		// manager focused
+		ko.clipHistory.paused = ko.Paused
+		go ko.clipHistory.Run(ctx)
+	}
 
-	// Clean up extra whitespace and newlines
-	response = strings.TrimSpace(response)
+	if ko.expander != nil {
+		sub := ko.listener.Subscribe(SubscribeOptions{Buffer: 256})
+		go ko.expander.Run(context.Background(), sub)
+	}
+	return nil
+}
 
-	// Remove multiple consecutive newlines
-	newlineRegex := regexp.MustCompile("\\n{3,}")
-	response = newlineRegex.ReplaceAllString(response, "\n\n")
+// completeSnippet answers a prompt snippet with the configured model
+func (ko *KeyboardOperator) completeSnippet(ctx context.Context, prompt string) (string, error) {
+	profile, client := ko.currentProfile()
+	// No binding: a binding's context sources must not leak into snippets
+	response, err := ko.queryOpenAIWithContext(ctx, ko.logger, client, profile, prompt, "", capturedContext{}, nil)
+	if err != nil {
+		return "", err
+	}
+	return ko.processResponse("", response), nil
+}
 
-	return response
+// processResponse runs a response through the binding's pipeline
+func (ko *KeyboardOperator) processResponse(binding, response string) string {
+	if pipeline, ok := ko.pipelines[binding]; ok {
+		return pipeline.Process(response)
+	}
+	return ko.pipelines[""].Process(response)
 }
 
 func (ko *KeyboardOperator) GetConfig() *KeyBindingConfig {
@@ -0,0 +1,121 @@
+package keyboard
+
+import (
+	"context"
+	"time"
+)
+
+// pauseBinding is the name of the combination that toggles the pause; it
+// keeps working while paused
+const pauseBinding = "pause"
+
+// SetPaused pauses or resumes all hotkeys. Resuming also lifts an automatic
+// pause until another paused application gets the focus. The interaction in
+// progress, if any, is not affected.
+func (ko *KeyboardOperator) SetPaused(paused bool) {
+	ko.pauseMutex.Lock()
+	ko.manualPause = paused
+	if !paused {
+		ko.autoPauseApp = ""
+	}
+	ko.pauseMutex.Unlock()
+	ko.applyPause()
+}
+
+// TogglePause pauses hotkeys when active and resumes them when paused
+func (ko *KeyboardOperator) TogglePause() {
+	ko.SetPaused(!ko.Paused())
+}
+
+// Paused reports whether hotkeys are paused, manually or automatically
+func (ko *KeyboardOperator) Paused() bool {
+	return ko.paused.Load()
+}
+
+// setAutoPause pauses hotkeys because app is focused, or lifts the automatic
+// pause when app is empty
+func (ko *KeyboardOperator) setAutoPause(app string) {
+	ko.pauseMutex.Lock()
+	ko.autoPauseApp = app
+	ko.pauseMutex.Unlock()
+	ko.applyPause()
+}
+
+// applyPause updates the listener, observers and notification after the
+// manual or automatic pause changed
+func (ko *KeyboardOperator) applyPause() {
+	ko.pauseMutex.Lock()
+	paused := ko.manualPause || ko.autoPauseApp != ""
+	app := ko.autoPauseApp
+	if ko.paused.Swap(paused) == paused {
+		ko.pauseMutex.Unlock()
+		return
+	}
+	if paused {
+		ko.listener.Pause(pauseBinding)
+	} else {
+		ko.listener.Resume()
+	}
+	ko.pauseMutex.Unlock()
+
+	switch {
+	case paused && app != "":
+		ko.logger.Info("hotkeys paused", "app", app)
+		ko.notify(ko.logger, Notification{Summary: "Keygeist paused", Body: "Hotkeys are paused while " + app + " is focused", Urgency: UrgencyLow, Timeout: 3 * time.Second})
+	case paused:
+		ko.logger.Info("hotkeys paused")
+		ko.notify(ko.logger, Notification{Summary: "Keygeist paused", Body: "Hotkeys are paused until resumed", Urgency: UrgencyLow, Timeout: 3 * time.Second})
+	default:
+		ko.logger.Info("hotkeys resumed")
+		ko.notify(ko.logger, Notification{Summary: "Keygeist resumed", Urgency: UrgencyLow, Timeout: 3 * time.Second})
+	}
+	ko.refreshStatus()
+}
+
+// watchFocus pauses hotkeys while one of the configured applications is
+// focused, until ctx is done
+func (ko *KeyboardOperator) watchFocus(ctx context.Context) {
+	config := ko.fileConfig.Pause
+	ticker := time.NewTicker(config.pollInterval())
+	defer ticker.Stop()
+
+	lastApp := ""
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		window, err := ActiveWindow()
+		if err != nil {
+			ko.logger.Debug("cannot determine the focused window", "error", err)
+			continue
+		}
+		app := ""
+		if window.MatchesApp(config.Apps) {
+			app = window.Class
+		}
+		// Only react to focus changes, so that a manual resume sticks
+		if app != lastApp {
+			lastApp = app
+			ko.setAutoPause(app)
+		}
+	}
+}
+
+// registerPauseCommands adds pause, resume and toggle-pause to a control server
+func (ko *KeyboardOperator) registerPauseCommands(cs *ControlServer) {
+	cs.Handle("pause", func(args []string) (interface{}, error) {
+		ko.SetPaused(true)
+		return ko.Status(), nil
+	})
+	cs.Handle("resume", func(args []string) (interface{}, error) {
+		ko.SetPaused(false)
+		return ko.Status(), nil
+	})
+	cs.Handle("toggle-pause", func(args []string) (interface{}, error) {
+		ko.TogglePause()
+		return ko.Status(), nil
+	})
+}
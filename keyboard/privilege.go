@@ -0,0 +1,197 @@
+package keyboard
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// PrivilegeTarget is the unprivileged user the process switches to once the
+// input devices are open
+type PrivilegeTarget struct {
+	Username string
+	Home     string
+	UID      int
+	GID      int
+	Groups   []int
+}
+
+// ResolvePrivilegeTarget determines which user to drop to when running as
+// root: KEYGEIST_USER (name or uid) if set, otherwise the user that invoked
+// sudo (SUDO_UID/SUDO_GID). It returns nil when not running as root or when
+// there is no user to drop to.
+func ResolvePrivilegeTarget() (*PrivilegeTarget, error) {
+	if os.Geteuid() != 0 {
+		return nil, nil
+	}
+
+	var (
+		u   *user.User
+		err error
+	)
+	if name := os.Getenv("KEYGEIST_USER"); name != "" {
+		if _, convErr := strconv.Atoi(name); convErr == nil {
+			u, err = user.LookupId(name)
+		} else {
+			u, err = user.Lookup(name)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to look up KEYGEIST_USER %s: %v", name, err)
+		}
+	} else if uid := os.Getenv("SUDO_UID"); uid != "" && uid != "0" {
+		u, err = user.LookupId(uid)
+		if err != nil {
+			return nil, fmt.Errorf("failed to look up SUDO_UID %s: %v", uid, err)
+		}
+	} else {
+		return nil, nil
+	}
+
+	target := &PrivilegeTarget{
+		Username: u.Username,
+		Home:     u.HomeDir,
+	}
+	if target.UID, err = strconv.Atoi(u.Uid); err != nil {
+		return nil, fmt.Errorf("invalid uid %s: %v", u.Uid, err)
+	}
+	if target.GID, err = strconv.Atoi(u.Gid); err != nil {
+		return nil, fmt.Errorf("invalid gid %s: %v", u.Gid, err)
+	}
+	// sudo may have been invoked with a different primary group
+	if gid := os.Getenv("SUDO_GID"); gid != "" && os.Getenv("KEYGEIST_USER") == "" {
+		if target.GID, err = strconv.Atoi(gid); err != nil {
+			return nil, fmt.Errorf("invalid SUDO_GID %s: %v", gid, err)
+		}
+	}
+	if target.UID == 0 {
+		return nil, fmt.Errorf("refusing to drop privileges to root")
+	}
+
+	groupIDs, err := u.GroupIds()
+	if err != nil {
+		groupIDs = []string{strconv.Itoa(target.GID)}
+	}
+	for _, id := range groupIDs {
+		gid, err := strconv.Atoi(id)
+		if err != nil {
+			continue
+		}
+		target.Groups = append(target.Groups, gid)
+	}
+	return target, nil
+}
+
+// DropPrivileges irreversibly switches all threads of the process to the
+// target user and group, clears ambient capabilities and points the
+// per-user environment (HOME, XDG_RUNTIME_DIR, session bus) at that user.
+func DropPrivileges(target *PrivilegeTarget) error {
+	if err := clearAmbientCapabilities(); err != nil {
+		return fmt.Errorf("failed to clear ambient capabilities: %v", err)
+	}
+
+	// The syscall package applies these to every thread of the process
+	if err := syscall.Setgroups(target.Groups); err != nil {
+		return fmt.Errorf("failed to set groups: %v", err)
+	}
+	if err := syscall.Setresgid(target.GID, target.GID, target.GID); err != nil {
+		return fmt.Errorf("failed to set gid %d: %v", target.GID, err)
+	}
+	if err := syscall.Setresuid(target.UID, target.UID, target.UID); err != nil {
+		return fmt.Errorf("failed to set uid %d: %v", target.UID, err)
+	}
+
+	// Make sure there is no way back
+	if err := syscall.Setresuid(0, 0, 0); err == nil {
+		return fmt.Errorf("privileges could be regained after dropping them")
+	}
+
+	SetUserEnvironment(target)
+	return nil
+}
+
+// SetUserEnvironment points the per-user environment (USER, HOME,
+// XDG_RUNTIME_DIR, session bus) at target and forgets XDG base directories
+// outside its home. Call it before loading the configuration, so that the
+// configuration and the stores are the target user's rather than root's.
+func SetUserEnvironment(target *PrivilegeTarget) {
+	os.Setenv("USER", target.Username)
+	os.Setenv("LOGNAME", target.Username)
+	if target.Home != "" {
+		os.Setenv("HOME", target.Home)
+	}
+	for _, variable := range []string{"XDG_CONFIG_HOME", "XDG_CACHE_HOME", "XDG_DATA_HOME", "XDG_STATE_HOME"} {
+		dir := os.Getenv(variable)
+		if dir != "" && (target.Home == "" || !withinDir(dir, target.Home)) {
+			os.Unsetenv(variable)
+		}
+	}
+	runtimeDir := fmt.Sprintf("/run/user/%d", target.UID)
+	if _, err := os.Stat(runtimeDir); err == nil {
+		os.Setenv("XDG_RUNTIME_DIR", runtimeDir)
+		if os.Getenv("DBUS_SESSION_BUS_ADDRESS") == "" {
+			os.Setenv("DBUS_SESSION_BUS_ADDRESS", "unix:path="+runtimeDir+"/bus")
+		}
+	} else {
+		os.Unsetenv("XDG_RUNTIME_DIR")
+	}
+}
+
+// withinDir reports whether path is dir or below it
+func withinDir(path, dir string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, "../")
+}
+
+// clearAmbientCapabilities clears the ambient capability set on all threads
+func clearAmbientCapabilities() error {
+	_, _, errno := syscall.AllThreadsSyscall6(syscall.SYS_PRCTL, unix.PR_CAP_AMBIENT, unix.PR_CAP_AMBIENT_CLEAR_ALL, 0, 0, 0, 0)
+	switch errno {
+	case 0:
+		return nil
+	case syscall.ENOTSUP:
+		// Not available in cgo builds, clear at least the current thread
+		return unix.Prctl(unix.PR_CAP_AMBIENT, unix.PR_CAP_AMBIENT_CLEAR_ALL, 0, 0, 0)
+	case syscall.EINVAL:
+		// Kernel without ambient capabilities
+		return nil
+	default:
+		return errno
+	}
+}
+
+// helperAllowed returns an error when external helpers must not run because
+// the process is still root. Set KEYGEIST_ALLOW_ROOT_HELPERS=1 to override.
+func helperAllowed(name string) error {
+	if os.Geteuid() == 0 && os.Getenv("KEYGEIST_ALLOW_ROOT_HELPERS") != "1" {
+		return fmt.Errorf("refusing to run %s as root; run keygeist as your user or via sudo so it can drop privileges", name)
+	}
+	return nil
+}
+
+// helperCommand builds the command for an external helper (dialogs,
+// screenshot tools, window queries), refusing to do so as root
+func helperCommand(ctx context.Context, name string, args ...string) (*exec.Cmd, error) {
+	if err := helperAllowed(name); err != nil {
+		return nil, err
+	}
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Env = os.Environ()
+	return cmd, nil
+}
+
+// helperOutput runs an external helper and returns its standard output
+func helperOutput(name string, args ...string) ([]byte, error) {
+	cmd, err := helperCommand(context.Background(), name, args...)
+	if err != nil {
+		return nil, err
+	}
+	return cmd.Output()
+}
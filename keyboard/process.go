@@ -0,0 +1,171 @@
+package keyboard
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// ResponseProcessor transforms a model response before it is delivered
+type ResponseProcessor func(string) string
+
+// ResponsePipeline is an ordered list of processors
+type ResponsePipeline []ResponseProcessor
+
+// DefaultResponsePipeline is applied to bindings without a process option
+var DefaultResponsePipeline = []string{"unwrap_fences", "strip_thinking", "trim", "collapse_newlines"}
+
+// Patterns used by the processors, compiled once
+var (
+	fenceWithLangRegex = regexp.MustCompile("(?m)```[a-zA-Z0-9_+-]*\\n([\\w\\W]*?)```[ \t\r\n]*")
+	fenceRegex         = regexp.MustCompile("(?m)```\\n?([\\w\\W]*?)```[ \t\r\n]*")
+	firstFenceRegex    = regexp.MustCompile("```(?:[a-zA-Z0-9_+-]*[ \t]*\\n)?([\\w\\W]*?)```")
+	thinkingRegex      = regexp.MustCompile("(?m)<thinking>[\\w\\W]*?</thinking>")
+	thinkRegex         = regexp.MustCompile("(?m)<think>[\\w\\W]*?</think>")
+	newlinesRegex      = regexp.MustCompile("\\n{3,}")
+
+	markdownFenceRegex   = regexp.MustCompile("^\\s*```")
+	markdownHeadingRegex = regexp.MustCompile(`^\s{0,3}#{1,6}\s+`)
+	markdownQuoteRegex   = regexp.MustCompile(`^\s{0,3}>\s?`)
+	markdownBulletRegex  = regexp.MustCompile(`^(\s*)[*+]\s+`)
+	markdownRuleRegex    = regexp.MustCompile(`^\s{0,3}([*_-])(\s*[*_-]){2,}\s*$`)
+	markdownImageRegex   = regexp.MustCompile(`!\[([^\]]*)\]\([^)]*\)`)
+	markdownLinkRegex    = regexp.MustCompile(`\[([^\]]+)\]\(([^)\s]+)[^)]*\)`)
+	markdownBoldRegex    = regexp.MustCompile(`\*\*([^*]+)\*\*|__([^_]+)__`)
+	markdownItalicRegex  = regexp.MustCompile(`\*([^*\s][^*]*)\*|\b_([^_]+)_\b`)
+	markdownStrikeRegex  = regexp.MustCompile(`~~([^~]+)~~`)
+)
+
+// asciiReplacer maps typographic characters to their ASCII equivalents
+var asciiReplacer = strings.NewReplacer(
+	"‘", "'", "’", "'", "‚", "'", "‛", "'", "′", "'",
+	"“", `"`, "”", `"`, "„", `"`, "‟", `"`, "″", `"`, "«", `"`, "»", `"`,
+	"–", "-", "—", "-", "‐", "-", "‑", "-", "−", "-",
+	"…", "...", " ", " ", " ", " ",
+)
+
+// responseProcessors are the processors without an argument, by name
+var responseProcessors = map[string]ResponseProcessor{
+	// unwrap_fences removes the ``` lines around code blocks
+	"unwrap_fences": func(text string) string {
+		text = fenceWithLangRegex.ReplaceAllString(text, "$1")
+		return fenceRegex.ReplaceAllString(text, "$1")
+	},
+	// strip_thinking drops the reasoning of thinking models
+	"strip_thinking": func(text string) string {
+		text = thinkingRegex.ReplaceAllString(text, "")
+		return thinkRegex.ReplaceAllString(text, "")
+	},
+	"trim": strings.TrimSpace,
+	// collapse_newlines keeps at most one blank line in a row
+	"collapse_newlines": func(text string) string {
+		return newlinesRegex.ReplaceAllString(text, "\n\n")
+	},
+	// first_code_block keeps only the first fenced code block, if any
+	"first_code_block": func(text string) string {
+		if match := firstFenceRegex.FindStringSubmatch(text); match != nil {
+			return match[1]
+		}
+		return text
+	},
+	// strip_trailing_newlines keeps a typed command from being executed
+	"strip_trailing_newlines": func(text string) string {
+		return strings.TrimRight(text, "\r\n")
+	},
+	"markdown_to_text": markdownToText,
+	// ascii_quotes replaces smart quotes, dashes and ellipses
+	"ascii_quotes": asciiReplacer.Replace,
+}
+
+// ResponseProcessorNames lists the processors a pipeline can use
+var ResponseProcessorNames = []string{"unwrap_fences", "strip_thinking", "trim", "collapse_newlines", "first_code_block", "strip_trailing_newlines", "markdown_to_text", "ascii_quotes", "max_length:N"}
+
+// NewResponsePipeline builds a pipeline from processor names, in order.
+// max_length takes its limit in characters as in "max_length:500".
+func NewResponsePipeline(specs []string) (ResponsePipeline, error) {
+	pipeline := make(ResponsePipeline, 0, len(specs))
+	for _, spec := range specs {
+		name, arg, hasArg := strings.Cut(spec, ":")
+		if name == "max_length" {
+			limit, err := strconv.Atoi(arg)
+			if !hasArg || err != nil || limit <= 0 {
+				return nil, fmt.Errorf("max_length needs a positive limit, as in max_length:500")
+			}
+			pipeline = append(pipeline, maxLength(limit))
+			continue
+		}
+		processor, ok := responseProcessors[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown response processor '%s' (available: %s)", spec, strings.Join(ResponseProcessorNames, ", "))
+		}
+		if hasArg {
+			return nil, fmt.Errorf("response processor '%s' takes no argument", name)
+		}
+		pipeline = append(pipeline, processor)
+	}
+	return pipeline, nil
+}
+
+// Process runs the response through every processor
+func (p ResponsePipeline) Process(text string) string {
+	for _, processor := range p {
+		text = processor(text)
+	}
+	return text
+}
+
+// maxLength cuts responses to limit characters
+func maxLength(limit int) ResponseProcessor {
+	return func(text string) string {
+		runes := []rune(text)
+		if len(runes) <= limit {
+			return text
+		}
+		return string(runes[:limit])
+	}
+}
+
+// markdownToText removes Markdown formatting, keeping the content of code
+// blocks as is and link targets in parentheses
+func markdownToText(text string) string {
+	lines := strings.Split(text, "\n")
+	out := lines[:0]
+	inFence := false
+	for _, line := range lines {
+		if markdownFenceRegex.MatchString(line) {
+			inFence = !inFence
+			continue
+		}
+		if inFence {
+			out = append(out, line)
+			continue
+		}
+		if markdownRuleRegex.MatchString(line) {
+			out = append(out, "")
+			continue
+		}
+		line = markdownHeadingRegex.ReplaceAllString(line, "")
+		line = markdownQuoteRegex.ReplaceAllString(line, "")
+		line = markdownBulletRegex.ReplaceAllString(line, "$1- ")
+		// Inline code spans are the odd parts between backticks
+		parts := strings.Split(line, "`")
+		if len(parts)%2 == 0 {
+			parts = []string{line}
+		}
+		for i := 0; i < len(parts); i += 2 {
+			parts[i] = markdownInline(parts[i])
+		}
+		out = append(out, strings.Join(parts, ""))
+	}
+	return strings.Join(out, "\n")
+}
+
+// markdownInline removes inline Markdown formatting
+func markdownInline(text string) string {
+	text = markdownImageRegex.ReplaceAllString(text, "$1")
+	text = markdownLinkRegex.ReplaceAllString(text, "$1 ($2)")
+	text = markdownBoldRegex.ReplaceAllString(text, "$1$2")
+	text = markdownItalicRegex.ReplaceAllString(text, "$1$2")
+	return markdownStrikeRegex.ReplaceAllString(text, "$1")
+}
@@ -0,0 +1,83 @@
+package keyboard
+
+import "testing"
+
+// processWith builds the pipeline and runs text through it
+func processWith(t *testing.T, specs []string, text string) string {
+	t.Helper()
+	pipeline, err := NewResponsePipeline(specs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pipeline.Process(text)
+}
+
+// The default pipeline cleans responses as they always were
+func TestDefaultResponsePipeline(t *testing.T) {
+	for _, test := range []struct {
+		name, text, want string
+	}{
+		{"fence with a language", "```go\nfmt.Println(1)\n```\n", "fmt.Println(1)"},
+		{"fence without a language", "Here:\n```\necho hi\n```\nDone", "Here:\necho hi\nDone"},
+		{"fence on one line", "```ls -la```", "ls -la"},
+		{"think block", "<think>plan\nsteps</think>\n\nAnswer", "Answer"},
+		{"thinking block", "<thinking>a\nb</thinking>Answer", "Answer"},
+		{"runs of newlines", "one\n\n\n\ntwo\n\n\nthree", "one\n\ntwo\n\nthree"},
+		{"surrounding space", "  \n text \n", "text"},
+		{"all at once", "<think>x</think>\n```python\nprint(1)\n```\n\n\n\nafter", "print(1)\nafter"},
+		{"plain text", "Just an answer.", "Just an answer."},
+	} {
+		if got := processWith(t, DefaultResponsePipeline, test.text); got != test.want {
+			t.Errorf("%s: got %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestMarkdownToText(t *testing.T) {
+	for _, test := range []struct {
+		text, want string
+	}{
+		{"# Title\n\nSome **bold** and *italic* text", "Title\n\nSome bold and italic text"},
+		{"> quoted\n* item\n  + nested", "quoted\n- item\n  - nested"},
+		{"[docs](https://example.com \"Docs\") and ![alt](img.png)", "docs (https://example.com) and alt"},
+		{"use `**raw**` here", "use **raw** here"},
+		{"```\n# not a heading\n```", "# not a heading"},
+		{"a\n---\nb", "a\n\nb"},
+		{"~~gone~~ snake_case_name and __strong__", "gone snake_case_name and strong"},
+	} {
+		if got := processWith(t, []string{"markdown_to_text"}, test.text); got != test.want {
+			t.Errorf("markdown_to_text(%q) = %q, want %q", test.text, got, test.want)
+		}
+	}
+}
+
+func TestFirstCodeBlock(t *testing.T) {
+	for _, test := range []struct {
+		text, want string
+	}{
+		{"Run this:\n```sh\nls -la\n```\nthen\n```\nrm x\n```", "ls -la\n"},
+		{"```echo hi```", "echo hi"},
+		{"No code here", "No code here"},
+	} {
+		if got := processWith(t, []string{"first_code_block"}, test.text); got != test.want {
+			t.Errorf("first_code_block(%q) = %q, want %q", test.text, got, test.want)
+		}
+	}
+}
+
+func TestResponsePipelineSpecs(t *testing.T) {
+	if got := processWith(t, []string{"max_length:5"}, "héllo world"); got != "héllo" {
+		t.Errorf("max_length:5 = %q, want héllo", got)
+	}
+	if got := processWith(t, []string{"max_length:50"}, "short"); got != "short" {
+		t.Errorf("max_length:50 = %q, want short", got)
+	}
+	if got := processWith(t, []string{"trim", "max_length:3", "ascii_quotes"}, "  “quoted”  "); got != `"qu` {
+		t.Errorf("pipeline = %q, want the processors applied in order", got)
+	}
+	for _, spec := range []string{"max_length", "max_length:", "max_length:0", "max_length:-1", "max_length:abc", "trim:1", "unknown"} {
+		if _, err := NewResponsePipeline([]string{spec}); err == nil {
+			t.Errorf("NewResponsePipeline(%q) succeeded, want an error", spec)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package keyboard
+
+import (
+	"fmt"
+
+	openai "github.com/sashabaranov/go-openai"
+)
+
+// newOpenAIClient creates a client for an API key and optional base URL
+func newOpenAIClient(apiKey, baseURL string) *openai.Client {
+	config := openai.DefaultConfig(apiKey)
+	if baseURL != "" {
+		config.BaseURL = baseURL
+	}
+	return openai.NewClientWithConfig(config)
+}
+
+// resolveProfiles returns the default profile followed by the configured
+// ones, with empty fields filled in from the default
+func resolveProfiles(defaults Profile, configured []Profile) []Profile {
+	defaults.Name = DefaultProfileName
+	profiles := []Profile{defaults}
+	for _, profile := range configured {
+		if profile.Model == "" {
+			profile.Model = defaults.Model
+		}
+		if profile.BaseURL == "" {
+			profile.BaseURL = defaults.BaseURL
+		}
+		if profile.APIKey == "" {
+			profile.APIKey = defaults.APIKey
+		}
+		if profile.SystemPrompt == "" {
+			profile.SystemPrompt = defaults.SystemPrompt
+		}
+		if profile.Vision == nil {
+			profile.Vision = defaults.Vision
+		}
+		profiles = append(profiles, profile)
+	}
+	return profiles
+}
+
+// Profiles returns the names of the available profiles
+func (ko *KeyboardOperator) Profiles() []string {
+	ko.profileMutex.Lock()
+	defer ko.profileMutex.Unlock()
+	names := make([]string, len(ko.profiles))
+	for i, profile := range ko.profiles {
+		names[i] = profile.Name
+	}
+	return names
+}
+
+// ActiveProfile returns the name and model of the active profile
+func (ko *KeyboardOperator) ActiveProfile() (string, string) {
+	profile, _ := ko.currentProfile()
+	return profile.Name, profile.Model
+}
+
+// ProfileModel returns the model of the named profile
+func (ko *KeyboardOperator) ProfileModel(name string) string {
+	ko.profileMutex.Lock()
+	defer ko.profileMutex.Unlock()
+	for _, profile := range ko.profiles {
+		if profile.Name == name {
+			return profile.Model
+		}
+	}
+	return ""
+}
+
+// SetProfile switches the profile used by the next interactions
+func (ko *KeyboardOperator) SetProfile(name string) error {
+	ko.profileMutex.Lock()
+	index := -1
+	for i, profile := range ko.profiles {
+		if profile.Name == name {
+			index = i
+			break
+		}
+	}
+	if index < 0 {
+		ko.profileMutex.Unlock()
+		return fmt.Errorf("unknown profile: %s", name)
+	}
+	profile := ko.profiles[index]
+	ko.profile = index
+	ko.client = newOpenAIClient(profile.APIKey, profile.BaseURL)
+	ko.profileMutex.Unlock()
+
+	ko.logger.Info("switched profile", "profile", profile.Name, "model", profile.Model)
+	ko.refreshStatus()
+	return nil
+}
+
+// currentProfile returns the active profile and its client
+func (ko *KeyboardOperator) currentProfile() (Profile, *openai.Client) {
+	ko.profileMutex.Lock()
+	defer ko.profileMutex.Unlock()
+	return ko.profiles[ko.profile], ko.client
+}
@@ -0,0 +1,180 @@
+package keyboard
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+)
+
+// Secret Service (org.freedesktop.secrets), implemented by GNOME Keyring,
+// KWallet and KeePassXC
+const (
+	secretsService   = "org.freedesktop.secrets"
+	secretsPath      = dbus.ObjectPath("/org/freedesktop/secrets")
+	secretsInterface = "org.freedesktop.Secret."
+)
+
+// secretPromptTimeout bounds an unlock prompt, where the user may have to
+// type the keyring password
+const secretPromptTimeout = 2 * time.Minute
+
+// secretValue is the (oayays) secret structure of the Secret Service API
+type secretValue struct {
+	Session     dbus.ObjectPath
+	Parameters  []byte
+	Value       []byte
+	ContentType string
+}
+
+// secretKey returns the 32 byte key stored in the user's keyring under
+// attributes, creating a random one on first use
+func secretKey(label string, attributes map[string]string) ([]byte, error) {
+	conn, err := dbus.ConnectSessionBus()
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to the session bus: %v", err)
+	}
+	defer conn.Close()
+	return secretKeyOn(conn, label, attributes)
+}
+
+// secretKeyOn is secretKey on an existing connection, such as a private
+// session bus
+func secretKeyOn(conn *dbus.Conn, label string, attributes map[string]string) ([]byte, error) {
+	service := conn.Object(secretsService, secretsPath)
+	var output dbus.Variant
+	var session dbus.ObjectPath
+	if err := service.Call(secretsInterface+"Service.OpenSession", 0, "plain", dbus.MakeVariant("")).Store(&output, &session); err != nil {
+		return nil, fmt.Errorf("no Secret Service keyring (GNOME Keyring, KWallet or KeePassXC) on the session bus: %v", err)
+	}
+	defer conn.Object(secretsService, session).Call(secretsInterface+"Session.Close", 0)
+
+	var unlocked, locked []dbus.ObjectPath
+	if err := service.Call(secretsInterface+"Service.SearchItems", 0, attributes).Store(&unlocked, &locked); err != nil {
+		return nil, fmt.Errorf("failed to search the keyring: %v", err)
+	}
+	if len(unlocked) == 0 && len(locked) > 0 {
+		var err error
+		if unlocked, err = secretUnlock(conn, locked[:1]); err != nil {
+			return nil, err
+		}
+		if len(unlocked) == 0 {
+			return nil, fmt.Errorf("the keyring holding '%s' is locked", label)
+		}
+	}
+
+	if len(unlocked) > 0 {
+		var secret secretValue
+		if err := conn.Object(secretsService, unlocked[0]).Call(secretsInterface+"Item.GetSecret", 0, session).Store(&secret); err != nil {
+			return nil, fmt.Errorf("failed to read the key from the keyring: %v", err)
+		}
+		if len(secret.Value) != 32 {
+			return nil, fmt.Errorf("the keyring item '%s' must hold 32 bytes", label)
+		}
+		return secret.Value, nil
+	}
+	return secretCreateKey(conn, session, label, attributes)
+}
+
+// secretCreateKey stores a new random key in the default collection
+func secretCreateKey(conn *dbus.Conn, session dbus.ObjectPath, label string, attributes map[string]string) ([]byte, error) {
+	service := conn.Object(secretsService, secretsPath)
+	var collection dbus.ObjectPath
+	if err := service.Call(secretsInterface+"Service.ReadAlias", 0, "default").Store(&collection); err != nil {
+		return nil, fmt.Errorf("failed to find the default keyring: %v", err)
+	}
+	if collection == "/" {
+		return nil, fmt.Errorf("no default keyring; create one in your keyring manager")
+	}
+	locked, err := conn.Object(secretsService, collection).GetProperty(secretsInterface + "Collection.Locked")
+	if err != nil {
+		return nil, fmt.Errorf("failed to query the default keyring: %v", err)
+	}
+	if isLocked, _ := locked.Value().(bool); isLocked {
+		unlocked, err := secretUnlock(conn, []dbus.ObjectPath{collection})
+		if err != nil {
+			return nil, err
+		}
+		if len(unlocked) == 0 {
+			return nil, fmt.Errorf("the default keyring is locked")
+		}
+	}
+
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return nil, err
+	}
+	properties := map[string]dbus.Variant{
+		secretsInterface + "Item.Label":      dbus.MakeVariant(label),
+		secretsInterface + "Item.Attributes": dbus.MakeVariant(attributes),
+	}
+	secret := secretValue{Session: session, Parameters: []byte{}, Value: key, ContentType: "application/octet-stream"}
+	var item, prompt dbus.ObjectPath
+	if err := conn.Object(secretsService, collection).Call(secretsInterface+"Collection.CreateItem", 0, properties, secret, true).Store(&item, &prompt); err != nil {
+		return nil, fmt.Errorf("failed to store the key in the keyring: %v", err)
+	}
+	if prompt != "/" {
+		if _, err := secretPrompt(conn, prompt); err != nil {
+			return nil, err
+		}
+	}
+	return key, nil
+}
+
+// secretUnlock unlocks objects, prompting the user when the keyring asks
+// to, and returns those unlocked
+func secretUnlock(conn *dbus.Conn, objects []dbus.ObjectPath) ([]dbus.ObjectPath, error) {
+	var unlocked []dbus.ObjectPath
+	var prompt dbus.ObjectPath
+	if err := conn.Object(secretsService, secretsPath).Call(secretsInterface+"Service.Unlock", 0, objects).Store(&unlocked, &prompt); err != nil {
+		return nil, fmt.Errorf("failed to unlock the keyring: %v", err)
+	}
+	if prompt == "/" {
+		return unlocked, nil
+	}
+	result, err := secretPrompt(conn, prompt)
+	if err != nil {
+		return nil, err
+	}
+	unlocked, _ = result.Value().([]dbus.ObjectPath)
+	return unlocked, nil
+}
+
+// secretPrompt shows a keyring prompt and waits for its result
+func secretPrompt(conn *dbus.Conn, prompt dbus.ObjectPath) (dbus.Variant, error) {
+	if err := conn.AddMatchSignal(
+		dbus.WithMatchObjectPath(prompt),
+		dbus.WithMatchInterface(secretsInterface+"Prompt"),
+		dbus.WithMatchMember("Completed"),
+	); err != nil {
+		return dbus.Variant{}, fmt.Errorf("failed to watch the keyring prompt: %v", err)
+	}
+	signals := make(chan *dbus.Signal, 4)
+	conn.Signal(signals)
+	defer conn.RemoveSignal(signals)
+
+	ctx, cancel := context.WithTimeout(context.Background(), secretPromptTimeout)
+	defer cancel()
+	if err := conn.Object(secretsService, prompt).CallWithContext(ctx, secretsInterface+"Prompt.Prompt", 0, "").Err; err != nil {
+		return dbus.Variant{}, fmt.Errorf("failed to show the keyring prompt: %v", err)
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			conn.Object(secretsService, prompt).Call(secretsInterface+"Prompt.Dismiss", 0)
+			return dbus.Variant{}, fmt.Errorf("no answer to the keyring prompt")
+		case signal := <-signals:
+			if signal.Path != prompt || len(signal.Body) < 2 {
+				continue
+			}
+			if dismissed, _ := signal.Body[0].(bool); dismissed {
+				return dbus.Variant{}, fmt.Errorf("the keyring prompt was dismissed")
+			}
+			result, _ := signal.Body[1].(dbus.Variant)
+			return result, nil
+		}
+	}
+}
@@ -0,0 +1,156 @@
+package keyboard
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/godbus/dbus/v5"
+)
+
+// stubSecrets implements the parts of the Secret Service used for keys:
+// one default collection, locked until unlocked without a prompt
+type stubSecrets struct {
+	mu     sync.Mutex
+	locked bool
+	items  map[dbus.ObjectPath]stubSecretItem
+}
+
+type stubSecretItem struct {
+	attributes map[string]string
+	value      []byte
+}
+
+const stubCollection = dbus.ObjectPath("/org/freedesktop/secrets/collection/login")
+
+func (s *stubSecrets) OpenSession(algorithm string, input dbus.Variant) (dbus.Variant, dbus.ObjectPath, *dbus.Error) {
+	if algorithm != "plain" {
+		return dbus.Variant{}, "/", dbus.MakeFailedError(fmt.Errorf("unsupported algorithm"))
+	}
+	return dbus.MakeVariant(""), "/org/freedesktop/secrets/session/1", nil
+}
+
+func (s *stubSecrets) SearchItems(attributes map[string]string) ([]dbus.ObjectPath, []dbus.ObjectPath, *dbus.Error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	unlocked, locked := []dbus.ObjectPath{}, []dbus.ObjectPath{}
+	for path, item := range s.items {
+		match := true
+		for key, value := range attributes {
+			match = match && item.attributes[key] == value
+		}
+		if match && s.locked {
+			locked = append(locked, path)
+		} else if match {
+			unlocked = append(unlocked, path)
+		}
+	}
+	return unlocked, locked, nil
+}
+
+func (s *stubSecrets) Unlock(objects []dbus.ObjectPath) ([]dbus.ObjectPath, dbus.ObjectPath, *dbus.Error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.locked = false
+	return objects, "/", nil
+}
+
+func (s *stubSecrets) ReadAlias(name string) (dbus.ObjectPath, *dbus.Error) {
+	return stubCollection, nil
+}
+
+// stubCollectionObject implements the default collection
+type stubCollectionObject struct{ *stubSecrets }
+
+func (c stubCollectionObject) CreateItem(properties map[string]dbus.Variant, secret secretValue, replace bool) (dbus.ObjectPath, dbus.ObjectPath, *dbus.Error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.locked {
+		return "/", "/", dbus.MakeFailedError(fmt.Errorf("collection is locked"))
+	}
+	attributes, _ := properties[secretsInterface+"Item.Attributes"].Value().(map[string]string)
+	path := dbus.ObjectPath(fmt.Sprintf("%s/%d", stubCollection, len(c.items)+1))
+	c.items[path] = stubSecretItem{attributes: attributes, value: secret.Value}
+	return path, "/", nil
+}
+
+func (c stubCollectionObject) Get(iface, property string) (dbus.Variant, *dbus.Error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return dbus.MakeVariant(c.locked), nil
+}
+
+// stubItemObject implements an item
+type stubItemObject struct {
+	*stubSecrets
+	path dbus.ObjectPath
+}
+
+func (i stubItemObject) GetSecret(session dbus.ObjectPath) (secretValue, *dbus.Error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if i.locked {
+		return secretValue{}, dbus.MakeFailedError(fmt.Errorf("item is locked"))
+	}
+	return secretValue{Session: session, Parameters: []byte{}, Value: i.items[i.path].value, ContentType: "application/octet-stream"}, nil
+}
+
+func (s *stubSecrets) Close() *dbus.Error { return nil }
+
+func TestSecretKeyCreatedOnceAndUnlocked(t *testing.T) {
+	address := startSessionBus(t)
+	server := connectBus(t, address)
+	stub := &stubSecrets{items: map[dbus.ObjectPath]stubSecretItem{}}
+	server.Export(stub, secretsPath, secretsInterface+"Service")
+	server.Export(stub, "/org/freedesktop/secrets/session/1", secretsInterface+"Session")
+	server.Export(stubCollectionObject{stub}, stubCollection, secretsInterface+"Collection")
+	server.Export(stubCollectionObject{stub}, stubCollection, "org.freedesktop.DBus.Properties")
+	for i := 1; i <= 2; i++ {
+		path := dbus.ObjectPath(fmt.Sprintf("%s/%d", stubCollection, i))
+		server.Export(stubItemObject{stub, path}, path, secretsInterface+"Item")
+	}
+	if reply, err := server.RequestName(secretsService, dbus.NameFlagDoNotQueue); err != nil || reply != dbus.RequestNameReplyPrimaryOwner {
+		t.Fatalf("failed to own %s: %v", secretsService, err)
+	}
+
+	client := connectBus(t, address)
+	attributes := map[string]string{"application": "keygeist-test"}
+	key, err := secretKeyOn(client, "test key", attributes)
+	if err != nil {
+		t.Fatalf("secretKeyOn: %v", err)
+	}
+	if len(key) != 32 {
+		t.Fatalf("key has %d bytes, want 32", len(key))
+	}
+
+	// Later calls find the stored key, unlocking the keyring if needed
+	stub.mu.Lock()
+	stub.locked = true
+	stub.mu.Unlock()
+	again, err := secretKeyOn(client, "test key", attributes)
+	if err != nil {
+		t.Fatalf("secretKeyOn after locking: %v", err)
+	}
+	if !bytes.Equal(again, key) {
+		t.Error("the stored key was not returned")
+	}
+	if len(stub.items) != 1 {
+		t.Errorf("keyring holds %d items, want 1", len(stub.items))
+	}
+}
+
+func TestClipboardKeyRefusesHistoryDirectory(t *testing.T) {
+	dir := t.TempDir()
+	if _, err := clipboardKey(dir+"/clipboard.key", dir); err == nil {
+		t.Error("clipboardKey created a key next to the history")
+	}
+	other := t.TempDir()
+	key, err := clipboardKey(other+"/clipboard.key", dir)
+	if err != nil || len(key) != 32 {
+		t.Fatalf("clipboardKey = %d bytes, %v", len(key), err)
+	}
+	if again, err := clipboardKey(other+"/clipboard.key", dir); err != nil || !bytes.Equal(again, key) {
+		t.Errorf("clipboardKey did not read back the key: %v", err)
+	}
+}
@@ -0,0 +1,191 @@
+package keyboard
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Output sink types
+const (
+	SinkType         = "type"
+	SinkPaste        = "paste"
+	SinkClipboard    = "clipboard"
+	SinkNotification = "notification"
+	SinkPopup        = "popup"
+	SinkFile         = "file"
+	SinkCommand      = "command"
+)
+
+// sinkCommandTimeout bounds how long a command sink may run
+const sinkCommandTimeout = 30 * time.Second
+
+// SinkConfig selects where a response goes
+type SinkConfig struct {
+	// Type is one of type, paste, clipboard, notification, popup, file or command
+	Type string `json:"type"`
+	// Keys is the paste shortcut for the paste sink (default ctrl+v)
+	Keys string `json:"keys,omitempty"`
+	// Path is the file the file sink appends to
+	Path string `json:"path,omitempty"`
+	// Command is the program and arguments the command sink runs, with the
+	// response on its standard input
+	Command []string `json:"command,omitempty"`
+}
+
+// Validate checks that the sink has the settings its type needs
+func (sc SinkConfig) Validate() error {
+	switch sc.Type {
+	case SinkType, SinkClipboard, SinkNotification, SinkPopup:
+	case SinkPaste:
+		if sc.Keys != "" {
+			if _, err := ParseKeyCombination(sc.Keys); err != nil {
+				return err
+			}
+		}
+	case SinkFile:
+		if sc.Path == "" {
+			return fmt.Errorf("file sink needs a path")
+		}
+	case SinkCommand:
+		if len(sc.Command) == 0 {
+			return fmt.Errorf("command sink needs a command")
+		}
+	default:
+		return fmt.Errorf("unknown output type '%s'", sc.Type)
+	}
+	return nil
+}
+
+// usesKeyboard reports whether the sink sends key events, and must take
+// turns with the other jobs
+func (sc SinkConfig) usesKeyboard() bool {
+	return sc.Type == SinkType || sc.Type == SinkPaste
+}
+
+// Output is a response ready to be delivered
+type Output struct {
+	Binding string
+	Prompt  string
+	Text    string
+	Elapsed time.Duration
+}
+
+// outputSinks returns the sinks of a binding, typing the response by default
+func (ko *KeyboardOperator) outputSinks(binding string) []SinkConfig {
+	if sinks := ko.fileConfig.Bindings[binding].Output; len(sinks) > 0 {
+		return sinks
+	}
+	return []SinkConfig{{Type: SinkType}}
+}
+
+// deliver sends an output to one sink
+func (ko *KeyboardOperator) deliver(ctx context.Context, sink SinkConfig, out Output) error {
+	switch sink.Type {
+	case SinkType:
+		return ko.emulator.TypeText(out.Text)
+	case SinkPaste:
+		return ko.pasteOutput(sink, out)
+	case SinkClipboard:
+		return ko.clipboard.Write(out.Text)
+	case SinkNotification:
+		return ko.notifier.Notify(Notification{
+			Summary: fmt.Sprintf("Keygeist (%s, %.1fs)", out.Binding, out.Elapsed.Seconds()),
+			Body:    out.Text,
+		})
+	case SinkPopup:
+		return showPopup(out)
+	case SinkFile:
+		return appendOutputFile(sink.Path, out)
+	case SinkCommand:
+		return runOutputCommand(ctx, sink.Command, out)
+	default:
+		return fmt.Errorf("unknown output type '%s'", sink.Type)
+	}
+}
+
+// pasteOutput puts the text on the clipboard and presses the paste shortcut
+func (ko *KeyboardOperator) pasteOutput(sink SinkConfig, out Output) error {
+	combination := sink.Keys
+	if combination == "" {
+		combination = "ctrl+v"
+	}
+	keys, err := ParseKeyCombination(combination)
+	if err != nil {
+		return err
+	}
+	if err := ko.clipboard.Write(out.Text); err != nil {
+		return err
+	}
+	codes := make([]int, len(keys))
+	for i, key := range keys {
+		codes[i] = int(key)
+	}
+	return ko.emulator.PressHotkey(codes...)
+}
+
+// showPopup shows the response in a read-only zenity window without waiting
+// for it to be closed
+func showPopup(out Output) error {
+	cmd, err := helperCommand(context.Background(), "zenity", "--text-info",
+		"--title=Keygeist ("+out.Binding+")", "--width=600", "--height=400")
+	if err != nil {
+		return err
+	}
+	cmd.Stdin = strings.NewReader(out.Text)
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to show popup: %v", err)
+	}
+	go cmd.Wait()
+	return nil
+}
+
+// appendOutputFile appends the prompt and response to a notes file
+func appendOutputFile(path string, out Output) error {
+	if strings.HasPrefix(path, "~/") {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return err
+		}
+		path = filepath.Join(home, path[2:])
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("failed to create directory for %s: %v", path, err)
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %v", path, err)
+	}
+	defer file.Close()
+	entry := fmt.Sprintf("## %s (%s)\n\n> %s\n\n%s\n\n",
+		time.Now().Format("2006-01-02 15:04:05"), out.Binding,
+		strings.ReplaceAll(out.Prompt, "\n", "\n> "), out.Text)
+	if _, err := file.WriteString(entry); err != nil {
+		return fmt.Errorf("failed to write %s: %v", path, err)
+	}
+	return nil
+}
+
+// runOutputCommand runs a command with the response on its standard input
+// and the prompt and binding in KEYGEIST_PROMPT and KEYGEIST_BINDING
+func runOutputCommand(ctx context.Context, command []string, out Output) error {
+	ctx, cancel := context.WithTimeout(ctx, sinkCommandTimeout)
+	defer cancel()
+	cmd, err := helperCommand(ctx, command[0], command[1:]...)
+	if err != nil {
+		return err
+	}
+	cmd.Stdin = strings.NewReader(out.Text)
+	cmd.Env = append(cmd.Env, "KEYGEIST_PROMPT="+out.Prompt, "KEYGEIST_BINDING="+out.Binding)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		if _, ok := err.(*exec.ExitError); ok {
+			return fmt.Errorf("%s failed: %v: %s", command[0], err, strings.TrimSpace(string(output)))
+		}
+		return fmt.Errorf("failed to run %s: %v", command[0], err)
+	}
+	return nil
+}
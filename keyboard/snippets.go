@@ -0,0 +1,295 @@
+package keyboard
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync/atomic"
+	"text/template"
+	"time"
+	"unicode/utf8"
+)
+
+// maxSnippetBuffer bounds the number of characters remembered since the last delimiter
+const maxSnippetBuffer = 64
+
+// snippetCompletionTimeout bounds how long a prompt snippet waits for the LLM
+const snippetCompletionTimeout = 60 * time.Second
+
+// SnippetExpander replaces typed abbreviations with their expansion. It
+// tracks a rolling buffer of characters typed on the listened keyboard and,
+// when a delimiter follows a snippet trigger, erases the trigger and types
+// the expansion with the emulator.
+type SnippetExpander struct {
+	logger    *slog.Logger
+	config    SnippetConfig
+	emulator  *KeyboardEmulator
+	clipboard ClipboardBackend
+	complete  func(ctx context.Context, prompt string) (string, error)
+	// typing is the operator's typing slot, held while a snippet is typed
+	typing chan struct{}
+
+	buffer    []rune
+	shift     map[uint16]bool
+	modifiers map[uint16]bool
+
+	expanding   atomic.Bool
+	typedDuring atomic.Int32
+}
+
+// NewSnippetExpander creates a snippet expander. clipboard is read by the
+// clipboard template function; complete is used for prompt snippets and
+// may be nil if none are configured. typing is the slot taken to type, so
+// that snippets and other outputs never interleave.
+func NewSnippetExpander(config SnippetConfig, emulator *KeyboardEmulator, clipboard ClipboardBackend, typing chan struct{}, complete func(ctx context.Context, prompt string) (string, error)) *SnippetExpander {
+	return &SnippetExpander{
+		logger:    slog.Default(),
+		config:    config,
+		emulator:  emulator,
+		clipboard: clipboard,
+		typing:    typing,
+		complete:  complete,
+		shift:     make(map[uint16]bool),
+		modifiers: make(map[uint16]bool),
+	}
+}
+
+// SetLogger sets the logger used by the expander; call it before Run
+func (se *SnippetExpander) SetLogger(logger *slog.Logger) {
+	se.logger = logger
+}
+
+// Run consumes key events from the subscription until it is closed or ctx is done
+func (se *SnippetExpander) Run(ctx context.Context, sub *Subscription) {
+	defer sub.Close()
+	se.logger.Info("text expansion enabled", "snippets", len(se.config.Library))
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event, ok := <-sub.C:
+			if !ok {
+				return
+			}
+			se.handleEvent(ctx, event)
+		}
+	}
+}
+
+// handleEvent updates the typed buffer and starts an expansion on a trigger match
+func (se *SnippetExpander) handleEvent(ctx context.Context, event KeyEvent) {
+	held := event.Action != KeyActionRelease
+	switch event.Code {
+	case KEY_LEFTSHIFT, KEY_RIGHTSHIFT:
+		se.shift[event.Code] = held
+		return
+	case KEY_LEFTCTRL, KEY_RIGHTCTRL, KEY_LEFTALT, KEY_RIGHTALT, KEY_LEFTMETA, KEY_RIGHTMETA:
+		// Shortcuts move the cursor or edit text in ways we can't follow
+		se.modifiers[event.Code] = held
+		se.reset()
+		return
+	}
+	if event.Action == KeyActionRelease {
+		return
+	}
+
+	if se.expanding.Load() {
+		se.typedDuring.Add(1)
+		se.reset()
+		return
+	}
+	if se.modifierHeld() {
+		se.reset()
+		return
+	}
+
+	if event.Code == KEY_BACKSPACE {
+		if len(se.buffer) > 0 {
+			se.buffer = se.buffer[:len(se.buffer)-1]
+		}
+		return
+	}
+
+	char, ok := se.eventChar(event.Code)
+	if !ok {
+		// Navigation and other non-printable keys invalidate the buffer
+		se.reset()
+		return
+	}
+
+	if strings.ContainsRune(se.config.delimiters(), char) {
+		word := string(se.buffer)
+		se.reset()
+		if snippet, found := se.lookup(word); found {
+			se.expanding.Store(true)
+			se.typedDuring.Store(0)
+			go se.expand(ctx, snippet, char)
+		}
+		return
+	}
+	// Enter submits the line and tab moves the focus or completes the word:
+	// expanding afterwards would erase the wrong text, so they only end it
+	if char == '\n' || char == '\t' {
+		se.reset()
+		return
+	}
+
+	se.buffer = append(se.buffer, char)
+	if len(se.buffer) > maxSnippetBuffer {
+		se.buffer = se.buffer[len(se.buffer)-maxSnippetBuffer:]
+	}
+}
+
+// eventChar converts a key code to the character it types
+func (se *SnippetExpander) eventChar(code uint16) (rune, bool) {
+	switch code {
+	case KEY_ENTER:
+		return '\n', true
+	case KEY_TAB:
+		return '\t', true
+	}
+	return keyCodeToChar(code, se.shift[KEY_LEFTSHIFT] || se.shift[KEY_RIGHTSHIFT])
+}
+
+// modifierHeld checks if ctrl, alt or meta is currently held
+func (se *SnippetExpander) modifierHeld() bool {
+	for _, held := range se.modifiers {
+		if held {
+			return true
+		}
+	}
+	return false
+}
+
+// reset clears the typed buffer
+func (se *SnippetExpander) reset() {
+	se.buffer = se.buffer[:0]
+}
+
+// lookup finds the snippet for a trigger
+func (se *SnippetExpander) lookup(trigger string) (Snippet, bool) {
+	if trigger == "" {
+		return Snippet{}, false
+	}
+	for _, snippet := range se.config.Library {
+		if snippet.Trigger == trigger {
+			return snippet, true
+		}
+	}
+	return Snippet{}, false
+}
+
+// expand renders a snippet and replaces the typed trigger with it
+func (se *SnippetExpander) expand(ctx context.Context, snippet Snippet, delimiter rune) {
+	defer se.expanding.Store(false)
+	log := se.logger.With("snippet", snippet.Trigger)
+
+	if !se.enabledFor(snippet) {
+		log.Debug("snippet disabled for the focused application")
+		return
+	}
+
+	start := time.Now()
+	text, err := se.render(ctx, snippet)
+	if err != nil {
+		log.Error("failed to expand snippet", "error", err, "latency", time.Since(start))
+		return
+	}
+
+	// Erasing the trigger is only safe if the cursor hasn't moved meanwhile
+	if se.typedDuring.Load() > 0 {
+		log.Warn("skipping snippet, keys were typed during expansion")
+		return
+	}
+
+	// Another output being typed has moved the cursor away from the
+	// trigger, so the expansion is dropped rather than waiting for it
+	select {
+	case se.typing <- struct{}{}:
+	default:
+		log.Warn("skipping snippet, another output is being typed")
+		return
+	}
+	defer release(se.typing)
+
+	erase := strings.Repeat("\b", utf8.RuneCountInString(snippet.Trigger)+1)
+	if err := se.emulator.TypeText(erase + text + string(delimiter)); err != nil {
+		log.Error("failed to type snippet", "error", err)
+		return
+	}
+	log.Debug("expanded snippet", "chars", utf8.RuneCountInString(text), "latency", time.Since(start))
+}
+
+// enabledFor checks the per-application settings against the focused window
+func (se *SnippetExpander) enabledFor(snippet Snippet) bool {
+	allow := snippet.Apps
+	if len(allow) == 0 {
+		allow = se.config.EnabledApps
+	}
+	if len(allow) == 0 && len(se.config.DisabledApps) == 0 {
+		return true
+	}
+
+	window, err := ActiveWindow()
+	if err != nil {
+		se.logger.Warn("failed to detect the focused application", "error", err)
+		// Without knowing the application, only an allow list can decide
+		return len(allow) == 0
+	}
+	if window.MatchesApp(se.config.DisabledApps) {
+		return false
+	}
+	return len(allow) == 0 || window.MatchesApp(allow)
+}
+
+// render produces the expansion text for a snippet
+func (se *SnippetExpander) render(ctx context.Context, snippet Snippet) (string, error) {
+	if snippet.Text != "" {
+		return snippet.Text, nil
+	}
+
+	source := snippet.Template
+	if snippet.Prompt != "" {
+		source = snippet.Prompt
+	}
+	tmpl, err := template.New(snippet.Trigger).Funcs(snippetFuncs(se.clipboard)).Parse(source)
+	if err != nil {
+		return "", fmt.Errorf("invalid template: %v", err)
+	}
+	var rendered strings.Builder
+	if err := tmpl.Execute(&rendered, nil); err != nil {
+		return "", fmt.Errorf("failed to render template: %v", err)
+	}
+	if snippet.Prompt == "" {
+		return rendered.String(), nil
+	}
+
+	if se.complete == nil {
+		return "", fmt.Errorf("no LLM configured for prompt snippets")
+	}
+	ctx, cancel := context.WithTimeout(ctx, snippetCompletionTimeout)
+	defer cancel()
+	return se.complete(ctx, rendered.String())
+}
+
+// snippetFuncs returns the functions available to snippet templates
+func snippetFuncs(clipboard ClipboardBackend) template.FuncMap {
+	return template.FuncMap{
+		"date": func(layout string) string {
+			return time.Now().Format(layout)
+		},
+		"now": time.Now,
+		"clipboard": func() string {
+			content, err := clipboard.Read()
+			if err != nil {
+				return ""
+			}
+			return strings.TrimSpace(content)
+		},
+		"upper": strings.ToUpper,
+		"lower": strings.ToLower,
+		"trim":  strings.TrimSpace,
+	}
+}
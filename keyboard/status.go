@@ -0,0 +1,103 @@
+package keyboard
+
+import (
+	"fmt"
+	"time"
+)
+
+// InteractionState is the phase the operator is in
+type InteractionState string
+
+const (
+	StateIdle         InteractionState = "idle"
+	StateQueued       InteractionState = "queued"
+	StateCapturing    InteractionState = "capturing"
+	StatePrompting    InteractionState = "prompting"
+	StateRecording    InteractionState = "recording"
+	StateTranscribing InteractionState = "transcribing"
+	StateWaiting      InteractionState = "waiting"
+	StateTyping       InteractionState = "typing"
+	StateConfirming   InteractionState = "confirming"
+	StateDelivering   InteractionState = "delivering"
+	StateError        InteractionState = "error"
+)
+
+// InteractionStatus describes what the operator is currently doing
+type InteractionStatus struct {
+	State   InteractionState `json:"state"`
+	Binding string           `json:"binding,omitempty"`
+	Profile string           `json:"profile"`
+	Paused  bool             `json:"paused"`
+	Jobs    int              `json:"jobs"`
+	Since   time.Time        `json:"since"`
+	Error   string           `json:"error,omitempty"`
+}
+
+// String returns a short human readable description of the status
+func (s InteractionStatus) String() string {
+	var text string
+	switch s.State {
+	case StateQueued:
+		text = "Queued"
+	case StateCapturing:
+		text = "Capturing context"
+	case StatePrompting:
+		text = "Waiting for prompt"
+	case StateRecording:
+		text = "Listening"
+	case StateTranscribing:
+		text = "Transcribing prompt"
+	case StateWaiting:
+		text = "Waiting for model"
+	case StateTyping:
+		text = "Typing response"
+	case StateConfirming:
+		text = "Waiting for confirmation"
+	case StateDelivering:
+		text = "Delivering response"
+	case StateError:
+		return fmt.Sprintf("Error: %s", s.Error)
+	default:
+		if s.Paused {
+			return "Paused"
+		}
+		return "Idle"
+	}
+	if s.Binding != "" {
+		text += fmt.Sprintf(" (%s)", s.Binding)
+	}
+	if s.Jobs > 1 {
+		text += fmt.Sprintf(", %d jobs", s.Jobs)
+	}
+	return text
+}
+
+// Status returns the current interaction status
+func (ko *KeyboardOperator) Status() InteractionStatus {
+	ko.statusMutex.Lock()
+	defer ko.statusMutex.Unlock()
+	return ko.status
+}
+
+// OnStatusChange registers a callback invoked after every status change
+func (ko *KeyboardOperator) OnStatusChange(callback func(InteractionStatus)) {
+	ko.statusMutex.Lock()
+	defer ko.statusMutex.Unlock()
+	ko.statusCallbacks = append(ko.statusCallbacks, callback)
+}
+
+// refreshStatus recomputes the status from the jobs, profile and pause
+// state, and notifies the observers outside the lock
+func (ko *KeyboardOperator) refreshStatus() {
+	ko.statusMutex.Lock()
+	status := ko.interactions.status()
+	status.Profile, _ = ko.ActiveProfile()
+	status.Paused = ko.Paused()
+	ko.status = status
+	callbacks := append([]func(InteractionStatus){}, ko.statusCallbacks...)
+	ko.statusMutex.Unlock()
+
+	for _, callback := range callbacks {
+		callback(status)
+	}
+}
@@ -0,0 +1,324 @@
+package keyboard
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// KeyAction describes what happened to a key
+type KeyAction int
+
+const (
+	KeyActionRelease KeyAction = iota
+	KeyActionPress
+	KeyActionRepeat
+)
+
+// String returns a human readable name for the action
+func (a KeyAction) String() string {
+	switch a {
+	case KeyActionPress:
+		return "press"
+	case KeyActionRepeat:
+		return "repeat"
+	default:
+		return "release"
+	}
+}
+
+// KeyEvent is a decoded key event delivered to subscribers
+type KeyEvent struct {
+	Device string
+	Code   uint16
+	Name   string
+	Action KeyAction
+	Time   time.Time
+}
+
+// BackpressurePolicy decides what happens when a subscriber falls behind
+type BackpressurePolicy int
+
+const (
+	// DropNewest discards the incoming event when the channel is full
+	DropNewest BackpressurePolicy = iota
+	// DropOldest discards the oldest queued event to make room for the new one
+	DropOldest
+	// Block stalls the event loop until the subscriber catches up or
+	// BlockTimeout elapses
+	Block
+)
+
+// defaultSubscriptionBuffer is the channel size used when SubscribeOptions.Buffer is zero
+const defaultSubscriptionBuffer = 64
+
+// SubscribeOptions configures a key event subscription
+type SubscribeOptions struct {
+	// Buffer is the channel capacity (defaults to 64)
+	Buffer int
+	// Codes restricts delivery to these key codes (all keys when empty)
+	Codes []uint16
+	// Actions restricts delivery to these actions (all actions when empty)
+	Actions []KeyAction
+	// Filter, if set, must return true for an event to be delivered
+	Filter func(KeyEvent) bool
+	// Policy selects the backpressure behavior (defaults to DropNewest)
+	Policy BackpressurePolicy
+	// BlockTimeout bounds how long the Block policy may stall the event
+	// loop; zero waits until the event is consumed or the subscription closed
+	BlockTimeout time.Duration
+}
+
+// Subscription delivers key events over a channel until closed
+type Subscription struct {
+	// C receives the events; it is closed when the subscription or the
+	// listener ends
+	C <-chan KeyEvent
+
+	ch       chan KeyEvent
+	opts     SubscribeOptions
+	listener *KeyboardListener
+	closing  chan struct{}
+	once     sync.Once
+	dropped  atomic.Uint64
+}
+
+// Subscribe returns a subscription receiving decoded key events alongside
+// the registered combination callbacks
+func (kl *KeyboardListener) Subscribe(opts SubscribeOptions) *Subscription {
+	if opts.Buffer <= 0 {
+		opts.Buffer = defaultSubscriptionBuffer
+	}
+	ch := make(chan KeyEvent, opts.Buffer)
+	sub := &Subscription{
+		C:        ch,
+		ch:       ch,
+		opts:     opts,
+		listener: kl,
+		closing:  make(chan struct{}),
+	}
+
+	kl.subsMu.Lock()
+	defer kl.subsMu.Unlock()
+	if kl.subsClosed {
+		close(sub.closing)
+		close(sub.ch)
+		sub.once.Do(func() {})
+		return sub
+	}
+	if kl.subscribers == nil {
+		kl.subscribers = make(map[*Subscription]struct{})
+	}
+	kl.subscribers[sub] = struct{}{}
+	return sub
+}
+
+// Close ends the subscription and closes its channel
+func (s *Subscription) Close() {
+	s.once.Do(func() {
+		close(s.closing)
+		s.listener.subsMu.Lock()
+		delete(s.listener.subscribers, s)
+		s.listener.subsMu.Unlock()
+		close(s.ch)
+	})
+}
+
+// Dropped returns how many events were discarded by the backpressure policy
+func (s *Subscription) Dropped() uint64 {
+	return s.dropped.Load()
+}
+
+// matches checks the subscription filters against an event
+func (s *Subscription) matches(event KeyEvent) bool {
+	if len(s.opts.Codes) > 0 {
+		found := false
+		for _, code := range s.opts.Codes {
+			if code == event.Code {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if len(s.opts.Actions) > 0 {
+		found := false
+		for _, action := range s.opts.Actions {
+			if action == event.Action {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return s.opts.Filter == nil || s.opts.Filter(event)
+}
+
+// deliver sends an event according to the backpressure policy
+func (s *Subscription) deliver(event KeyEvent) {
+	if !s.matches(event) {
+		return
+	}
+
+	switch s.opts.Policy {
+	case Block:
+		var timeout <-chan time.Time
+		if s.opts.BlockTimeout > 0 {
+			timer := time.NewTimer(s.opts.BlockTimeout)
+			defer timer.Stop()
+			timeout = timer.C
+		}
+		select {
+		case s.ch <- event:
+		case <-s.closing:
+		case <-timeout:
+			s.dropped.Add(1)
+		}
+	case DropOldest:
+		for {
+			select {
+			case s.ch <- event:
+				return
+			default:
+			}
+			select {
+			case <-s.ch:
+				s.dropped.Add(1)
+			default:
+			}
+		}
+	default:
+		select {
+		case s.ch <- event:
+		default:
+			s.dropped.Add(1)
+		}
+	}
+}
+
+// publish delivers a raw input event to all subscribers
+func (kl *KeyboardListener) publish(device string, event InputEvent) {
+	kl.subsMu.RLock()
+	defer kl.subsMu.RUnlock()
+	if len(kl.subscribers) == 0 {
+		return
+	}
+
+	keyEvent := KeyEvent{
+		Device: device,
+		Code:   event.Code,
+		Name:   KeyName(event.Code),
+		Action: KeyAction(event.Value),
+		Time:   time.Unix(event.Time.Sec, event.Time.Usec*int64(time.Microsecond)),
+	}
+	for sub := range kl.subscribers {
+		sub.deliver(keyEvent)
+	}
+}
+
+// closeSubscribers ends all subscriptions once the event loop has exited
+func (kl *KeyboardListener) closeSubscribers() {
+	kl.subsMu.Lock()
+	kl.subsClosed = true
+	subs := make([]*Subscription, 0, len(kl.subscribers))
+	for sub := range kl.subscribers {
+		subs = append(subs, sub)
+	}
+	kl.subsMu.Unlock()
+
+	for _, sub := range subs {
+		sub.Close()
+	}
+}
+
+// KeyName returns the lowercase name of a key code, e.g. "a", "leftctrl" or "f5"
+func KeyName(code uint16) string {
+	if name, ok := keyNames[code]; ok {
+		return name
+	}
+	return fmt.Sprintf("key%d", code)
+}
+
+// keyNames maps key codes to the names returned by KeyName
+var keyNames = map[uint16]string{
+	KEY_ESC:        "esc",
+	KEY_1:          "1",
+	KEY_2:          "2",
+	KEY_3:          "3",
+	KEY_4:          "4",
+	KEY_5:          "5",
+	KEY_6:          "6",
+	KEY_7:          "7",
+	KEY_8:          "8",
+	KEY_9:          "9",
+	KEY_0:          "0",
+	KEY_MINUS:      "minus",
+	KEY_EQUAL:      "equal",
+	KEY_BACKSPACE:  "backspace",
+	KEY_TAB:        "tab",
+	KEY_Q:          "q",
+	KEY_W:          "w",
+	KEY_E:          "e",
+	KEY_R:          "r",
+	KEY_T:          "t",
+	KEY_Y:          "y",
+	KEY_U:          "u",
+	KEY_I:          "i",
+	KEY_O:          "o",
+	KEY_P:          "p",
+	KEY_LEFTBRACE:  "leftbrace",
+	KEY_RIGHTBRACE: "rightbrace",
+	KEY_ENTER:      "enter",
+	KEY_LEFTCTRL:   "leftctrl",
+	KEY_A:          "a",
+	KEY_S:          "s",
+	KEY_D:          "d",
+	KEY_F:          "f",
+	KEY_G:          "g",
+	KEY_H:          "h",
+	KEY_J:          "j",
+	KEY_K:          "k",
+	KEY_L:          "l",
+	KEY_SEMICOLON:  "semicolon",
+	KEY_APOSTROPHE: "apostrophe",
+	KEY_GRAVE:      "grave",
+	KEY_LEFTSHIFT:  "leftshift",
+	KEY_BACKSLASH:  "backslash",
+	KEY_Z:          "z",
+	KEY_X:          "x",
+	KEY_C:          "c",
+	KEY_V:          "v",
+	KEY_B:          "b",
+	KEY_N:          "n",
+	KEY_M:          "m",
+	KEY_COMMA:      "comma",
+	KEY_DOT:        "dot",
+	KEY_SLASH:      "slash",
+	KEY_RIGHTSHIFT: "rightshift",
+	KEY_LEFTALT:    "leftalt",
+	KEY_SPACE:      "space",
+	KEY_CAPSLOCK:   "capslock",
+	KEY_F1:         "f1",
+	KEY_F2:         "f2",
+	KEY_F3:         "f3",
+	KEY_F4:         "f4",
+	KEY_F5:         "f5",
+	KEY_F6:         "f6",
+	KEY_F7:         "f7",
+	KEY_F8:         "f8",
+	KEY_F9:         "f9",
+	KEY_F10:        "f10",
+	KEY_SCROLLLOCK: "scrolllock",
+	KEY_F11:        "f11",
+	KEY_F12:        "f12",
+	KEY_RIGHTCTRL:  "rightctrl",
+	KEY_RIGHTALT:   "rightalt",
+	KEY_PAUSE:      "pause",
+	KEY_LEFTMETA:   "leftmeta",
+	KEY_RIGHTMETA:  "rightmeta",
+}
@@ -0,0 +1,437 @@
+package keyboard
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	openai "github.com/sashabaranov/go-openai"
+)
+
+// Tool limits used when the configuration doesn't set them
+const (
+	DefaultToolTimeout   = 10 * time.Second
+	DefaultToolMaxOutput = 8000
+	DefaultToolMaxRounds = 5
+)
+
+// ToolEnv is what a tool may need to know about the interaction calling it
+type ToolEnv struct {
+	// Window is the window focused when the binding was pressed
+	Window WindowInfo
+}
+
+// Tool is a local action the model can call
+type Tool struct {
+	Name        string
+	Description string
+	// Parameters is the JSON schema of the arguments
+	Parameters json.RawMessage
+	// Confirm asks the user before every call
+	Confirm bool
+	Run     func(ctx context.Context, env ToolEnv, arguments json.RawMessage) (string, error)
+}
+
+// ToolRegistry holds the tools offered to the model
+type ToolRegistry struct {
+	mu        sync.RWMutex
+	tools     map[string]*Tool
+	timeout   time.Duration
+	maxOutput int
+	maxRounds int
+}
+
+// NewToolRegistry creates an empty registry with the limits of config
+func NewToolRegistry(config ToolsConfig) *ToolRegistry {
+	registry := &ToolRegistry{
+		tools:     make(map[string]*Tool),
+		timeout:   DefaultToolTimeout,
+		maxOutput: DefaultToolMaxOutput,
+		maxRounds: DefaultToolMaxRounds,
+	}
+	if config.TimeoutSeconds > 0 {
+		registry.timeout = time.Duration(config.TimeoutSeconds) * time.Second
+	}
+	if config.MaxOutputBytes > 0 {
+		registry.maxOutput = config.MaxOutputBytes
+	}
+	if config.MaxRounds > 0 {
+		registry.maxRounds = config.MaxRounds
+	}
+	return registry
+}
+
+// Register adds a tool. A tool already registered under the same name is
+// kept, so that one tool can't shadow another, and an error is returned.
+func (tr *ToolRegistry) Register(tool Tool) error {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	if _, exists := tr.tools[tool.Name]; exists {
+		return fmt.Errorf("a tool named '%s' is already registered", tool.Name)
+	}
+	tr.tools[tool.Name] = &tool
+	return nil
+}
+
+// Names returns the registered tool names in order
+func (tr *ToolRegistry) Names() []string {
+	tr.mu.RLock()
+	defer tr.mu.RUnlock()
+	names := make([]string, 0, len(tr.tools))
+	for name := range tr.tools {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// definitions describes the tools for the chat completion request
+func (tr *ToolRegistry) definitions() []openai.Tool {
+	var tools []openai.Tool
+	for _, name := range tr.Names() {
+		tool := tr.lookup(name)
+		tools = append(tools, openai.Tool{
+			Type: openai.ToolTypeFunction,
+			Function: &openai.FunctionDefinition{
+				Name:        tool.Name,
+				Description: tool.Description,
+				Parameters:  tool.Parameters,
+			},
+		})
+	}
+	return tools
+}
+
+// lookup returns the tool with the given name, or nil
+func (tr *ToolRegistry) lookup(name string) *Tool {
+	tr.mu.RLock()
+	defer tr.mu.RUnlock()
+	return tr.tools[name]
+}
+
+// call runs a tool requested by the model. Failures are reported to the
+// model as the result rather than ending the interaction.
+func (tr *ToolRegistry) call(ctx context.Context, session *toolSession, call openai.ToolCall) string {
+	log := session.log.With("tool", call.Function.Name)
+	tool := tr.lookup(call.Function.Name)
+	if tool == nil {
+		log.Warn("model called an unknown tool")
+		return fmt.Sprintf("error: unknown tool %s", call.Function.Name)
+	}
+	arguments := json.RawMessage(call.Function.Arguments)
+	if len(arguments) == 0 {
+		arguments = json.RawMessage("{}")
+	}
+
+	if tool.Confirm {
+		allowed, err := session.confirm(ctx, fmt.Sprintf("Allow the model to run %s with %s?", tool.Name, string(arguments)))
+		if err != nil {
+			log.Warn("tool confirmation failed", "error", err)
+			return fmt.Sprintf("error: confirmation failed: %v", err)
+		}
+		if !allowed {
+			log.Info("tool call denied by the user")
+			return "error: the user denied this tool call"
+		}
+	}
+
+	start := time.Now()
+	callCtx, cancel := context.WithTimeout(ctx, tr.timeout)
+	defer cancel()
+	result, err := tool.Run(callCtx, session.env, arguments)
+	if err != nil {
+		log.Warn("tool call failed", "error", err, "latency", time.Since(start))
+		return fmt.Sprintf("error: %v", err)
+	}
+	log.Info("tool call completed", "latency", time.Since(start), "bytes", len(result))
+	return truncateOutput(result, tr.maxOutput)
+}
+
+// truncateOutput cuts text to at most max bytes, without splitting a
+// character, saying how much was dropped
+func truncateOutput(text string, max int) string {
+	if len(text) <= max {
+		return text
+	}
+	for max > 0 && !utf8.RuneStart(text[max]) {
+		max--
+	}
+	return fmt.Sprintf("%s\n[truncated %d bytes]", text[:max], len(text)-max)
+}
+
+// builtinTools returns the built-in tools for config; clipboard_history
+// reads history when it is recorded, and the current clipboard otherwise
+func builtinTools(config ToolsConfig, clipboard ClipboardBackend, history *ClipboardHistory) map[string]Tool {
+	return map[string]Tool{
+		"read_file": {
+			Name:        "read_file",
+			Description: "Read a text file from the user's computer",
+			Parameters:  json.RawMessage(`{"type":"object","properties":{"path":{"type":"string","description":"Absolute path, or relative to the home directory"}},"required":["path"]}`),
+			Confirm:     config.confirm("read_file", true),
+			Run: func(ctx context.Context, env ToolEnv, arguments json.RawMessage) (string, error) {
+				var args struct {
+					Path string `json:"path"`
+				}
+				if err := json.Unmarshal(arguments, &args); err != nil {
+					return "", fmt.Errorf("invalid arguments: %v", err)
+				}
+				path, err := config.allowedPath(args.Path)
+				if err != nil {
+					return "", err
+				}
+				file, err := os.Open(path)
+				if err != nil {
+					return "", err
+				}
+				defer file.Close()
+				// Read past the limit so that the truncation is reported
+				data, err := io.ReadAll(io.LimitReader(file, int64(config.maxOutput())+1024))
+				if err != nil {
+					return "", err
+				}
+				return string(data), nil
+			},
+		},
+		"list_directory": {
+			Name:        "list_directory",
+			Description: "List the entries of a directory on the user's computer",
+			Parameters:  json.RawMessage(`{"type":"object","properties":{"path":{"type":"string","description":"Absolute path, or relative to the home directory"}},"required":["path"]}`),
+			Confirm:     config.confirm("list_directory", true),
+			Run: func(ctx context.Context, env ToolEnv, arguments json.RawMessage) (string, error) {
+				var args struct {
+					Path string `json:"path"`
+				}
+				if err := json.Unmarshal(arguments, &args); err != nil {
+					return "", fmt.Errorf("invalid arguments: %v", err)
+				}
+				path, err := config.allowedPath(args.Path)
+				if err != nil {
+					return "", err
+				}
+				entries, err := os.ReadDir(path)
+				if err != nil {
+					return "", err
+				}
+				var lines []string
+				for _, entry := range entries {
+					name := entry.Name()
+					// Hidden entries can't be read, so they aren't listed
+					if strings.HasPrefix(name, ".") {
+						continue
+					}
+					if entry.IsDir() {
+						name += "/"
+					} else if info, err := entry.Info(); err == nil {
+						name = fmt.Sprintf("%s (%d bytes)", name, info.Size())
+					}
+					lines = append(lines, name)
+				}
+				return strings.Join(lines, "\n"), nil
+			},
+		},
+		"run_command": {
+			Name:        "run_command",
+			Description: "Run one of the allowed commands and return its output. Allowed commands: " + strings.Join(config.Commands, ", "),
+			Parameters:  json.RawMessage(`{"type":"object","properties":{"command":{"type":"string"},"args":{"type":"array","items":{"type":"string"}}},"required":["command"]}`),
+			Confirm:     config.confirm("run_command", true),
+			Run: func(ctx context.Context, env ToolEnv, arguments json.RawMessage) (string, error) {
+				var args struct {
+					Command string   `json:"command"`
+					Args    []string `json:"args"`
+				}
+				if err := json.Unmarshal(arguments, &args); err != nil {
+					return "", fmt.Errorf("invalid arguments: %v", err)
+				}
+				if !containsString(config.Commands, args.Command) {
+					return "", fmt.Errorf("command %s is not allowed", args.Command)
+				}
+				cmd, err := helperCommand(ctx, args.Command, args.Args...)
+				if err != nil {
+					return "", err
+				}
+				output, err := cmd.CombinedOutput()
+				if err != nil {
+					return fmt.Sprintf("%s\n[%v]", output, err), nil
+				}
+				return string(output), nil
+			},
+		},
+		"clipboard_history": clipboardHistoryTool(config, clipboard, history),
+		"get_datetime": {
+			Name:        "get_datetime",
+			Description: "Get the current local date, time and time zone",
+			Parameters:  json.RawMessage(`{"type":"object","properties":{}}`),
+			Confirm:     config.confirm("get_datetime", false),
+			Run: func(ctx context.Context, env ToolEnv, arguments json.RawMessage) (string, error) {
+				return time.Now().Format("Monday, 2006-01-02 15:04:05 MST (-07:00)"), nil
+			},
+		},
+		"get_window_title": {
+			Name:        "get_window_title",
+			Description: "Get the title and application of the window the user was working in",
+			Parameters:  json.RawMessage(`{"type":"object","properties":{}}`),
+			Confirm:     config.confirm("get_window_title", false),
+			Run: func(ctx context.Context, env ToolEnv, arguments json.RawMessage) (string, error) {
+				if env.Window.ID == "" {
+					return "", fmt.Errorf("the focused window is unknown")
+				}
+				return fmt.Sprintf("title: %s\napplication: %s", env.Window.Title, env.Window.Class), nil
+			},
+		},
+	}
+}
+
+// clipboardHistoryTool returns recent clipboard entries, or only the
+// current clipboard when no history is recorded
+func clipboardHistoryTool(config ToolsConfig, clipboard ClipboardBackend, history *ClipboardHistory) Tool {
+	if history == nil {
+		return Tool{
+			Name:        "clipboard_history",
+			Description: "Get the current clipboard content",
+			Parameters:  json.RawMessage(`{"type":"object","properties":{}}`),
+			Confirm:     config.confirm("clipboard_history", false),
+			Run: func(ctx context.Context, env ToolEnv, arguments json.RawMessage) (string, error) {
+				return clipboard.Read()
+			},
+		}
+	}
+	return Tool{
+		Name:        "clipboard_history",
+		Description: "Get the most recent clipboard entries, most recent first",
+		Parameters:  json.RawMessage(`{"type":"object","properties":{"count":{"type":"integer","description":"Number of entries (default 5)"}}}`),
+		Confirm:     config.confirm("clipboard_history", false),
+		Run: func(ctx context.Context, env ToolEnv, arguments json.RawMessage) (string, error) {
+			var args struct {
+				Count int `json:"count"`
+			}
+			if err := json.Unmarshal(arguments, &args); err != nil {
+				return "", fmt.Errorf("invalid arguments: %v", err)
+			}
+			if args.Count <= 0 {
+				args.Count = DefaultClipboardHistoryLast
+			}
+			entries := history.Recent(args.Count)
+			if len(entries) == 0 {
+				return "the clipboard history is empty", nil
+			}
+			return formatClips(entries), nil
+		},
+	}
+}
+
+// newToolRegistry creates the registry of the enabled built-in tools
+func newToolRegistry(config ToolsConfig, clipboard ClipboardBackend, history *ClipboardHistory) (*ToolRegistry, error) {
+	registry := NewToolRegistry(config)
+	if !config.Enabled {
+		return registry, nil
+	}
+	builtins := builtinTools(config, clipboard, history)
+	fileTool := func(name string) bool {
+		return name == "read_file" || name == "list_directory"
+	}
+	names := config.Allow
+	if len(names) == 0 {
+		// The file tools and run_command are useless without roots and commands
+		for name := range builtins {
+			if fileTool(name) && len(config.Roots) == 0 || name == "run_command" && len(config.Commands) == 0 {
+				continue
+			}
+			names = append(names, name)
+		}
+	}
+	for _, name := range names {
+		tool, ok := builtins[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown tool '%s'", name)
+		}
+		if fileTool(name) && len(config.Roots) == 0 {
+			return nil, fmt.Errorf("tool '%s' needs the directories it may access in roots", name)
+		}
+		if err := registry.Register(tool); err != nil {
+			return nil, err
+		}
+	}
+	return registry, nil
+}
+
+// toolSession carries what tool calls need during one interaction
+type toolSession struct {
+	registry *ToolRegistry
+	env      ToolEnv
+	log      *slog.Logger
+	// confirm asks the user whether a tool may run
+	confirm func(ctx context.Context, question string) (bool, error)
+}
+
+// confirm reports whether calls to the tool need the user's approval
+func (tc ToolsConfig) confirm(name string, fallback bool) bool {
+	switch tc.Confirm[name] {
+	case ConfirmAlways:
+		return true
+	case ConfirmNever:
+		return false
+	}
+	return fallback
+}
+
+// maxOutput returns the configured result size limit or the default
+func (tc ToolsConfig) maxOutput() int {
+	if tc.MaxOutputBytes > 0 {
+		return tc.MaxOutputBytes
+	}
+	return DefaultToolMaxOutput
+}
+
+// allowedPath resolves a path given by the model and checks that it lies
+// within one of the configured roots, following symlinks on both sides.
+// Hidden files and directories below a root, such as .ssh or .env, are
+// refused: only a root can name them.
+func (tc ToolsConfig) allowedPath(path string) (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	if path == "" {
+		return "", fmt.Errorf("no path given")
+	}
+	if strings.HasPrefix(path, "~/") {
+		path = path[2:]
+	}
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(home, path)
+	}
+	resolved, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return "", err
+	}
+
+	for _, root := range tc.Roots {
+		if strings.HasPrefix(root, "~/") {
+			root = filepath.Join(home, root[2:])
+		}
+		root, err := filepath.EvalSymlinks(root)
+		if err != nil {
+			continue
+		}
+		rel, err := filepath.Rel(root, resolved)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+			continue
+		}
+		for _, part := range strings.Split(rel, string(filepath.Separator)) {
+			if strings.HasPrefix(part, ".") && part != "." {
+				return "", fmt.Errorf("%s is hidden; list it in roots to allow it", path)
+			}
+		}
+		return resolved, nil
+	}
+	return "", fmt.Errorf("%s is outside the allowed directories", path)
+}
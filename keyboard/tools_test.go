@@ -0,0 +1,124 @@
+package keyboard
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+)
+
+func TestAllowedPath(t *testing.T) {
+	home, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("HOME", home)
+	for _, dir := range []string{"notes/sub", "notes/.ssh", ".config/app", ".config/other"} {
+		if err := os.MkdirAll(filepath.Join(home, dir), 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, file := range []string{"notes/a.txt", "notes/sub/b.txt", "notes/.ssh/id_ed25519", "secret.txt", ".config/app/settings.json", ".config/other/token"} {
+		if err := os.WriteFile(filepath.Join(home, file), []byte("x"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink(filepath.Join(home, "secret.txt"), filepath.Join(home, "notes", "escape")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(home, "notes", "sub"), filepath.Join(home, "notes", "inside")); err != nil {
+		t.Fatal(err)
+	}
+
+	config := ToolsConfig{Roots: []string{"~/notes", filepath.Join(home, ".config/app")}}
+	for _, test := range []struct {
+		path string
+		want string // empty when the path is refused
+	}{
+		{"~/notes/a.txt", "notes/a.txt"},
+		{"notes/a.txt", "notes/a.txt"},
+		{filepath.Join(home, "notes/sub/b.txt"), "notes/sub/b.txt"},
+		{"~/notes", "notes"},
+		{"~/notes/inside/b.txt", "notes/sub/b.txt"},
+		{"~/notes/../secret.txt", ""},
+		{filepath.Join(home, "notes/sub/../../secret.txt"), ""},
+		{"~/notes/escape", ""},
+		{"~/notes/.ssh/id_ed25519", ""},
+		{"~/notes/.ssh", ""},
+		{filepath.Join(home, ".config/app/settings.json"), ".config/app/settings.json"},
+		{"~/.config/other/token", ""},
+		{"~/notes/missing.txt", ""},
+		{"", ""},
+	} {
+		got, err := config.allowedPath(test.path)
+		if test.want == "" {
+			if err == nil {
+				t.Errorf("allowedPath(%q) = %q, want an error", test.path, got)
+			}
+			continue
+		}
+		if want := filepath.Join(home, test.want); err != nil || got != want {
+			t.Errorf("allowedPath(%q) = %q, %v; want %q", test.path, got, err, want)
+		}
+	}
+
+	if _, err := (ToolsConfig{}).allowedPath("~/notes/a.txt"); err == nil {
+		t.Error("allowedPath allowed a path without roots")
+	}
+}
+
+// toolCallingModel serves chat completions that always call a tool, with
+// "answer" as the text, and counts the requests
+func toolCallingModel(t *testing.T) (*httptest.Server, *atomic.Int32) {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := requests.Add(1)
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"id":"%d","object":"chat.completion","choices":[{"index":0,"finish_reason":"tool_calls","message":{"role":"assistant","content":"answer","tool_calls":[{"id":"call-%d","type":"function","function":{"name":"get_datetime","arguments":"{}"}}]}}]}`, n, n)
+	}))
+	t.Cleanup(server.Close)
+	return server, &requests
+}
+
+func TestToolCallsWithoutTools(t *testing.T) {
+	ko := &KeyboardOperator{fileConfig: &Config{}}
+	ctx := context.Background()
+	for _, test := range []struct {
+		name  string
+		tools *toolSession
+		want  int32
+	}{
+		{"no session", nil, 1},
+		{"empty registry", &toolSession{registry: NewToolRegistry(ToolsConfig{}), log: testLogger()}, 1},
+	} {
+		server, requests := toolCallingModel(t)
+		client := newOpenAIClient("test", server.URL)
+		response, err := ko.queryOpenAIWithContext(ctx, testLogger(), client, Profile{Model: "test"}, "hello", "", capturedContext{}, test.tools)
+		if err != nil || response != "answer" {
+			t.Errorf("%s: response = %q, %v; want answer", test.name, response, err)
+		}
+		if got := requests.Load(); got != test.want {
+			t.Errorf("%s: %d requests, want %d", test.name, got, test.want)
+		}
+	}
+
+	// With tools, the model is made to answer once the rounds are used up
+	config := ToolsConfig{Enabled: true, Allow: []string{"get_datetime"}, MaxRounds: 2}
+	registry, err := newToolRegistry(config, ClipboardBackend{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, requests := toolCallingModel(t)
+	session := &toolSession{registry: registry, log: testLogger()}
+	response, err := ko.queryOpenAIWithContext(ctx, testLogger(), newOpenAIClient("test", server.URL), Profile{Model: "test"}, "hello", "", capturedContext{}, session)
+	if err != nil || response != "answer" {
+		t.Errorf("response = %q, %v; want answer", response, err)
+	}
+	if got := requests.Load(); got != 3 {
+		t.Errorf("%d requests, want 3", got)
+	}
+}
@@ -0,0 +1,526 @@
+package keyboard
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+
+	"github.com/godbus/dbus/v5"
+	"github.com/godbus/dbus/v5/introspect"
+	"github.com/godbus/dbus/v5/prop"
+)
+
+const (
+	trayItemPath      = dbus.ObjectPath("/StatusNotifierItem")
+	trayMenuPath      = dbus.ObjectPath("/MenuBar")
+	trayItemInterface = "org.kde.StatusNotifierItem"
+	trayMenuInterface = "com.canonical.dbusmenu"
+	trayWatcher       = "org.kde.StatusNotifierWatcher"
+	trayWatcherPath   = dbus.ObjectPath("/StatusNotifierWatcher")
+)
+
+// Menu item IDs; profiles use trayMenuProfileBase + their index
+const (
+	trayMenuStatus int32 = iota + 1
+	trayMenuCancel
+	trayMenuPause
+	trayMenuProfiles
+	trayMenuHistory
+	trayMenuSeparator
+	trayMenuProfileBase int32 = 100
+)
+
+// trayPixmap is an ARGB32 icon as used by the StatusNotifierItem spec
+type trayPixmap struct {
+	Width  int32
+	Height int32
+	Data   []byte
+}
+
+// trayToolTip is the (sa(iiay)ss) tooltip structure
+type trayToolTip struct {
+	IconName    string
+	IconPixmap  []trayPixmap
+	Title       string
+	Description string
+}
+
+// trayMenuLayout is the recursive (ia{sv}av) dbusmenu layout structure
+type trayMenuLayout struct {
+	ID         int32
+	Properties map[string]dbus.Variant
+	Children   []dbus.Variant
+}
+
+// trayMenuProperties is the (ia{sv}) dbusmenu item properties structure
+type trayMenuProperties struct {
+	ID         int32
+	Properties map[string]dbus.Variant
+}
+
+// trayMenuEvent is the (isvu) dbusmenu event structure
+type trayMenuEvent struct {
+	ID        int32
+	EventID   string
+	Data      dbus.Variant
+	Timestamp uint32
+}
+
+// trayMenuItem is a menu entry built from the operator state
+type trayMenuItem struct {
+	id       int32
+	props    map[string]dbus.Variant
+	children []trayMenuItem
+	action   func() error
+}
+
+// Tray is a StatusNotifierItem showing the operator state, with a menu to
+// cancel the interaction, pause hotkeys, switch profile and open the history
+type Tray struct {
+	logger   *slog.Logger
+	conn     *dbus.Conn
+	operator *KeyboardOperator
+	name     string
+	props    *prop.Properties
+	signals  chan *dbus.Signal
+
+	mu       sync.Mutex
+	revision uint32
+}
+
+// NewTray exports the tray item on an existing connection, such as a
+// private session bus, and registers it with the StatusNotifierWatcher.
+// Close closes the connection.
+func NewTray(conn *dbus.Conn, operator *KeyboardOperator) (*Tray, error) {
+	t := &Tray{
+		logger:   operator.logger,
+		conn:     conn,
+		operator: operator,
+		name:     fmt.Sprintf("org.kde.StatusNotifierItem-%d-1", os.Getpid()),
+		revision: 1,
+	}
+	if err := t.export(); err != nil {
+		return nil, err
+	}
+	reply, err := conn.RequestName(t.name, dbus.NameFlagDoNotQueue)
+	if err != nil {
+		return nil, fmt.Errorf("failed to request bus name %s: %v", t.name, err)
+	}
+	if reply != dbus.RequestNameReplyPrimaryOwner {
+		return nil, fmt.Errorf("bus name %s is already taken", t.name)
+	}
+	if err := t.register(); err != nil {
+		return nil, err
+	}
+
+	// Register again when the tray host (re)starts
+	if err := conn.AddMatchSignal(
+		dbus.WithMatchInterface("org.freedesktop.DBus"),
+		dbus.WithMatchMember("NameOwnerChanged"),
+		dbus.WithMatchArg(0, trayWatcher),
+	); err != nil {
+		t.logger.Warn("cannot watch for tray host restarts", "error", err)
+	} else {
+		t.signals = make(chan *dbus.Signal, 8)
+		conn.Signal(t.signals)
+		go t.watch()
+	}
+
+	operator.OnStatusChange(t.Update)
+	return t, nil
+}
+
+// ConnectTray connects to the session bus and shows the tray item
+func ConnectTray(operator *KeyboardOperator) (*Tray, error) {
+	conn, err := dbus.ConnectSessionBus()
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to the session bus: %v", err)
+	}
+	tray, err := NewTray(conn, operator)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tray, nil
+}
+
+// Close removes the tray item by closing the connection
+func (t *Tray) Close() error {
+	return t.conn.Close()
+}
+
+// export publishes the item and menu objects with their properties
+func (t *Tray) export() error {
+	status := t.operator.Status()
+	itemProps := map[string]*prop.Prop{
+		"Category":            {Value: "ApplicationStatus"},
+		"Id":                  {Value: "keygeist"},
+		"Title":               {Value: trayTitle(status)},
+		"Status":              {Value: trayStatus(status)},
+		"IconName":            {Value: trayIcon(status)},
+		"IconPixmap":          {Value: []trayPixmap{}},
+		"OverlayIconName":     {Value: ""},
+		"AttentionIconName":   {Value: "dialog-error"},
+		"AttentionIconPixmap": {Value: []trayPixmap{}},
+		"ToolTip":             {Value: trayToolTipFor(status)},
+		"ItemIsMenu":          {Value: true},
+		"Menu":                {Value: trayMenuPath},
+	}
+	menuProps := map[string]*prop.Prop{
+		"Version":       {Value: uint32(3)},
+		"TextDirection": {Value: "ltr"},
+		"Status":        {Value: "normal"},
+		"IconThemePath": {Value: []string{}},
+	}
+
+	item := &trayItem{t}
+	if err := t.conn.Export(item, trayItemPath, trayItemInterface); err != nil {
+		return fmt.Errorf("failed to export tray item: %v", err)
+	}
+	props, err := prop.Export(t.conn, trayItemPath, prop.Map{trayItemInterface: itemProps})
+	if err != nil {
+		return fmt.Errorf("failed to export tray properties: %v", err)
+	}
+	t.props = props
+	menu := &trayMenu{t}
+	if err := t.conn.Export(menu, trayMenuPath, trayMenuInterface); err != nil {
+		return fmt.Errorf("failed to export tray menu: %v", err)
+	}
+	menuProperties, err := prop.Export(t.conn, trayMenuPath, prop.Map{trayMenuInterface: menuProps})
+	if err != nil {
+		return fmt.Errorf("failed to export tray menu properties: %v", err)
+	}
+
+	for path, iface := range map[dbus.ObjectPath]introspect.Interface{
+		trayItemPath: {
+			Name:       trayItemInterface,
+			Methods:    introspect.Methods(item),
+			Properties: props.Introspection(trayItemInterface),
+			Signals: []introspect.Signal{
+				{Name: "NewTitle"}, {Name: "NewIcon"}, {Name: "NewAttentionIcon"}, {Name: "NewToolTip"},
+				{Name: "NewStatus", Args: []introspect.Arg{{Name: "status", Type: "s"}}},
+			},
+		},
+		trayMenuPath: {
+			Name:       trayMenuInterface,
+			Methods:    introspect.Methods(menu),
+			Properties: menuProperties.Introspection(trayMenuInterface),
+			Signals: []introspect.Signal{
+				{Name: "LayoutUpdated", Args: []introspect.Arg{{Name: "revision", Type: "u"}, {Name: "parent", Type: "i"}}},
+			},
+		},
+	} {
+		node := &introspect.Node{
+			Name:       string(path),
+			Interfaces: []introspect.Interface{introspect.IntrospectData, prop.IntrospectData, iface},
+		}
+		if err := t.conn.Export(introspect.NewIntrospectable(node), path, "org.freedesktop.DBus.Introspectable"); err != nil {
+			return fmt.Errorf("failed to export tray introspection: %v", err)
+		}
+	}
+	return nil
+}
+
+// register announces the item to the StatusNotifierWatcher
+func (t *Tray) register() error {
+	err := t.conn.Object(trayWatcher, trayWatcherPath).Call(trayWatcher+".RegisterStatusNotifierItem", 0, t.name).Err
+	if err != nil {
+		return fmt.Errorf("failed to register with %s (is a tray running?): %v", trayWatcher, err)
+	}
+	return nil
+}
+
+// watch registers the item again whenever a new watcher appears
+func (t *Tray) watch() {
+	for signal := range t.signals {
+		if signal.Name != "org.freedesktop.DBus.NameOwnerChanged" || len(signal.Body) < 3 {
+			continue
+		}
+		if newOwner, _ := signal.Body[2].(string); newOwner != "" {
+			if err := t.register(); err != nil {
+				t.logger.Warn("failed to register tray item", "error", err)
+			}
+		}
+	}
+}
+
+// Update shows a new operator status
+func (t *Tray) Update(status InteractionStatus) {
+	t.props.SetMust(trayItemInterface, "Title", trayTitle(status))
+	t.props.SetMust(trayItemInterface, "Status", trayStatus(status))
+	t.props.SetMust(trayItemInterface, "IconName", trayIcon(status))
+	t.props.SetMust(trayItemInterface, "ToolTip", trayToolTipFor(status))
+	t.emit(trayItemPath, trayItemInterface+".NewTitle")
+	t.emit(trayItemPath, trayItemInterface+".NewIcon")
+	t.emit(trayItemPath, trayItemInterface+".NewToolTip")
+	t.emit(trayItemPath, trayItemInterface+".NewStatus", trayStatus(status))
+
+	t.mu.Lock()
+	t.revision++
+	revision := t.revision
+	t.mu.Unlock()
+	t.emit(trayMenuPath, trayMenuInterface+".LayoutUpdated", revision, int32(0))
+}
+
+func (t *Tray) emit(path dbus.ObjectPath, name string, values ...interface{}) {
+	if err := t.conn.Emit(path, name, values...); err != nil {
+		t.logger.Debug("failed to emit tray signal", "signal", name, "error", err)
+	}
+}
+
+// menu builds the menu from the current operator state
+func (t *Tray) menu() trayMenuItem {
+	ko := t.operator
+	status := ko.Status()
+
+	activeProfile, _ := ko.ActiveProfile()
+	var profiles []trayMenuItem
+	for i, name := range ko.Profiles() {
+		name := name
+		state := int32(0)
+		if name == activeProfile {
+			state = 1
+		}
+		profiles = append(profiles, trayMenuItem{
+			id: trayMenuProfileBase + int32(i),
+			props: map[string]dbus.Variant{
+				"label":        dbus.MakeVariant(fmt.Sprintf("%s (%s)", name, ko.ProfileModel(name))),
+				"toggle-type":  dbus.MakeVariant("radio"),
+				"toggle-state": dbus.MakeVariant(state),
+			},
+			action: func() error { return ko.SetProfile(name) },
+		})
+	}
+
+	paused := int32(0)
+	if status.Paused {
+		paused = 1
+	}
+	return trayMenuItem{
+		id:    0,
+		props: map[string]dbus.Variant{"children-display": dbus.MakeVariant("submenu")},
+		children: []trayMenuItem{
+			{
+				id: trayMenuStatus,
+				props: map[string]dbus.Variant{
+					"label":   dbus.MakeVariant(status.String()),
+					"enabled": dbus.MakeVariant(false),
+				},
+			},
+			{
+				id:    trayMenuSeparator,
+				props: map[string]dbus.Variant{"type": dbus.MakeVariant("separator")},
+			},
+			{
+				id: trayMenuCancel,
+				props: map[string]dbus.Variant{
+					"label":   dbus.MakeVariant("Cancel interaction"),
+					"enabled": dbus.MakeVariant(ko.Interacting()),
+				},
+				action: func() error {
+					ko.StopCurrentInteraction()
+					return nil
+				},
+			},
+			{
+				id: trayMenuPause,
+				props: map[string]dbus.Variant{
+					"label":        dbus.MakeVariant("Pause hotkeys"),
+					"toggle-type":  dbus.MakeVariant("checkmark"),
+					"toggle-state": dbus.MakeVariant(paused),
+				},
+				action: func() error {
+					ko.TogglePause()
+					return nil
+				},
+			},
+			{
+				id: trayMenuProfiles,
+				props: map[string]dbus.Variant{
+					"label":            dbus.MakeVariant("Profile"),
+					"children-display": dbus.MakeVariant("submenu"),
+				},
+				children: profiles,
+			},
+			{
+				id: trayMenuHistory,
+				props: map[string]dbus.Variant{
+					"label":   dbus.MakeVariant("Open history"),
+					"enabled": dbus.MakeVariant(ko.HistoryEnabled()),
+				},
+				action: ko.OpenHistory,
+			},
+		},
+	}
+}
+
+// find returns the item with the given ID
+func (item trayMenuItem) find(id int32) (trayMenuItem, bool) {
+	if item.id == id {
+		return item, true
+	}
+	for _, child := range item.children {
+		if found, ok := child.find(id); ok {
+			return found, true
+		}
+	}
+	return trayMenuItem{}, false
+}
+
+// layout converts the item to the dbusmenu structure, down to depth levels
+// of children (-1 for all)
+func (item trayMenuItem) layout(depth int32) trayMenuLayout {
+	layout := trayMenuLayout{ID: item.id, Properties: item.props, Children: []dbus.Variant{}}
+	if depth == 0 {
+		return layout
+	}
+	for _, child := range item.children {
+		layout.Children = append(layout.Children, dbus.MakeVariant(child.layout(depth-1)))
+	}
+	return layout
+}
+
+// trayStatus maps the operator status to the item status
+func trayStatus(status InteractionStatus) string {
+	switch {
+	case status.State == StateError:
+		return "NeedsAttention"
+	case status.Paused && status.State == StateIdle:
+		return "Passive"
+	default:
+		return "Active"
+	}
+}
+
+// trayIcon returns a themed icon name for the operator status
+func trayIcon(status InteractionStatus) string {
+	switch status.State {
+	case StateCapturing:
+		return "camera-photo"
+	case StatePrompting:
+		return "document-edit"
+	case StateRecording:
+		return "audio-input-microphone"
+	case StateTranscribing:
+		return "content-loading"
+	case StateWaiting:
+		return "content-loading"
+	case StateTyping:
+		return "input-keyboard"
+	case StateConfirming:
+		return "dialog-question"
+	case StateDelivering:
+		return "document-send"
+	case StateError:
+		return "dialog-error"
+	}
+	if status.Paused {
+		return "media-playback-pause"
+	}
+	return "input-keyboard"
+}
+
+func trayTitle(status InteractionStatus) string {
+	return "Keygeist: " + status.String()
+}
+
+func trayToolTipFor(status InteractionStatus) trayToolTip {
+	return trayToolTip{
+		IconName:    trayIcon(status),
+		IconPixmap:  []trayPixmap{},
+		Title:       "Keygeist",
+		Description: fmt.Sprintf("%s\nProfile: %s", status.String(), status.Profile),
+	}
+}
+
+// trayItem implements the org.kde.StatusNotifierItem methods
+type trayItem struct {
+	tray *Tray
+}
+
+// Activate is called on a primary click; the host shows the menu instead
+// since ItemIsMenu is set
+func (i *trayItem) Activate(x, y int32) *dbus.Error { return nil }
+
+// SecondaryActivate is called on a middle click and toggles the pause
+func (i *trayItem) SecondaryActivate(x, y int32) *dbus.Error {
+	i.tray.operator.TogglePause()
+	return nil
+}
+
+func (i *trayItem) ContextMenu(x, y int32) *dbus.Error { return nil }
+
+func (i *trayItem) Scroll(delta int32, orientation string) *dbus.Error { return nil }
+
+// trayMenu implements the com.canonical.dbusmenu methods
+type trayMenu struct {
+	tray *Tray
+}
+
+func (m *trayMenu) GetLayout(parentID int32, recursionDepth int32, propertyNames []string) (uint32, trayMenuLayout, *dbus.Error) {
+	m.tray.mu.Lock()
+	revision := m.tray.revision
+	m.tray.mu.Unlock()
+
+	item, ok := m.tray.menu().find(parentID)
+	if !ok {
+		return 0, trayMenuLayout{}, dbus.MakeFailedError(fmt.Errorf("unknown menu item %d", parentID))
+	}
+	return revision, item.layout(recursionDepth), nil
+}
+
+func (m *trayMenu) GetGroupProperties(ids []int32, propertyNames []string) ([]trayMenuProperties, *dbus.Error) {
+	menu := m.tray.menu()
+	result := []trayMenuProperties{}
+	for _, id := range ids {
+		if item, ok := menu.find(id); ok {
+			result = append(result, trayMenuProperties{ID: id, Properties: item.props})
+		}
+	}
+	return result, nil
+}
+
+func (m *trayMenu) GetProperty(id int32, name string) (dbus.Variant, *dbus.Error) {
+	item, ok := m.tray.menu().find(id)
+	if !ok {
+		return dbus.Variant{}, dbus.MakeFailedError(fmt.Errorf("unknown menu item %d", id))
+	}
+	value, ok := item.props[name]
+	if !ok {
+		return dbus.Variant{}, dbus.MakeFailedError(fmt.Errorf("unknown property %s", name))
+	}
+	return value, nil
+}
+
+func (m *trayMenu) Event(id int32, eventID string, data dbus.Variant, timestamp uint32) *dbus.Error {
+	if eventID != "clicked" {
+		return nil
+	}
+	item, ok := m.tray.menu().find(id)
+	if !ok || item.action == nil {
+		return nil
+	}
+	// Run outside the D-Bus handler, actions may update the tray themselves
+	go func() {
+		if err := item.action(); err != nil {
+			m.tray.logger.Warn("tray menu action failed", "item", id, "error", err)
+		}
+	}()
+	return nil
+}
+
+func (m *trayMenu) EventGroup(events []trayMenuEvent) ([]int32, *dbus.Error) {
+	for _, event := range events {
+		m.Event(event.ID, event.EventID, event.Data, event.Timestamp)
+	}
+	return []int32{}, nil
+}
+
+func (m *trayMenu) AboutToShow(id int32) (bool, *dbus.Error) {
+	return false, nil
+}
+
+func (m *trayMenu) AboutToShowGroup(ids []int32) ([]int32, []int32, *dbus.Error) {
+	return []int32{}, []int32{}, nil
+}
@@ -0,0 +1,28 @@
+package keyboard
+
+import (
+	"bytes"
+	"text/template"
+)
+
+// UdevRulesPath is where the udev rules granting device access are installed
+const UdevRulesPath = "/etc/udev/rules.d/99-uinput-keyboard.rules"
+
+// udevRulesTemplate grants the uinput and input groups access to the devices
+var udevRulesTemplate = template.Must(template.New("udev").Parse(`# Installed by keygeist
+# Allow members of {{.UinputGroup}} to create virtual keyboards
+KERNEL=="uinput", SUBSYSTEM=="misc", MODE="0660", GROUP="{{.UinputGroup}}", OPTIONS+="static_node=uinput"
+
+# Allow members of {{.InputGroup}} to read input devices
+SUBSYSTEM=="input", KERNEL=="event*", MODE="0660", GROUP="{{.InputGroup}}"
+`))
+
+// RenderUdevRules renders the udev rules for the given group names
+func RenderUdevRules(uinputGroup, inputGroup string) string {
+	var buf bytes.Buffer
+	_ = udevRulesTemplate.Execute(&buf, struct {
+		UinputGroup string
+		InputGroup  string
+	}{uinputGroup, inputGroup})
+	return buf.String()
+}
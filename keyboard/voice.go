@@ -0,0 +1,242 @@
+package keyboard
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"os/exec"
+	"strings"
+	"time"
+
+	openai "github.com/sashabaranov/go-openai"
+)
+
+// Audio format recorded for transcription: 16 kHz mono signed 16-bit
+const (
+	voiceSampleRate = 16000
+	voiceFrame      = voiceSampleRate / 50 * 2 // 20ms of samples, in bytes
+)
+
+// voiceBinding is the name of the push-to-talk binding
+const voiceBinding = "voice"
+
+// Voice defaults used when the configuration doesn't set them
+const (
+	DefaultVoiceModel            = "whisper-1"
+	DefaultVoiceSilence          = 1500 * time.Millisecond
+	DefaultVoiceNoSpeech         = 5 * time.Second
+	DefaultVoiceMaxDuration      = 30 * time.Second
+	DefaultVoiceSilenceThreshold = 500
+)
+
+// voiceRecorders are the recording commands by name, writing raw audio in
+// the format above to their standard output
+var voiceRecorders = map[string][]string{
+	"pw-record": {"pw-record", "--rate", "16000", "--channels", "1", "--format", "s16", "-"},
+	"parec":     {"parec", "--raw", "--rate=16000", "--channels=1", "--format=s16le"},
+}
+
+// recorderCommand returns the configured recorder, or the first one
+// installed
+func (vc VoiceConfig) recorderCommand() ([]string, error) {
+	if vc.Recorder != "" && vc.Recorder != "auto" {
+		command, ok := voiceRecorders[vc.Recorder]
+		if !ok {
+			return nil, fmt.Errorf("unknown recorder '%s'", vc.Recorder)
+		}
+		return command, nil
+	}
+	for _, name := range []string{"pw-record", "parec"} {
+		if _, err := exec.LookPath(name); err == nil {
+			return voiceRecorders[name], nil
+		}
+	}
+	return nil, fmt.Errorf("no recorder found; install pw-record (PipeWire) or parec (PulseAudio)")
+}
+
+// errNoSpeech is returned when nothing was said before the timeout
+var errNoSpeech = fmt.Errorf("no speech detected")
+
+// recordVoice records from the default microphone until stop is closed
+// (push-to-talk release), the speaker has been silent for long enough after
+// speaking, or the maximum duration is reached. It returns raw PCM samples.
+func recordVoice(ctx context.Context, log *slog.Logger, config VoiceConfig, stop <-chan struct{}) ([]byte, error) {
+	command, err := config.recorderCommand()
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, config.maxDuration())
+	defer cancel()
+	cmd, err := helperCommand(ctx, command[0], command[1:]...)
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to start %s: %v", command[0], err)
+	}
+	defer func() {
+		cancel()
+		cmd.Wait()
+	}()
+
+	// Frames are read in the background so that stop is noticed at once
+	frames := make(chan []byte, 64)
+	go func() {
+		defer close(frames)
+		for {
+			frame := make([]byte, voiceFrame)
+			if _, err := io.ReadFull(stdout, frame); err != nil {
+				return
+			}
+			frames <- frame
+		}
+	}()
+
+	var pcm bytes.Buffer
+	start := time.Now()
+	var spoke bool
+	var lastVoice time.Time
+	for {
+		select {
+		case <-stop:
+			log.Debug("recording stopped by key release", "duration", time.Since(start))
+			return pcm.Bytes(), nil
+		case frame, ok := <-frames:
+			if !ok {
+				if ctx.Err() == context.DeadlineExceeded {
+					log.Info("recording reached the maximum duration")
+					return pcm.Bytes(), nil
+				}
+				if ctx.Err() != nil {
+					return nil, ctx.Err()
+				}
+				return nil, fmt.Errorf("%s stopped: %s", command[0], strings.TrimSpace(stderr.String()))
+			}
+			pcm.Write(frame)
+			now := time.Now()
+			if frameLevel(frame) >= config.silenceThreshold() {
+				spoke = true
+				lastVoice = now
+			}
+			if stop != nil {
+				// Push-to-talk ends with the key release only
+				continue
+			}
+			if spoke && now.Sub(lastVoice) >= config.silence() {
+				log.Debug("recording stopped after silence", "duration", time.Since(start))
+				return pcm.Bytes(), nil
+			}
+			if !spoke && now.Sub(start) >= config.noSpeech() {
+				return nil, errNoSpeech
+			}
+		}
+	}
+}
+
+// frameLevel returns the RMS level of 16-bit little-endian samples
+func frameLevel(frame []byte) float64 {
+	var sum float64
+	samples := len(frame) / 2
+	for i := 0; i < samples; i++ {
+		sample := float64(int16(binary.LittleEndian.Uint16(frame[i*2:])))
+		sum += sample * sample
+	}
+	if samples == 0 {
+		return 0
+	}
+	return math.Sqrt(sum / float64(samples))
+}
+
+// encodeWAV wraps raw PCM samples in a WAV header
+func encodeWAV(pcm []byte) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("RIFF")
+	binary.Write(&buf, binary.LittleEndian, uint32(36+len(pcm)))
+	buf.WriteString("WAVEfmt ")
+	binary.Write(&buf, binary.LittleEndian, uint32(16))                // fmt chunk size
+	binary.Write(&buf, binary.LittleEndian, uint16(1))                 // PCM
+	binary.Write(&buf, binary.LittleEndian, uint16(1))                 // mono
+	binary.Write(&buf, binary.LittleEndian, uint32(voiceSampleRate))   // sample rate
+	binary.Write(&buf, binary.LittleEndian, uint32(voiceSampleRate*2)) // byte rate
+	binary.Write(&buf, binary.LittleEndian, uint16(2))                 // block align
+	binary.Write(&buf, binary.LittleEndian, uint16(16))                // bits per sample
+	buf.WriteString("data")
+	binary.Write(&buf, binary.LittleEndian, uint32(len(pcm)))
+	buf.Write(pcm)
+	return buf.Bytes()
+}
+
+// transcribe sends recorded audio to the /audio/transcriptions endpoint
+func transcribe(ctx context.Context, client *openai.Client, config VoiceConfig, pcm []byte) (string, error) {
+	resp, err := client.CreateTranscription(ctx, openai.AudioRequest{
+		Model:    config.model(),
+		FilePath: "prompt.wav",
+		Reader:   bytes.NewReader(encodeWAV(pcm)),
+		Language: config.Language,
+		Format:   openai.AudioResponseFormatJSON,
+	})
+	if err != nil {
+		return "", fmt.Errorf("transcription API error: %v", err)
+	}
+	return strings.TrimSpace(resp.Text), nil
+}
+
+// voicePrompt records and transcribes a spoken prompt, showing a
+// notification while the microphone is open. Push-to-talk bindings stop
+// recording when released, others when the speaker pauses.
+func (ko *KeyboardOperator) voicePrompt(ctx context.Context, log *slog.Logger, job *interactionJob) (string, error) {
+	if ko.voiceClient == nil {
+		return "", fmt.Errorf("voice input is not enabled")
+	}
+	config := ko.fileConfig.Voice
+	released := job.released
+	select {
+	case <-released:
+		// Released before the microphone opened: a tap, so detect the end
+		// of speech instead
+		released = nil
+	default:
+	}
+	body := "Speak now, recording stops when you pause"
+	if released != nil {
+		body = "Speak now, release the keys to stop"
+	}
+	ko.setJobState(job, StateRecording)
+	ko.notify(log, Notification{Summary: "Keygeist: listening…", Body: body, Urgency: UrgencyNormal, Timeout: -1})
+
+	start := time.Now()
+	pcm, err := recordVoice(ctx, log, config, released)
+	if err == errNoSpeech {
+		log.Info("no speech detected")
+		ko.notify(log, Notification{Summary: "Keygeist: no speech detected", Urgency: UrgencyLow, Timeout: 3 * time.Second})
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	log.Info("recorded voice prompt", "duration", time.Since(start), "bytes", len(pcm))
+	if len(pcm) < voiceSampleRate/5*2 {
+		// Less than 200ms is a slip of the finger
+		return "", nil
+	}
+
+	ko.setJobState(job, StateTranscribing)
+	ko.notify(log, Notification{Summary: "Keygeist: transcribing…", Urgency: UrgencyLow, Timeout: -1})
+	start = time.Now()
+	text, err := transcribe(ctx, ko.voiceClient, config, pcm)
+	if err != nil {
+		return "", err
+	}
+	log.Info("transcribed voice prompt", "chars", len(text), "latency", time.Since(start))
+	return text, nil
+}